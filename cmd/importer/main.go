@@ -0,0 +1,54 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command importer converts the documents of the Python implementation of
+// Armada into ArmadaChart, ArmadaChartGroup and ArmadaManifest custom
+// resources, written to the standard output.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keleustes/armada-operator/pkg/importer"
+)
+
+func main() {
+	filename := flag.String("f", "-", "file containing the Armada documents, - for the standard input")
+	namespace := flag.String("namespace", "", "namespace of the custom resources")
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if *filename != "-" {
+		file, err := os.Open(*filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	objs, err := importer.Convert(in, *namespace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := importer.Write(os.Stdout, objs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -6,11 +6,19 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/keleustes/armada-crd/pkg/apis"
 	"github.com/keleustes/armada-operator/pkg/controller"
 	"github.com/keleustes/armada-operator/pkg/k8sutil"
+	"github.com/keleustes/armada-operator/pkg/services"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -18,6 +26,25 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
+// readinessRulesReloadPeriod is the period at which the readiness rules
+// ConfigMap is reloaded.
+const readinessRulesReloadPeriod = time.Minute
+
+// cachedObjectSelectors restricts the objects held by the cache of the manager.
+// The Secrets storing the Helm releases, labeled owner=helm, are left out:
+// the Secrets storage driver of the helm manager factory reads and writes them
+// through its own clientset, created with kubernetes.NewForConfig, which goes
+// to the API server directly. The cache only holds the Secrets the operator
+// reads through the client of the manager: the ones referenced by the
+// substitutions of the ArmadaCharts and by the ArmadaBackups, and the plans
+// of the ArmadaManifests.
+func cachedObjectSelectors() cache.SelectorsByObject {
+	helmReleases, _ := labels.NewRequirement("owner", selection.NotEquals, []string{"helm"})
+	return cache.SelectorsByObject{
+		&corev1.Secret{}: {Label: labels.NewSelector().Add(*helmReleases)},
+	}
+}
+
 // Change below variables to serve metrics on different host or port.
 var log = logf.Log.WithName("cmd")
 
@@ -65,6 +92,7 @@ func main() {
 	// Create a new Cmd to provide shared dependencies and start components
 	mgr, err := manager.New(cfg, manager.Options{
 		Namespace: namespace,
+		NewCache:  cache.BuilderWithOptions(cache.Options{SelectorsByObject: cachedObjectSelectors()}),
 		// MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
 	})
 	if err != nil {
@@ -80,6 +108,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Load the readiness rules of the third-party custom resources
+	if name, found := os.LookupEnv(k8sutil.ReadinessRulesConfigMapEnvVar); found {
+		operatorNamespace, err := k8sutil.GetOperatorNamespace()
+		if err != nil {
+			log.Error(err, "Failed to get operator namespace")
+			os.Exit(1)
+		}
+		key := types.NamespacedName{Namespace: operatorNamespace, Name: name}
+		if err := services.DefaultReadinessRegistry.LoadReadinessRules(ctx, mgr.GetAPIReader(), key); err != nil {
+			log.Error(err, "Failed to load readiness rules")
+			os.Exit(1)
+		}
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			services.DefaultReadinessRegistry.WatchReadinessRules(ctx, mgr.GetAPIReader(), key, readinessRulesReloadPeriod)
+			return nil
+		})); err != nil {
+			log.Error(err, "Failed to watch readiness rules")
+			os.Exit(1)
+		}
+	}
+
 	// Setup all Controllers
 	if err := controller.AddToManager(mgr); err != nil {
 		log.Error(err, "")
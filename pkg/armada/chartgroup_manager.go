@@ -16,12 +16,17 @@ package armada
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	armadaif "github.com/keleustes/armada-operator/pkg/services"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -31,12 +36,18 @@ import (
 var acglog = logf.Log.WithName("acg-manager")
 
 type chartgroupmanager struct {
-	kubeClient       client.Client
-	resourceName     string
-	namespace        string
-	spec             *av1.ArmadaChartGroupSpec
-	status           *av1.ArmadaChartGroupStatus
-	deployedResource *av1.ArmadaCharts
+	kubeClient           client.Client
+	scheme               *runtime.Scheme
+	owner                *av1.ArmadaChartGroup
+	resourceName         string
+	namespace            string
+	spec                 *av1.ArmadaChartGroupSpec
+	status               *av1.ArmadaChartGroupStatus
+	deployedResource     *av1.ArmadaCharts
+	charts               []string
+	maxConcurrency       int
+	orphanPolicy         armadaif.OrphanPolicy
+	uninstallStepTimeout time.Duration
 
 	isInstalled      bool
 	isUpdateRequired bool
@@ -55,21 +66,47 @@ func (m chartgroupmanager) IsUpdateRequired() bool {
 	return m.isUpdateRequired
 }
 
+// OrphanPolicy returns the orphan_policy read from the spec by Sync.
+func (m chartgroupmanager) OrphanPolicy() armadaif.OrphanPolicy {
+	return m.orphanPolicy
+}
+
 // Sync detects which ArmadaCharts are already present for that ArmadaChartGroup
 // to proceed. The ArmadaChartGroup should not proceed until all the Charts
 // are present in the system
 func (m *chartgroupmanager) Sync(ctx context.Context) error {
 	m.deployedResource = av1.NewArmadaCharts(m.resourceName)
+
+	ext, err := armadaif.GetArmadaChartGroupSpecExtensions(ctx, m.kubeClient, m.owner)
+	if err != nil {
+		m.isUpdateRequired = false
+		return err
+	}
+	m.orphanPolicy = ext.OrphanPolicy
+	m.maxConcurrency = ext.MaxConcurrency
+	if m.maxConcurrency == 0 {
+		m.maxConcurrency = armadaif.GetDefaultMaxConcurrency(m.owner.GetAnnotations())
+	}
+
+	charts, err := chartGroupMembers(ctx, m.kubeClient, m.owner)
+	if err != nil {
+		m.isUpdateRequired = false
+		return err
+	}
+	m.charts = charts
+
 	errs := make([]error, 0)
-	targetResourceList := m.expectedChartList()
-	for _, existingResource := range targetResourceList.List.Items {
-		err := m.kubeClient.Get(context.TODO(), types.NamespacedName{Name: existingResource.GetName(), Namespace: existingResource.GetNamespace()}, &existingResource)
+	missing := make([]string, 0)
+	for _, key := range m.expectedCharts() {
+		existingResource := av1.ArmadaChart{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
 		if err != nil {
-			if !apierrors.IsNotFound(err) {
-				// Don't want to trace is the error is not a NotFound.
-				acglog.Error(err, "Can't not retrieve ArmadaChart")
+			if apierrors.IsNotFound(err) {
+				missing = append(missing, key.Name)
+			} else {
+				acglog.Error(err, "Can't not retrieve ArmadaChart", "name", key.Name)
+				errs = append(errs, err)
 			}
-			errs = append(errs, err)
 		} else {
 			m.deployedResource.List.Items = append(m.deployedResource.List.Items, existingResource)
 		}
@@ -77,69 +114,107 @@ func (m *chartgroupmanager) Sync(ctx context.Context) error {
 
 	acglog.Info("Charts", "deployedResources", m.deployedResource.States())
 
-	// The ChartGroup manager is not in charge of creating the ArmaChart since it
-	// only contains the name of the charts.
+	// The ArmadaChartGroup manager is not in charge of creating the ArmadaChart since it
+	// only contains their names.
 	if len(errs) != 0 {
-		// Regardless if the error is NotFound or something else,
-		// we can't sync the ArmadaChartGroup with content of Kubernetes.
+		// We can't sync the ArmadaChartGroup with content of Kubernetes.
 		m.isUpdateRequired = false
 		return errs[0]
 	}
+	if len(missing) != 0 {
+		m.isUpdateRequired = false
+		return &armadaif.MissingResourcesError{Kind: "ArmadaChart", Names: missing}
+	}
 
-	// TODO(jeb): We should check that the ArmadaChartGroup is still not the "owner" of
-	// chartgroups which are not listed in its Spec anymore. In such as case we should put
-	// the isUpdateRequired to true.
+	// The ArmadaCharts still owned but no longer members of the group are handled
+	// by HandleOrphans according to the orphan policy.
+	// The children not controlled yet are adopted by Install until the
+	// resource is deployed, and by Update afterwards.
 	m.isUpdateRequired = false
 	m.isInstalled = true
-	if m.status.ActualState != av1.StateDeployed {
-		for _, deployedResource := range m.deployedResource.List.Items {
-			existingRefs := deployedResource.GetOwnerReferences()
-			if len(existingRefs) == 0 {
-				m.isInstalled = false
-			}
+	for i := range m.deployedResource.List.Items {
+		ref := metav1.GetControllerOf(&m.deployedResource.List.Items[i])
+		if ref != nil && ref.UID == m.owner.GetUID() {
+			continue
+		}
+		if m.status.ActualState != av1.StateDeployed {
+			m.isInstalled = false
+		} else {
+			m.isUpdateRequired = true
 		}
 	}
 
 	return nil
 }
 
-// InstallResource checks that the corresponding charts
+// InstallResource checks that the corresponding charts are present and
+// adopts them as controller. It fails if one of them is already controlled by
+// another ArmadaChartGroup.
 // TODO(jeb): We should most likely update the target_state is not already done.
-// TODO(jeb): We should also update the the owner of the charts.
 func (m chartgroupmanager) InstallResource(ctx context.Context) (*av1.ArmadaCharts, error) {
+	errs := make([]error, 0)
 	installedResources := av1.NewArmadaCharts(m.resourceName)
-	targetResourceList := m.expectedChartList()
-	for _, existingResource := range targetResourceList.List.Items {
-		err := m.kubeClient.Get(context.TODO(), types.NamespacedName{Name: existingResource.GetName(), Namespace: existingResource.GetNamespace()}, &existingResource)
-		if err == nil {
-			installedResources.List.Items = append(installedResources.List.Items, existingResource)
+	for _, key := range m.expectedCharts() {
+		existingResource := av1.ArmadaChart{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
+		if err != nil {
+			continue
+		}
+
+		adopted, err := adopt(m.owner, &existingResource, m.scheme)
+		if err != nil {
+			acglog.Error(err, "Can't adopt ArmadaChart", "name", existingResource.GetName())
+			errs = append(errs, err)
+			continue
+		}
+		if adopted {
+			if err := m.kubeClient.Update(context.TODO(), &existingResource); err != nil {
+				acglog.Error(err, "Can't adopt ArmadaChart", "name", existingResource.GetName())
+				errs = append(errs, err)
+				continue
+			}
+			acglog.Info("Adopted ArmadaChart", "name", existingResource.GetName())
 		}
+		installedResources.List.Items = append(installedResources.List.Items, existingResource)
 	}
 
+	if len(errs) != 0 {
+		return installedResources, errs[0]
+	}
 	return installedResources, nil
 }
 
-// UpdateResource performs an update of an ArmadaChartGroup.
-// Currently either the list of Charts or the Sequenced attribute may have change.
+// UpdateResource performs an update of an ArmadaChartGroup. The specs of the
+// ArmadaCharts belong to their authors and are never rewritten, hence only the
+// live objects are refreshed and the new members adopted.
 func (m chartgroupmanager) UpdateResource(ctx context.Context) (*av1.ArmadaCharts, *av1.ArmadaCharts, error) {
-	errs := make([]error, 0)
-	toUpdateList := m.expectedChartList()
-	for _, toUpdate := range (*toUpdateList).List.Items {
-		err := m.kubeClient.Update(context.TODO(), &toUpdate)
+	updatedResources := av1.NewArmadaCharts(m.resourceName)
+	for _, key := range m.expectedCharts() {
+		existingResource := av1.ArmadaChart{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
 		if err != nil {
-			acglog.Error(err, "Can't not Update ArmadaChart")
-			errs = append(errs, err)
+			if apierrors.IsNotFound(err) {
+				return nil, nil, armadaif.ErrNotFound
+			}
+			return nil, nil, err
 		}
-	}
 
-	if len(errs) != 0 {
-		if apierrors.IsNotFound(errs[0]) {
-			return nil, nil, armadaif.ErrNotFound
-		} else {
-			return nil, nil, errs[0]
+		// The charts added to the group since the installation are adopted.
+		adopted, err := adopt(m.owner, &existingResource, m.scheme)
+		if err != nil {
+			acglog.Error(err, "Can't adopt ArmadaChart", "name", existingResource.GetName())
+			return nil, nil, err
+		}
+		if adopted {
+			if err := m.kubeClient.Update(context.TODO(), &existingResource); err != nil {
+				acglog.Error(err, "Can't adopt ArmadaChart", "name", existingResource.GetName())
+				return nil, nil, err
+			}
+			acglog.Info("Adopted ArmadaChart", "name", existingResource.GetName())
 		}
+		updatedResources.List.Items = append(updatedResources.List.Items, existingResource)
 	}
-	return m.deployedResource, toUpdateList, nil
+	return m.deployedResource, updatedResources, nil
 }
 
 // ReconcileResource creates or patches resources as necessary to match the
@@ -147,6 +222,19 @@ func (m chartgroupmanager) UpdateResource(ctx context.Context) (*av1.ArmadaChart
 func (m chartgroupmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaCharts, error) {
 	errs := make([]error, 0)
 
+	// Propagate the release prefix received from the ArmadaManifest to the ArmadaCharts.
+	if prefix, found := m.owner.GetAnnotations()[armadaif.AnnotationReleasePrefix]; found {
+		for i := range m.deployedResource.List.Items {
+			chart := &m.deployedResource.List.Items[i]
+			if setAnnotation(chart, armadaif.AnnotationReleasePrefix, prefix) {
+				if err := m.kubeClient.Update(context.TODO(), chart); err != nil {
+					acglog.Error(err, "Can't propagate release prefix to ArmadaChart", "name", chart.GetName())
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
 	var chartsToEnable *av1.ArmadaCharts
 	if m.spec.Sequenced {
 		// If Sequenced is enabled, let's compute the next one to enable.
@@ -158,8 +246,14 @@ func (m chartgroupmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaCh
 			chartsToEnable.List.Items = append(chartsToEnable.List.Items, *nextToEnable)
 		}
 	} else {
-		// If Sequenced is false, all the Charts in disabled state should be enabled.
-		chartsToEnable = m.deployedResource.GetAllDisabledCharts()
+		// If Sequenced is false, the Charts in disabled state whose dependencies
+		// are deployed should be enabled.
+		graph, err := newChartDependencyGraph(m.deployedResource)
+		if err != nil {
+			acglog.Error(err, "Can't order the ArmadaCharts", "name", m.resourceName)
+			return m.deployedResource, err
+		}
+		chartsToEnable = m.limitConcurrency(graph.GetChartsToEnable(m.resourceName))
 	}
 
 	for _, nextToEnable := range (*chartsToEnable).List.Items {
@@ -184,64 +278,192 @@ func (m chartgroupmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaCh
 	return m.deployedResource, nil
 }
 
-// UninstallResource currently delete Charts matching the ArmadaChartGroups.
-// This is probably not the behavior we want to maitain in the long run.
+// limitConcurrency keeps the charts to enable within the slots left by the
+// charts whose release is not settled yet: charts installing, upgrading or
+// being uninstalled.
+func (m chartgroupmanager) limitConcurrency(chartsToEnable *av1.ArmadaCharts) *av1.ArmadaCharts {
+	if m.maxConcurrency <= 0 {
+		return chartsToEnable
+	}
+
+	inProgress := 0
+	for i := range m.deployedResource.List.Items {
+		chart := &m.deployedResource.List.Items[i]
+		if !isSettled(chart) {
+			inProgress++
+		}
+	}
+
+	slots := m.maxConcurrency - inProgress
+	if slots <= 0 {
+		chartsToEnable.List.Items = nil
+	} else if len(chartsToEnable.List.Items) > slots {
+		chartsToEnable.List.Items = chartsToEnable.List.Items[:slots]
+	}
+	acglog.Info("Limiting concurrency", "name", m.resourceName, "maxConcurrency", m.maxConcurrency,
+		"inProgress", inProgress, "toEnable", len(chartsToEnable.List.Items))
+	return chartsToEnable
+}
+
+// UninstallResource deletes the Charts listed in the ArmadaChartGroup. The
+// Charts of a sequenced group are torn down in reverse order, one at a time.
+// The Charts of other groups are torn down in reverse dependency order.
 func (m chartgroupmanager) UninstallResource(ctx context.Context) (*av1.ArmadaCharts, error) {
-	errs := make([]error, 0)
-	toDeleteList := m.expectedChartList()
-	for _, toDelete := range (*toDeleteList).List.Items {
-		err := m.kubeClient.Delete(context.TODO(), &toDelete)
+	if m.spec.Sequenced {
+		err := uninstallInReverseOrder(ctx, m.kubeClient, m.expectedCharts(),
+			func() client.Object { return &av1.ArmadaChart{} }, m.uninstallStepTimeout)
+		return av1.NewArmadaCharts(m.resourceName), err
+	}
+	return av1.NewArmadaCharts(m.resourceName), m.uninstallByDependencies(ctx)
+}
+
+// uninstallByDependencies deletes the Charts no remaining Chart of the group
+// depends on. A Chart is hence only deleted once its dependents are gone. It
+// returns ErrUninstallInProgress until all the Charts are gone and
+// ErrUninstallTimeout if a Chart is still terminating after the step timeout.
+func (m chartgroupmanager) uninstallByDependencies(ctx context.Context) error {
+	existing := av1.NewArmadaCharts(m.resourceName)
+	for _, key := range m.expectedCharts() {
+		chart := av1.ArmadaChart{}
+		err := m.kubeClient.Get(ctx, key, &chart)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
 		if err != nil {
-			acglog.Error(err, "Can't not Delete ArmadaChart")
-			errs = append(errs, err)
+			return err
+		}
+		existing.List.Items = append(existing.List.Items, chart)
+	}
+	if len(existing.List.Items) == 0 {
+		return nil
+	}
+
+	graph, err := newChartDependencyGraph(existing)
+	if err != nil {
+		return err
+	}
+
+	terminating := make([]string, 0)
+	for _, chart := range graph.GetChartsToDelete(m.resourceName).List.Items {
+		deletionTimestamp := chart.GetDeletionTimestamp()
+		if deletionTimestamp == nil {
+			if err := m.kubeClient.Delete(ctx, &chart); err != nil && !apierrors.IsNotFound(err) {
+				acglog.Error(err, "Can't delete ArmadaChart", "name", chart.GetName())
+				return err
+			}
+		} else if time.Since(deletionTimestamp.Time) > m.uninstallStepTimeout {
+			return fmt.Errorf("%w: %s still terminating after %s", armadaif.ErrUninstallTimeout, chart.GetName(), m.uninstallStepTimeout)
 		}
+		terminating = append(terminating, chart.GetName())
 	}
+	return fmt.Errorf("%w: waiting for %s", armadaif.ErrUninstallInProgress, strings.Join(terminating, ", "))
+}
 
+// HandleOrphans applies the orphan policy to the ArmadaCharts still owned by
+// the ArmadaChartGroup but no longer listed in its Spec nor selected. It returns the names of the orphans.
+func (m chartgroupmanager) HandleOrphans(ctx context.Context) ([]string, error) {
+	children := &av1.ArmadaChartList{}
+	if err := m.kubeClient.List(ctx, children, client.InNamespace(m.namespace)); err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]bool)
+	for _, name := range m.charts {
+		expected[name] = true
+	}
+
+	errs := make([]error, 0)
+	orphans := make([]string, 0)
+	for i := range children.Items {
+		child := &children.Items[i]
+		if expected[child.GetName()] || !isOwnedBy(child, "ArmadaChartGroup", m.resourceName) {
+			continue
+		}
+		orphans = append(orphans, child.GetName())
+
+		switch m.orphanPolicy {
+		case armadaif.OrphanPolicyDelete:
+			if err := m.kubeClient.Delete(ctx, child); err != nil && !apierrors.IsNotFound(err) {
+				acglog.Error(err, "Can't delete orphaned ArmadaChart", "name", child.GetName())
+				errs = append(errs, err)
+			}
+		case armadaif.OrphanPolicyOrphan:
+			child.SetOwnerReferences(removeOwnerReference(child.GetOwnerReferences(), "ArmadaChartGroup", m.resourceName))
+			if err := m.kubeClient.Update(ctx, child); err != nil {
+				acglog.Error(err, "Can't release orphaned ArmadaChart", "name", child.GetName())
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(orphans) != 0 {
+		acglog.Info("Orphans", "policy", m.orphanPolicy, "names", orphans)
+	}
 	if len(errs) != 0 {
-		if apierrors.IsNotFound(errs[0]) {
-			return nil, armadaif.ErrNotFound
-		} else {
-			return nil, errs[0]
-		}
-	}
-	return toDeleteList, nil
-}
-
-// expectedChartList returns a dummy ArmadaChart the same name/namespace as the cr
-// TODO(jeb): We should be able to delete this function and use the GetMockCharts
-// method of the ArmadaChartGroup.
-func (m chartgroupmanager) expectedChartList() *av1.ArmadaCharts {
-	labels := map[string]string{
-		"app": m.resourceName,
-	}
-
-	var res = av1.NewArmadaCharts(m.resourceName)
-
-	for _, chartname := range m.spec.Charts {
-		res.List.Items = append(res.List.Items, av1.ArmadaChart{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      chartname,
-				Namespace: m.namespace,
-				Labels:    labels,
-			},
-			Spec: av1.ArmadaChartSpec{
-				ChartName: chartname,
-				Release:   m.resourceName + "-release",
-				Namespace: m.namespace,
-				Upgrade: &av1.ArmadaUpgrade{
-					NoHooks: false,
-				},
-				Source: &av1.ArmadaChartSource{
-					Type:      "local",
-					Location:  "/opt/armada/helm-charts/testchart",
-					Subpath:   ".",
-					Reference: "master",
-				},
-				Dependencies: make([]string, 0),
-				TargetState:  av1.StateUninitialized,
-			},
-		})
-	}
-
-	return res
+		return orphans, errs[0]
+	}
+	return orphans, nil
+}
+
+// expectedCharts returns the references of the ArmadaCharts listed in the Spec
+// or matching the chart selector
+func (m chartgroupmanager) expectedCharts() []types.NamespacedName {
+	keys := make([]types.NamespacedName, 0, len(m.charts))
+	for _, name := range m.charts {
+		keys = append(keys, types.NamespacedName{Namespace: m.namespace, Name: name})
+	}
+	return keys
+}
+
+// TestResource requests a run of the Helm tests of the ArmadaCharts and collects
+// the results. The run is identified by the generation of the ArmadaChartGroup.
+// Sequenced groups test one chart at a time and stop at the first failure.
+func (m chartgroupmanager) TestResource(ctx context.Context) (*armadaif.ChartTestResults, error) {
+	runID := strconv.FormatInt(m.owner.GetGeneration(), 10)
+	results := &armadaif.ChartTestResults{}
+
+	errs := make([]error, 0)
+	for i := range m.deployedResource.List.Items {
+		chart := &m.deployedResource.List.Items[i]
+		if chart.GetAnnotations()[armadaif.AnnotationTestCompleted] == runID {
+			if hasCondition(chart.Status.Conditions, armadaif.ConditionTested, av1.ConditionStatusTrue) {
+				results.Passed = append(results.Passed, chart.GetName())
+			} else {
+				results.Failed = append(results.Failed, chart.GetName())
+			}
+			continue
+		}
+
+		results.Pending = append(results.Pending, chart.GetName())
+		if m.spec.Sequenced && (len(results.Failed) != 0 || len(results.Pending) > 1) {
+			continue
+		}
+		if setAnnotation(chart, armadaif.AnnotationTestRequested, runID) {
+			if err := m.kubeClient.Update(ctx, chart); err != nil {
+				acglog.Error(err, "Can't request test of ArmadaChart", "name", chart.GetName())
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return results, errs[0]
+	}
+	return results, nil
+}
+
+// Progress returns the deployment progress of the ArmadaCharts of the group,
+// as currently reported by the ArmadaCharts. The missing ArmadaCharts are
+// reported without state.
+func (m chartgroupmanager) Progress(ctx context.Context) *armadaif.Progress {
+	charts := make([]av1.ArmadaChart, 0, len(m.charts))
+	for _, key := range m.expectedCharts() {
+		chart := av1.ArmadaChart{}
+		if err := m.kubeClient.Get(ctx, key, &chart); err != nil {
+			chart = av1.ArmadaChart{}
+			chart.SetName(key.Name)
+		}
+		charts = append(charts, chart)
+	}
+	return armadaif.NewChartProgress(charts)
 }
@@ -0,0 +1,162 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keleustes/armada-crd/pkg/apis"
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSequencedTestResource(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	group := &av1.ArmadaChartGroup{}
+	group.SetName("openstack")
+	group.SetGeneration(2)
+	group.Spec.Sequenced = true
+	group.Spec.TestCharts = true
+
+	deployed := av1.NewArmadaCharts("openstack")
+	for _, name := range []string{"mariadb", "keystone", "glance"} {
+		chart := newTestChart(name, av1.StateDeployed)
+		chart.SetNamespace("openstack")
+		deployed.List.Items = append(deployed.List.Items, chart)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(&deployed.List.Items[0], &deployed.List.Items[1], &deployed.List.Items[2]).Build()
+	m := chartgroupmanager{kubeClient: c, owner: group, spec: &group.Spec, deployedResource: deployed}
+
+	// Only the first chart is requested to run its tests
+	results, err := m.TestResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(results.Pending).To(gomega.Equal([]string{"mariadb", "keystone", "glance"}))
+	g.Expect(deployed.List.Items[0].GetAnnotations()).To(gomega.HaveKeyWithValue(armadaif.AnnotationTestRequested, "2"))
+	g.Expect(deployed.List.Items[1].GetAnnotations()).NotTo(gomega.HaveKey(armadaif.AnnotationTestRequested))
+
+	// Once mariadb passed, keystone is requested
+	deployed.List.Items[0].Annotations[armadaif.AnnotationTestCompleted] = "2"
+	deployed.List.Items[0].Status.Conditions = []av1.HelmResourceCondition{
+		{Type: armadaif.ConditionTested, Status: av1.ConditionStatusTrue},
+	}
+	results, err = m.TestResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(results.Passed).To(gomega.Equal([]string{"mariadb"}))
+	g.Expect(results.Pending).To(gomega.Equal([]string{"keystone", "glance"}))
+	g.Expect(deployed.List.Items[1].GetAnnotations()).To(gomega.HaveKeyWithValue(armadaif.AnnotationTestRequested, "2"))
+
+	// A failure stops the tests of the remaining charts
+	deployed.List.Items[1].Annotations[armadaif.AnnotationTestCompleted] = "2"
+	results, err = m.TestResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(results.Failed).To(gomega.Equal([]string{"keystone"}))
+	g.Expect(deployed.List.Items[2].GetAnnotations()).NotTo(gomega.HaveKey(armadaif.AnnotationTestRequested))
+}
+
+func TestUpdateResourceAdoptsMembers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	group := newTestChartGroup("openstack", av1.StateDeployed, "keystone", "glance")
+	group.SetUID("uid-openstack")
+	other := &av1.ArmadaChartGroup{}
+	other.SetName("infra")
+	other.SetUID("uid-infra")
+
+	keystone := newTestChart("keystone", av1.StateDeployed)
+	keystone.SetNamespace("openstack")
+	_, err := adopt(&group, &keystone, scheme)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	glance := newTestChart("glance", "")
+	glance.SetNamespace("openstack")
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&group, &keystone, &glance).Build()
+	m := chartgroupmanager{kubeClient: c, scheme: scheme, owner: &group, namespace: "openstack",
+		resourceName: "openstack", spec: &group.Spec, status: &group.Status}
+
+	// The chart added to the deployed group requires an update, which adopts it
+	g.Expect(m.Sync(context.TODO())).To(gomega.Succeed())
+	g.Expect(m.IsInstalled()).To(gomega.BeTrue())
+	g.Expect(m.IsUpdateRequired()).To(gomega.BeTrue())
+	_, updated, err := m.UpdateResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(updated.List.Items).To(gomega.HaveLen(2))
+	found := &av1.ArmadaChart{}
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "glance"}, found)).To(gomega.Succeed())
+	g.Expect(isOwnedBy(found, "ArmadaChartGroup", "openstack")).To(gomega.BeTrue())
+
+	g.Expect(m.Sync(context.TODO())).To(gomega.Succeed())
+	g.Expect(m.IsUpdateRequired()).To(gomega.BeFalse())
+
+	// A chart controlled by another group is reported as a conflict
+	m.owner = other
+	_, _, err = m.UpdateResource(context.TODO())
+	g.Expect(errors.Is(err, armadaif.ErrOwnershipConflict)).To(gomega.BeTrue())
+}
+
+func TestUninstallByDependencies(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	group := &av1.ArmadaChartGroup{}
+	group.SetNamespace("openstack")
+	group.SetName("openstack")
+
+	mariadb := newTestChart("mariadb", "")
+	keystone := newTestChart("keystone", "", "mariadb")
+	keystone.SetFinalizers([]string{"uninstall-helm-release"})
+	glance := newTestChart("glance", "")
+	for _, chart := range []*av1.ArmadaChart{&mariadb, &keystone, &glance} {
+		chart.SetNamespace("openstack")
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&mariadb, &keystone, &glance).Build()
+	m := chartgroupmanager{kubeClient: c, owner: group, spec: &group.Spec, namespace: "openstack",
+		resourceName: "openstack", charts: []string{"mariadb", "keystone", "glance"}, uninstallStepTimeout: time.Hour}
+
+	// keystone and glance are torn down in parallel, mariadb waits for keystone
+	_, err := m.UninstallResource(context.TODO())
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "glance"}, &av1.ArmadaChart{})).NotTo(gomega.Succeed())
+	_, err = m.UninstallResource(context.TODO())
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "mariadb"}, &av1.ArmadaChart{})).To(gomega.Succeed())
+
+	// once the finalizer of keystone completed, mariadb is deleted
+	current := &av1.ArmadaChart{}
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "keystone"}, current)).To(gomega.Succeed())
+	current.SetFinalizers(nil)
+	g.Expect(c.Update(context.TODO(), current)).To(gomega.Succeed())
+
+	_, err = m.UninstallResource(context.TODO())
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	_, err = m.UninstallResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+}
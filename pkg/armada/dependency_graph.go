@@ -0,0 +1,178 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+)
+
+// chartDependencyGraph is the DAG built from the spec.dependencies of the
+// charts of an ArmadaChartGroup. Dependencies on charts which are not part
+// of the group are ignored.
+type chartDependencyGraph struct {
+	charts map[string]*av1.ArmadaChart
+	deps   map[string][]string
+	names  []string
+}
+
+// newChartDependencyGraph builds the DAG of the charts and returns a
+// DependencyException if the dependencies contain a cycle.
+func newChartDependencyGraph(charts *av1.ArmadaCharts) (*chartDependencyGraph, error) {
+	g := &chartDependencyGraph{
+		charts: make(map[string]*av1.ArmadaChart),
+		deps:   make(map[string][]string),
+	}
+
+	for i := range charts.List.Items {
+		chart := &charts.List.Items[i]
+		g.charts[chart.GetName()] = chart
+		g.names = append(g.names, chart.GetName())
+	}
+	sort.Strings(g.names)
+
+	for _, name := range g.names {
+		for _, dep := range g.charts[name].Spec.Dependencies {
+			if _, found := g.charts[dep]; found {
+				g.deps[name] = append(g.deps[name], dep)
+			}
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("%w Cycle: %s", armadaif.DependencyException, strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// findCycle returns the charts forming a cycle, or nil if the graph is acyclic
+func (g *chartDependencyGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	colors := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		colors[name] = visiting
+		path = append(path, name)
+		for _, dep := range g.deps[name] {
+			switch colors[dep] {
+			case visiting:
+				for i, n := range path {
+					if n == dep {
+						return append(append([]string{}, path[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		colors[name] = visited
+		return nil
+	}
+
+	for _, name := range g.names {
+		if colors[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// isEnabled checks if the ArmadaChart has already been asked to deploy
+func isEnabled(chart *av1.ArmadaChart) bool {
+	return chart.Spec.TargetState == av1.StateDeployed
+}
+
+// isDeployed checks if the ArmadaChart reached the Deployed state
+func isDeployed(chart *av1.ArmadaChart) bool {
+	return chart.Status.ActualState == av1.StateDeployed
+}
+
+// isFailed checks if the ArmadaChart failed to deploy
+func isFailed(chart *av1.ArmadaChart) bool {
+	return chart.Status.ActualState == av1.StateFailed || chart.Status.ActualState == av1.StateError
+}
+
+// isSettled checks if the release of the ArmadaChart is neither installing nor
+// upgrading. A Deployed chart being upgraded still has a Running condition.
+func isSettled(chart *av1.ArmadaChart) bool {
+	for _, condition := range chart.Status.Conditions {
+		if condition.Type == av1.ConditionRunning && condition.Status == av1.ConditionStatusTrue {
+			return false
+		}
+	}
+	switch chart.Status.ActualState {
+	case av1.StatePending, av1.StateRunning:
+		return false
+	}
+	return !isEnabled(chart) || isDeployed(chart) || isFailed(chart)
+}
+
+// GetChartsToEnable returns the disabled charts whose dependencies are all
+// deployed. Independent branches of the DAG are hence enabled in parallel.
+func (g *chartDependencyGraph) GetChartsToEnable(name string) *av1.ArmadaCharts {
+	res := av1.NewArmadaCharts(name)
+	for _, chartName := range g.names {
+		chart := g.charts[chartName]
+		if isEnabled(chart) {
+			continue
+		}
+
+		ready := true
+		for _, dep := range g.deps[chartName] {
+			if !isDeployed(g.charts[dep]) {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			res.List.Items = append(res.List.Items, *chart)
+		}
+	}
+	return res
+}
+
+// GetChartsToDelete returns the charts no other chart of the graph depends on.
+// Independent branches of the DAG are hence torn down in parallel.
+func (g *chartDependencyGraph) GetChartsToDelete(name string) *av1.ArmadaCharts {
+	dependedOn := make(map[string]bool)
+	for _, deps := range g.deps {
+		for _, dep := range deps {
+			dependedOn[dep] = true
+		}
+	}
+
+	res := av1.NewArmadaCharts(name)
+	for _, chartName := range g.names {
+		if !dependedOn[chartName] {
+			res.List.Items = append(res.List.Items, *g.charts[chartName])
+		}
+	}
+	return res
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"errors"
+	"testing"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+	"github.com/onsi/gomega"
+)
+
+func newTestChart(name string, state av1.HelmResourceState, deps ...string) av1.ArmadaChart {
+	chart := av1.ArmadaChart{}
+	chart.SetName(name)
+	chart.Spec.Dependencies = deps
+	if state != "" {
+		chart.Spec.TargetState = av1.StateDeployed
+		chart.Status.ActualState = state
+	}
+	return chart
+}
+
+func chartNames(charts *av1.ArmadaCharts) []string {
+	names := make([]string, 0)
+	for _, chart := range charts.List.Items {
+		names = append(names, chart.GetName())
+	}
+	return names
+}
+
+func TestChartDependencyGraph(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	charts := av1.NewArmadaCharts("group")
+	charts.List.Items = []av1.ArmadaChart{
+		newTestChart("mariadb", ""),
+		newTestChart("memcached", ""),
+		newTestChart("keystone", "", "mariadb", "memcached", "outside-of-group"),
+		newTestChart("glance", "", "keystone"),
+	}
+
+	graph, err := newChartDependencyGraph(charts)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(chartNames(graph.GetChartsToEnable("group"))).To(gomega.Equal([]string{"mariadb", "memcached"}))
+
+	charts.List.Items[0] = newTestChart("mariadb", av1.StateDeployed)
+	charts.List.Items[1] = newTestChart("memcached", av1.StateInitialized)
+	graph, _ = newChartDependencyGraph(charts)
+	g.Expect(chartNames(graph.GetChartsToEnable("group"))).To(gomega.BeEmpty())
+
+	charts.List.Items[1] = newTestChart("memcached", av1.StateDeployed)
+	graph, _ = newChartDependencyGraph(charts)
+	g.Expect(chartNames(graph.GetChartsToEnable("group"))).To(gomega.Equal([]string{"keystone"}))
+
+	charts.List.Items[0] = newTestChart("mariadb", "", "glance")
+	_, err = newChartDependencyGraph(charts)
+	g.Expect(errors.Is(err, armadaif.DependencyException)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("glance -> keystone -> mariadb -> glance"))
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	charts := av1.NewArmadaCharts("group")
+	charts.List.Items = []av1.ArmadaChart{
+		newTestChart("cinder", av1.StateRunning),
+		newTestChart("glance", av1.StateFailed),
+		newTestChart("heat", ""),
+		newTestChart("keystone", ""),
+		newTestChart("nova", ""),
+	}
+	m := chartgroupmanager{resourceName: "group", deployedResource: charts, maxConcurrency: 3}
+
+	graph, err := newChartDependencyGraph(charts)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(chartNames(m.limitConcurrency(graph.GetChartsToEnable("group")))).To(gomega.Equal([]string{"heat", "keystone"}))
+
+	m.maxConcurrency = 1
+	g.Expect(chartNames(m.limitConcurrency(graph.GetChartsToEnable("group")))).To(gomega.BeEmpty())
+
+	m.maxConcurrency = 0
+	g.Expect(chartNames(m.limitConcurrency(graph.GetChartsToEnable("group")))).To(gomega.HaveLen(3))
+
+	// A deployed chart which is upgrading takes a slot
+	m.maxConcurrency = 3
+	upgrading := newTestChart("glance", av1.StateDeployed)
+	upgrading.Status.Conditions = []av1.HelmResourceCondition{
+		{Type: av1.ConditionRunning, Status: av1.ConditionStatusTrue, Reason: av1.ReasonUpdateSuccessful}}
+	charts.List.Items[1] = upgrading
+	g.Expect(chartNames(m.limitConcurrency(graph.GetChartsToEnable("group")))).To(gomega.Equal([]string{"heat"}))
+}
@@ -15,9 +15,22 @@
 package armada
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 // Convert an unstructured.Unstructured into a typed Pod
@@ -50,3 +63,96 @@ func NewPodVersionKind(namespace string, name string) *unstructured.Unstructured
 	u.SetName(name)
 	return u
 }
+
+// Check if the object is owned by the resource of that kind and name
+func isOwnedBy(obj metav1.Object, kind string, name string) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == kind && ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the references to the owner of that kind and name
+func removeOwnerReference(refs []metav1.OwnerReference, kind string, name string) []metav1.OwnerReference {
+	res := make([]metav1.OwnerReference, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Kind != kind || ref.Name != name {
+			res = append(res, ref)
+		}
+	}
+	return res
+}
+
+// Check if the ArmadaChartGroup failed to deploy
+func isChartGroupFailed(chartGroup *av1.ArmadaChartGroup) bool {
+	return chartGroup.Status.ActualState == av1.StateFailed || chartGroup.Status.ActualState == av1.StateError
+}
+
+// Check if the list of conditions contains a condition of the type with the status.
+func hasCondition(conditions []av1.HelmResourceCondition, t av1.HelmResourceConditionType, status av1.HelmResourceConditionStatus) bool {
+	helper := av1.HelmResourceConditionListHelper{Items: conditions}
+	return helper.FindCondition(t, status) != nil
+}
+
+// Set an annotation of the object. It returns true if the annotations changed.
+func setAnnotation(obj metav1.Object, key string, value string) bool {
+	annotations := obj.GetAnnotations()
+	if current, found := annotations[key]; found && current == value {
+		return false
+	}
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// Set owner as the controller of obj. It returns true if obj has been modified
+// and ErrOwnershipConflict if obj is already controlled by another resource.
+func adopt(owner metav1.Object, obj metav1.Object, scheme *runtime.Scheme) (bool, error) {
+	if ref := metav1.GetControllerOf(obj); ref != nil {
+		if ref.UID == owner.GetUID() {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %s is controlled by %s %s",
+			armadaif.ErrOwnershipConflict, obj.GetName(), ref.Kind, ref.Name)
+	}
+	if err := controllerutil.SetControllerReference(owner, obj, scheme); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete the objects in the reverse order of keys, one at a time. The next
+// object is only deleted once the previous one is gone, i.e. its finalizers
+// completed. It returns ErrUninstallInProgress until all the objects are gone
+// and ErrUninstallTimeout if an object is still terminating after timeout.
+func uninstallInReverseOrder(ctx context.Context, c client.Client, keys []types.NamespacedName,
+	newObject func() client.Object, timeout time.Duration) error {
+	for i := len(keys) - 1; i >= 0; i-- {
+		obj := newObject()
+		err := c.Get(ctx, keys[i], obj)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		deletionTimestamp := obj.GetDeletionTimestamp()
+		if deletionTimestamp == nil {
+			if err := c.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			return fmt.Errorf("%w: deleting %s", armadaif.ErrUninstallInProgress, keys[i].Name)
+		}
+		if time.Since(deletionTimestamp.Time) > timeout {
+			return fmt.Errorf("%w: %s still terminating after %s", armadaif.ErrUninstallTimeout, keys[i].Name, timeout)
+		}
+		return fmt.Errorf("%w: waiting for %s", armadaif.ErrUninstallInProgress, keys[i].Name)
+	}
+	return nil
+}
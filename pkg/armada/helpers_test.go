@@ -0,0 +1,99 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/keleustes/armada-crd/pkg/apis"
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAdopt(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	group := &av1.ArmadaChartGroup{}
+	group.SetName("openstack")
+	group.SetUID("uid-openstack")
+	other := &av1.ArmadaChartGroup{}
+	other.SetName("infra")
+	other.SetUID("uid-infra")
+
+	chart := newTestChart("keystone", "")
+	adopted, err := adopt(group, &chart, scheme)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(adopted).To(gomega.BeTrue())
+	g.Expect(isOwnedBy(&chart, "ArmadaChartGroup", "openstack")).To(gomega.BeTrue())
+
+	adopted, err = adopt(group, &chart, scheme)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(adopted).To(gomega.BeFalse())
+
+	_, err = adopt(other, &chart, scheme)
+	g.Expect(errors.Is(err, armadaif.ErrOwnershipConflict)).To(gomega.BeTrue())
+}
+
+func TestUninstallInReverseOrder(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	mariadb := newTestChart("mariadb", "")
+	mariadb.SetNamespace("openstack")
+	keystone := newTestChart("keystone", "")
+	keystone.SetNamespace("openstack")
+	keystone.SetFinalizers([]string{"uninstall-helm-release"})
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&mariadb, &keystone).Build()
+
+	keys := []types.NamespacedName{
+		{Namespace: "openstack", Name: "mariadb"},
+		{Namespace: "openstack", Name: "keystone"},
+	}
+	newObject := func() client.Object { return &av1.ArmadaChart{} }
+
+	// keystone is deleted first and its finalizer blocks the teardown of mariadb
+	err := uninstallInReverseOrder(context.TODO(), c, keys, newObject, time.Hour)
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	err = uninstallInReverseOrder(context.TODO(), c, keys, newObject, time.Hour)
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	g.Expect(c.Get(context.TODO(), keys[0], &av1.ArmadaChart{})).To(gomega.Succeed())
+
+	err = uninstallInReverseOrder(context.TODO(), c, keys, newObject, -time.Second)
+	g.Expect(errors.Is(err, armadaif.ErrUninstallTimeout)).To(gomega.BeTrue())
+
+	// once the finalizer completed, mariadb is deleted
+	current := &av1.ArmadaChart{}
+	g.Expect(c.Get(context.TODO(), keys[1], current)).To(gomega.Succeed())
+	current.SetFinalizers(nil)
+	g.Expect(c.Update(context.TODO(), current)).To(gomega.Succeed())
+
+	err = uninstallInReverseOrder(context.TODO(), c, keys, newObject, time.Hour)
+	g.Expect(errors.Is(err, armadaif.ErrUninstallInProgress)).To(gomega.BeTrue())
+	g.Expect(uninstallInReverseOrder(context.TODO(), c, keys, newObject, time.Hour)).To(gomega.Succeed())
+}
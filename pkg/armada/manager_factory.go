@@ -15,6 +15,7 @@
 package armada
 
 import (
+	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
@@ -24,29 +25,36 @@ import (
 
 type managerFactory struct {
 	kubeClient client.Client
+	scheme     *runtime.Scheme
 }
 
 // NewManagerFactory returns a new Helm manager factory capable of installing and uninstalling releases.
 func NewManagerFactory(mgr manager.Manager) armadaif.ArmadaManagerFactory {
-	return &managerFactory{kubeClient: mgr.GetClient()}
+	return &managerFactory{kubeClient: mgr.GetClient(), scheme: mgr.GetScheme()}
 }
 
 func (f managerFactory) NewArmadaChartGroupManager(r *av1.ArmadaChartGroup) armadaif.ArmadaChartGroupManager {
 	return &chartgroupmanager{
-		kubeClient:   f.kubeClient,
-		resourceName: r.GetName(),
-		namespace:    r.GetNamespace(),
-		spec:         &r.Spec,
-		status:       &r.Status,
+		kubeClient:           f.kubeClient,
+		scheme:               f.scheme,
+		owner:                r,
+		resourceName:         r.GetName(),
+		namespace:            r.GetNamespace(),
+		spec:                 &r.Spec,
+		status:               &r.Status,
+		uninstallStepTimeout: armadaif.GetUninstallStepTimeout(r.GetAnnotations()),
 	}
 }
 
 func (f managerFactory) NewArmadaManifestManager(r *av1.ArmadaManifest) armadaif.ArmadaManifestManager {
 	return &manifestmanager{
-		kubeClient:   f.kubeClient,
-		resourceName: r.GetName(),
-		namespace:    r.GetNamespace(),
-		spec:         &r.Spec,
-		status:       &r.Status,
+		kubeClient:           f.kubeClient,
+		scheme:               f.scheme,
+		owner:                r,
+		resourceName:         r.GetName(),
+		namespace:            r.GetNamespace(),
+		spec:                 &r.Spec,
+		status:               &r.Status,
+		uninstallStepTimeout: armadaif.GetUninstallStepTimeout(r.GetAnnotations()),
 	}
 }
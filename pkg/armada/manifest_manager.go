@@ -16,11 +16,14 @@ package armada
 
 import (
 	"context"
+	"strconv"
+	"time"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	armadaif "github.com/keleustes/armada-operator/pkg/services"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -31,12 +34,20 @@ var amflog = logf.Log.WithName("amf-manager")
 
 type manifestmanager struct {
 	kubeClient       client.Client
+	scheme           *runtime.Scheme
+	owner            *av1.ArmadaManifest
 	resourceName     string
 	namespace        string
 	spec             *av1.ArmadaManifestSpec
 	status           *av1.ArmadaManifestStatus
 	deployedResource *av1.ArmadaChartGroups
 
+	// maxConcurrency is propagated to the ArmadaChartGroups it enables
+	maxConcurrency       int
+	orphanPolicy         armadaif.OrphanPolicy
+	failurePolicy        armadaif.FailurePolicy
+	uninstallStepTimeout time.Duration
+
 	isInstalled      bool
 	isUpdateRequired bool
 }
@@ -54,20 +65,42 @@ func (m manifestmanager) IsUpdateRequired() bool {
 	return m.isUpdateRequired
 }
 
+// OrphanPolicy returns the orphan_policy read from the spec by Sync.
+func (m manifestmanager) OrphanPolicy() armadaif.OrphanPolicy {
+	return m.orphanPolicy
+}
+
+// FailurePolicy returns the failure_policy read from the spec by Sync.
+func (m manifestmanager) FailurePolicy() armadaif.FailurePolicy {
+	return m.failurePolicy
+}
+
 // Sync detects which ArmadaChartGroup listed this ArmadaManifest are already present in
 // the K8s cluster.
 func (m *manifestmanager) Sync(ctx context.Context) error {
 	m.deployedResource = av1.NewArmadaChartGroups(m.resourceName)
+
+	ext, err := armadaif.GetArmadaManifestSpecExtensions(ctx, m.kubeClient, m.owner)
+	if err != nil {
+		m.isUpdateRequired = false
+		return err
+	}
+	m.maxConcurrency = ext.MaxConcurrency
+	m.orphanPolicy = ext.OrphanPolicy
+	m.failurePolicy = ext.FailurePolicy
+
 	errs := make([]error, 0)
-	targetResourceList := m.expectedChartGroupList()
-	for _, existingResource := range targetResourceList.List.Items {
-		err := m.kubeClient.Get(context.TODO(), types.NamespacedName{Name: existingResource.Name, Namespace: existingResource.Namespace}, &existingResource)
+	missing := make([]string, 0)
+	for _, key := range m.expectedChartGroups() {
+		existingResource := av1.ArmadaChartGroup{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
 		if err != nil {
-			if !apierrors.IsNotFound(err) {
-				// Don't want to trace is the error is not a NotFound.
-				amflog.Error(err, "Can't not retrieve ArmadaChartGroup")
+			if apierrors.IsNotFound(err) {
+				missing = append(missing, key.Name)
+			} else {
+				amflog.Error(err, "Can't not retrieve ArmadaChartGroup", "name", key.Name)
+				errs = append(errs, err)
 			}
-			errs = append(errs, err)
 		} else {
 			m.deployedResource.List.Items = append(m.deployedResource.List.Items, existingResource)
 		}
@@ -75,80 +108,149 @@ func (m *manifestmanager) Sync(ctx context.Context) error {
 
 	amflog.Info("ChartGroups", "deployedResources", m.deployedResource.States())
 
-	// The ChartGroup manager is not in charge of creating the ArmaChart since it
-	// only contains the name of the charts.
+	// The ArmadaManifest manager is not in charge of creating the ArmadaChartGroup since it
+	// only contains their names.
 	if len(errs) != 0 {
-		// Regardless if the error is NotFound or something else,
-		// we can't sync the ArmadaChartGroup with content of Kubernetes.
+		// We can't sync the ArmadaManifest with content of Kubernetes.
 		m.isUpdateRequired = false
 		return errs[0]
 	}
+	if len(missing) != 0 {
+		m.isUpdateRequired = false
+		return &armadaif.MissingResourcesError{Kind: "ArmadaChartGroup", Names: missing}
+	}
 
-	// TODO(jeb): We should check that the ArmadaManifest is still not the "owner" of
-	// chartgroups which are not listed in its Spec anymore. In such as case we should put
-	// the isUpdateRequired to true.
+	// The ArmadaChartGroups still owned but no longer listed in the Spec are handled
+	// by HandleOrphans according to the orphan policy.
+	// The children not controlled yet are adopted by Install until the
+	// resource is deployed, and by Update afterwards.
 	m.isUpdateRequired = false
 	m.isInstalled = true
-	if m.status.ActualState != av1.StateDeployed {
-		for _, deployedResource := range m.deployedResource.List.Items {
-			existingRefs := deployedResource.GetOwnerReferences()
-			if len(existingRefs) == 0 {
-				m.isInstalled = false
-			}
+	for i := range m.deployedResource.List.Items {
+		ref := metav1.GetControllerOf(&m.deployedResource.List.Items[i])
+		if ref != nil && ref.UID == m.owner.GetUID() {
+			continue
+		}
+		if m.status.ActualState != av1.StateDeployed {
+			m.isInstalled = false
+		} else {
+			m.isUpdateRequired = true
 		}
 	}
 
 	return nil
 }
 
-// InstallResource checks that the corresponding chartgroups are present
+// InstallResource checks that the corresponding chartgroups are present and
+// adopts them as controller. It fails if one of them is already controlled by
+// another ArmadaManifest.
 // TODO(jeb): We should most likely update the target_state is not already done.
-// TODO(jeb): We should also update the the owner of the charts.
 func (m manifestmanager) InstallResource(ctx context.Context) (*av1.ArmadaChartGroups, error) {
+	errs := make([]error, 0)
 	installedResources := av1.NewArmadaChartGroups(m.resourceName)
-	targetResourceList := m.expectedChartGroupList()
-	for _, existingResource := range targetResourceList.List.Items {
-		err := m.kubeClient.Get(context.TODO(), types.NamespacedName{Name: existingResource.GetName(), Namespace: existingResource.GetNamespace()}, &existingResource)
-		if err == nil {
-			installedResources.List.Items = append(installedResources.List.Items, existingResource)
+	for _, key := range m.expectedChartGroups() {
+		existingResource := av1.ArmadaChartGroup{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
+		if err != nil {
+			continue
+		}
+
+		adopted, err := adopt(m.owner, &existingResource, m.scheme)
+		if err != nil {
+			amflog.Error(err, "Can't adopt ArmadaChartGroup", "name", existingResource.GetName())
+			errs = append(errs, err)
+			continue
 		}
+		if adopted {
+			if err := m.kubeClient.Update(context.TODO(), &existingResource); err != nil {
+				amflog.Error(err, "Can't adopt ArmadaChartGroup", "name", existingResource.GetName())
+				errs = append(errs, err)
+				continue
+			}
+			amflog.Info("Adopted ArmadaChartGroup", "name", existingResource.GetName())
+		}
+		installedResources.List.Items = append(installedResources.List.Items, existingResource)
 	}
 
+	if len(errs) != 0 {
+		return installedResources, errs[0]
+	}
 	return installedResources, nil
 }
 
-// UpdateResource performs an update of an ArmadaManifest.
-// Currently either the list of ChartGroupss or the "prefix" attribute may have changed.
+// UpdateResource performs an update of an ArmadaManifest. The specs of the
+// ArmadaChartGroups belong to their authors and are never rewritten, hence only the
+// live objects are refreshed.
 func (m manifestmanager) UpdateResource(ctx context.Context) (*av1.ArmadaChartGroups, *av1.ArmadaChartGroups, error) {
-	errs := make([]error, 0)
-	toUpdateList := m.expectedChartGroupList()
-	for _, toUpdate := range (*toUpdateList).List.Items {
-		err := m.kubeClient.Update(context.TODO(), &toUpdate)
+	updatedResources := av1.NewArmadaChartGroups(m.resourceName)
+	for _, key := range m.expectedChartGroups() {
+		existingResource := av1.ArmadaChartGroup{}
+		err := m.kubeClient.Get(context.TODO(), key, &existingResource)
 		if err != nil {
-			amflog.Error(err, "Can't not Update ArmadaChartGroup")
-			errs = append(errs, err)
+			if apierrors.IsNotFound(err) {
+				return nil, nil, armadaif.ErrNotFound
+			}
+			return nil, nil, err
 		}
-	}
 
-	if len(errs) != 0 {
-		if apierrors.IsNotFound(errs[0]) {
-			return nil, nil, armadaif.ErrNotFound
-		} else {
-			return nil, nil, errs[0]
+		// The chart groups added to the manifest since the installation are adopted.
+		adopted, err := adopt(m.owner, &existingResource, m.scheme)
+		if err != nil {
+			amflog.Error(err, "Can't adopt ArmadaChartGroup", "name", existingResource.GetName())
+			return nil, nil, err
 		}
+		if adopted {
+			if err := m.kubeClient.Update(context.TODO(), &existingResource); err != nil {
+				amflog.Error(err, "Can't adopt ArmadaChartGroup", "name", existingResource.GetName())
+				return nil, nil, err
+			}
+			amflog.Info("Adopted ArmadaChartGroup", "name", existingResource.GetName())
+		}
+		updatedResources.List.Items = append(updatedResources.List.Items, existingResource)
 	}
-	return m.deployedResource, toUpdateList, nil
+	return m.deployedResource, updatedResources, nil
 }
 
 // ReconcileResource enables the ArmadaChartGroups which are listed in its list and not enabled yet
 func (m manifestmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaChartGroups, error) {
 	errs := make([]error, 0)
 
+	// Propagate the release prefix to the ArmadaChartGroups which propagate it to their ArmadaCharts.
+	for i := range m.deployedResource.List.Items {
+		chartGroup := &m.deployedResource.List.Items[i]
+		if setAnnotation(chartGroup, armadaif.AnnotationReleasePrefix, m.spec.ReleasePrefix) {
+			if err := m.kubeClient.Update(context.TODO(), chartGroup); err != nil {
+				amflog.Error(err, "Can't propagate release prefix to ArmadaChartGroup", "name", chartGroup.GetName())
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// Don't enable the next ArmadaChartGroup until the tests of the enabled ones passed.
+	// The failed tests are reported by the controller through FailedTests.
+	untested, _ := m.untestedChartGroups()
+
+	// Unless the failure policy says otherwise, don't enable the next ArmadaChartGroup
+	// once one of them failed.
+	failed, err := m.failedChartGroups(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
 	// The main goal of the ArmadaManifest is to group together all the ChartGroups that need to
 	// be deployed. The concept of sequencing is implicit here
 	chartGroupsToEnable := av1.NewArmadaChartGroups(m.resourceName)
 	nextToEnable := m.deployedResource.GetNextToEnable()
-	if nextToEnable != nil {
+	if len(failed) != 0 && m.failurePolicy == armadaif.FailurePolicyContinue {
+		nextToEnable = m.nextToEnableDespiteFailures()
+	}
+	switch {
+	case nextToEnable == nil:
+	case len(untested) != 0:
+		amflog.Info("Waiting for the tests of ArmadaChartGroups", "names", untested)
+	case len(failed) != 0 && m.failurePolicy != armadaif.FailurePolicyContinue:
+		amflog.Info("Halted on failed ArmadaChartGroups", "policy", m.failurePolicy, "names", failed)
+	default:
 		chartGroupsToEnable.List.Items = append(chartGroupsToEnable.List.Items, *nextToEnable)
 	}
 
@@ -157,6 +259,9 @@ func (m manifestmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaChar
 		err := m.kubeClient.Get(context.TODO(), types.NamespacedName{Name: found.GetName(), Namespace: found.GetNamespace()}, &nextToEnable)
 		if err == nil {
 			nextToEnable.Spec.TargetState = av1.StateDeployed
+			if m.maxConcurrency > 0 {
+				setAnnotation(&nextToEnable, armadaif.AnnotationDefaultMaxConcurrency, strconv.Itoa(m.maxConcurrency))
+			}
 			if err2 := m.kubeClient.Update(context.TODO(), &nextToEnable); err2 != nil {
 				amflog.Error(err, "Can't get enable of ArmadaChartGroup", "name", found.GetName())
 				errs = append(errs, err)
@@ -174,58 +279,343 @@ func (m manifestmanager) ReconcileResource(ctx context.Context) (*av1.ArmadaChar
 	return m.deployedResource, nil
 }
 
-// UninstallResource currently delete ChartGroups matching the manifest.
-// This is probably not the behavior we want to maitain in the long run.
-func (m manifestmanager) UninstallResource(ctx context.Context) (*av1.ArmadaChartGroups, error) {
+// untestedChartGroups returns the names of the enabled ArmadaChartGroups with
+// test_charts set whose tests did not pass yet, along with the names of the
+// ones whose tests failed.
+func (m manifestmanager) untestedChartGroups() ([]string, []string) {
+	untested := make([]string, 0)
+	failed := make([]string, 0)
+	for _, chartGroup := range m.deployedResource.List.Items {
+		if !chartGroup.Spec.TestCharts || chartGroup.Spec.TargetState != av1.StateDeployed {
+			continue
+		}
+		switch {
+		case hasCondition(chartGroup.Status.Conditions, armadaif.ConditionTested, av1.ConditionStatusTrue):
+		case hasCondition(chartGroup.Status.Conditions, armadaif.ConditionTested, av1.ConditionStatusFalse):
+			untested = append(untested, chartGroup.GetName())
+			failed = append(failed, chartGroup.GetName())
+		default:
+			untested = append(untested, chartGroup.GetName())
+		}
+	}
+
+	return untested, failed
+}
+
+// isRollbackable checks if the ArmadaChart failed and its release has a
+// previous revision to roll back to.
+func (m manifestmanager) isRollbackable(ctx context.Context, helmFactory armadaif.HelmManagerFactory, chart *av1.ArmadaChart) (bool, error) {
+	if armadaif.IsAbstract(chart.GetAnnotations()) || !isFailed(chart) {
+		return false, nil
+	}
+	resolved, err := armadaif.ResolveArmadaChart(ctx, m.kubeClient, chart)
+	if err != nil {
+		return false, err
+	}
+	history, err := helmFactory.NewArmadaChartManager(resolved).ReleaseHistory(ctx)
+	if err != nil {
+		return false, err
+	}
+	return len(history) > 1, nil
+}
+
+// FailedTests returns the names of the enabled ArmadaChartGroups whose tests
+// failed. The next ArmadaChartGroups stay disabled until they are tested again.
+func (m manifestmanager) FailedTests() []string {
+	_, failed := m.untestedChartGroups()
+	return failed
+}
+
+// nextToEnableDespiteFailures returns the first disabled ArmadaChartGroup, provided
+// the enabled ones are either deployed or failed.
+func (m manifestmanager) nextToEnableDespiteFailures() *av1.ArmadaChartGroup {
+	for i := range m.deployedResource.List.Items {
+		chartGroup := &m.deployedResource.List.Items[i]
+		switch {
+		case chartGroup.Spec.TargetState != av1.StateDeployed:
+			return chartGroup
+		case chartGroup.Status.ActualState == av1.StateDeployed || isChartGroupFailed(chartGroup):
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// failedChartGroups returns the names of the enabled ArmadaChartGroups which
+// failed, or whose ArmadaCharts are held at the revisions they were rolled back to.
+func (m manifestmanager) failedChartGroups(ctx context.Context) ([]string, error) {
+	failed := make([]string, 0)
+	for i := range m.deployedResource.List.Items {
+		chartGroup := &m.deployedResource.List.Items[i]
+		if chartGroup.Spec.TargetState != av1.StateDeployed {
+			continue
+		}
+		if isChartGroupFailed(chartGroup) {
+			failed = append(failed, chartGroup.GetName())
+			continue
+		}
+		rolledBack, err := m.isRolledBack(ctx, chartGroup)
+		if err != nil {
+			return failed, err
+		}
+		if rolledBack {
+			failed = append(failed, chartGroup.GetName())
+		}
+	}
+	return failed, nil
+}
+
+// isRolledBack checks if some ArmadaCharts of the ArmadaChartGroup are still held
+// at the revisions they were rolled back to by the failure policy.
+func (m manifestmanager) isRolledBack(ctx context.Context, chartGroup *av1.ArmadaChartGroup) (bool, error) {
+	runID := strconv.FormatInt(chartGroup.GetGeneration(), 10)
+	if chartGroup.GetAnnotations()[armadaif.AnnotationRollbackRequested] != runID {
+		return false, nil
+	}
+
+	charts, err := chartGroupMembers(ctx, m.kubeClient, chartGroup)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range charts {
+		chart := &av1.ArmadaChart{}
+		err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: chartGroup.GetNamespace(), Name: name}, chart)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if chart.GetAnnotations()[armadaif.AnnotationRolledBackGeneration] == strconv.FormatInt(chart.GetGeneration(), 10) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HandleFailures applies the failure policy to the failed ArmadaChartGroups. With
+// the rollback-group policy, the rollback of the failed ArmadaCharts of each failed
+// group is requested once per generation of the group. The ArmadaCharts whose
+// release has no previous revision are left as is. It returns the names of the
+// failed groups.
+func (m manifestmanager) HandleFailures(ctx context.Context, helmFactory armadaif.HelmManagerFactory) ([]string, error) {
+	failed, err := m.failedChartGroups(ctx)
+	if err != nil || m.failurePolicy != armadaif.FailurePolicyRollbackGroup {
+		return failed, err
+	}
+
 	errs := make([]error, 0)
-	toDeleteList := m.expectedChartGroupList()
-	for _, toDelete := range (*toDeleteList).List.Items {
-		err := m.kubeClient.Delete(context.TODO(), &toDelete)
+	for i := range m.deployedResource.List.Items {
+		chartGroup := &m.deployedResource.List.Items[i]
+		runID := strconv.FormatInt(chartGroup.GetGeneration(), 10)
+		if !isChartGroupFailed(chartGroup) || chartGroup.GetAnnotations()[armadaif.AnnotationRollbackRequested] == runID {
+			continue
+		}
+
+		charts, err := chartGroupMembers(ctx, m.kubeClient, chartGroup)
 		if err != nil {
-			amflog.Error(err, "Can't not Delete ArmadaChartGroup")
+			errs = append(errs, err)
+			continue
+		}
+		pendingErrs := len(errs)
+		for _, name := range charts {
+			chart := &av1.ArmadaChart{}
+			err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: chartGroup.GetNamespace(), Name: name}, chart)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err == nil {
+				var rollbackable bool
+				rollbackable, err = m.isRollbackable(ctx, helmFactory, chart)
+				if err == nil && !rollbackable {
+					continue
+				}
+			}
+			if err == nil && setAnnotation(chart, armadaif.AnnotationRollbackRequested, runID) {
+				err = m.kubeClient.Update(ctx, chart)
+			}
+			if err != nil {
+				amflog.Error(err, "Can't request rollback of ArmadaChart", "name", name)
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) != pendingErrs {
+			// Retry the rollback requests on the next reconciliation
+			continue
+		}
+
+		setAnnotation(chartGroup, armadaif.AnnotationRollbackRequested, runID)
+		if err := m.kubeClient.Update(ctx, chartGroup); err != nil {
+			amflog.Error(err, "Can't record rollback of ArmadaChartGroup", "name", chartGroup.GetName())
 			errs = append(errs, err)
 		}
+		amflog.Info("Requested rollback of ArmadaChartGroup", "name", chartGroup.GetName())
 	}
 
 	if len(errs) != 0 {
-		if apierrors.IsNotFound(errs[0]) {
-			return nil, armadaif.ErrNotFound
-		} else {
-			return nil, errs[0]
-		}
+		return failed, errs[0]
 	}
-	return toDeleteList, nil
+	return failed, nil
 }
 
-// expectedChartGroupList returns a dummy list of ArmadaChartGroup the same name/namespace as the cr
-// TODO(jeb): We should be able to delete this function and use the GetMockChartGroups
-// method of the ArmadaManifest.
-func (m manifestmanager) expectedChartGroupList() *av1.ArmadaChartGroups {
-	labels := map[string]string{
-		"app": m.resourceName,
+// UninstallResource deletes the ChartGroups listed in the manifest. As for the
+// deployment, the ChartGroups are sequenced, hence torn down in reverse order,
+// one at a time.
+func (m manifestmanager) UninstallResource(ctx context.Context) (*av1.ArmadaChartGroups, error) {
+	err := uninstallInReverseOrder(ctx, m.kubeClient, m.expectedChartGroups(),
+		func() client.Object { return &av1.ArmadaChartGroup{} }, m.uninstallStepTimeout)
+	return av1.NewArmadaChartGroups(m.resourceName), err
+}
+
+// HandleOrphans applies the orphan policy to the ArmadaChartGroups still owned by
+// the ArmadaManifest but no longer listed in its Spec. It returns the names of the orphans.
+func (m manifestmanager) HandleOrphans(ctx context.Context) ([]string, error) {
+	children := &av1.ArmadaChartGroupList{}
+	if err := m.kubeClient.List(ctx, children, client.InNamespace(m.namespace)); err != nil {
+		return nil, err
 	}
 
-	var res = av1.NewArmadaChartGroups(m.resourceName)
+	expected := make(map[string]bool)
+	for _, name := range m.spec.ChartGroups {
+		expected[name] = true
+	}
 
-	for _, chartgroupname := range m.spec.ChartGroups {
-		res.List.Items = append(res.List.Items,
-			av1.ArmadaChartGroup{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      chartgroupname,
-					Namespace: m.namespace,
-					Labels:    labels,
-				},
-				Spec: av1.ArmadaChartGroupSpec{
-					Charts:      make([]string, 0),
-					Description: "Created by " + m.resourceName,
-					Name:        chartgroupname,
-					Sequenced:   false,
-					TestCharts:  false,
-					TargetState: av1.StateUninitialized,
-				},
-			},
-		)
+	errs := make([]error, 0)
+	orphans := make([]string, 0)
+	for i := range children.Items {
+		child := &children.Items[i]
+		if expected[child.GetName()] || !isOwnedBy(child, "ArmadaManifest", m.resourceName) {
+			continue
+		}
+		orphans = append(orphans, child.GetName())
+
+		switch m.orphanPolicy {
+		case armadaif.OrphanPolicyDelete:
+			if err := m.kubeClient.Delete(ctx, child); err != nil && !apierrors.IsNotFound(err) {
+				amflog.Error(err, "Can't delete orphaned ArmadaChartGroup", "name", child.GetName())
+				errs = append(errs, err)
+			}
+		case armadaif.OrphanPolicyOrphan:
+			child.SetOwnerReferences(removeOwnerReference(child.GetOwnerReferences(), "ArmadaManifest", m.resourceName))
+			if err := m.kubeClient.Update(ctx, child); err != nil {
+				amflog.Error(err, "Can't release orphaned ArmadaChartGroup", "name", child.GetName())
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(orphans) != 0 {
+		amflog.Info("Orphans", "policy", m.orphanPolicy, "names", orphans)
+	}
+	if len(errs) != 0 {
+		return orphans, errs[0]
 	}
+	return orphans, nil
+}
+
+// expectedChartGroups returns the references of the ArmadaChartGroups listed in the Spec
+func (m manifestmanager) expectedChartGroups() []types.NamespacedName {
+	keys := make([]types.NamespacedName, 0, len(m.spec.ChartGroups))
+	for _, name := range m.spec.ChartGroups {
+		keys = append(keys, types.NamespacedName{Namespace: m.namespace, Name: name})
+	}
+	return keys
+}
+
+// Progress returns the deployment progress of the ArmadaChartGroups listed in
+// the Spec, as currently reported by the ArmadaChartGroups. The missing
+// ArmadaChartGroups are reported without state.
+func (m manifestmanager) Progress(ctx context.Context) *armadaif.Progress {
+	chartGroups := make([]av1.ArmadaChartGroup, 0, len(m.spec.ChartGroups))
+	for _, key := range m.expectedChartGroups() {
+		chartGroup := av1.ArmadaChartGroup{}
+		if err := m.kubeClient.Get(ctx, key, &chartGroup); err != nil {
+			chartGroup = av1.ArmadaChartGroup{}
+			chartGroup.SetName(key.Name)
+		}
+		chartGroups = append(chartGroups, chartGroup)
+	}
+	return armadaif.NewChartGroupProgress(chartGroups)
+}
 
-	return res
+// PlanResource walks the ArmadaChartGroups and their ArmadaCharts in deployment
+// order and computes, without modifying anything, which releases would be
+// installed, upgraded or left unchanged. The release prefix of the ArmadaManifest
+// is applied to the releases even if it has not been propagated yet. The
+// releases are read from the Secrets Helm stores them in, so the plan reflects
+// what is actually deployed. The ArmadaCharts not enabled yet are flagged as
+// disabled.
+func (m manifestmanager) PlanResource(ctx context.Context, helmFactory armadaif.HelmManagerFactory) (*armadaif.ManifestPlan, error) {
+	plan := armadaif.NewManifestPlan(m.resourceName)
+	for _, name := range m.spec.ChartGroups {
+		chartGroup := &av1.ArmadaChartGroup{}
+		err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: m.namespace, Name: name}, chartGroup)
+		if apierrors.IsNotFound(err) {
+			plan.Add(armadaif.ChartPlan{ChartGroup: name, Action: armadaif.PlanActionMissing})
+			continue
+		}
+		if err != nil {
+			return plan, err
+		}
+
+		charts, err := chartGroupMembers(ctx, m.kubeClient, chartGroup)
+		if err != nil {
+			plan.Add(armadaif.ChartPlan{ChartGroup: name, Action: armadaif.PlanActionError, Error: err.Error()})
+			continue
+		}
+		for _, chartName := range charts {
+			chartPlan := armadaif.ChartPlan{ChartGroup: name, Chart: chartName, Disabled: chartGroup.Spec.TargetState != av1.StateDeployed}
+			chart := &av1.ArmadaChart{}
+			err := m.kubeClient.Get(ctx, types.NamespacedName{Namespace: chartGroup.GetNamespace(), Name: chartName}, chart)
+			if apierrors.IsNotFound(err) {
+				chartPlan.Action = armadaif.PlanActionMissing
+				plan.Add(chartPlan)
+				continue
+			}
+			if err != nil {
+				return plan, err
+			}
+
+			if armadaif.IsAbstract(chart.GetAnnotations()) {
+				continue
+			}
+			chartPlan.Disabled = chartPlan.Disabled || !isEnabled(chart)
+			resolved, err := armadaif.ResolveArmadaChart(ctx, m.kubeClient, chart)
+			if err != nil {
+				chartPlan.Action = armadaif.PlanActionError
+				chartPlan.Error = err.Error()
+				plan.Add(chartPlan)
+				continue
+			}
+
+			setAnnotation(resolved, armadaif.AnnotationReleasePrefix, m.spec.ReleasePrefix)
+			helmMgr := helmFactory.NewArmadaChartManager(resolved)
+			chartPlan.Release = helmMgr.ReleaseName()
+			if err := helmMgr.Sync(ctx); err != nil {
+				chartPlan.Action = armadaif.PlanActionError
+				chartPlan.Error = err.Error()
+				plan.Add(chartPlan)
+				continue
+			}
+
+			switch {
+			case !helmMgr.IsInstalled():
+				chartPlan.Action = armadaif.PlanActionInstall
+			case helmMgr.IsUpdateRequired():
+				chartPlan.Action = armadaif.PlanActionUpgrade
+				diff, err := helmMgr.DiffRelease(ctx)
+				if err != nil {
+					chartPlan.Action = armadaif.PlanActionError
+					chartPlan.Error = err.Error()
+				}
+				chartPlan.Diff = diff
+			default:
+				chartPlan.Action = armadaif.PlanActionUnchanged
+			}
+			plan.Add(chartPlan)
+		}
+	}
+	return plan, nil
 }
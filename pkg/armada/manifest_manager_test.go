@@ -0,0 +1,140 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"context"
+	"testing"
+
+	"github.com/keleustes/armada-crd/pkg/apis"
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestChartGroup(name string, state av1.HelmResourceState, charts ...string) av1.ArmadaChartGroup {
+	chartGroup := av1.ArmadaChartGroup{}
+	chartGroup.SetNamespace("openstack")
+	chartGroup.SetName(name)
+	chartGroup.SetGeneration(1)
+	chartGroup.Spec.Charts = charts
+	if state != "" {
+		chartGroup.Spec.TargetState = av1.StateDeployed
+		chartGroup.Status.ActualState = state
+	}
+	return chartGroup
+}
+
+// fakeHelmManager reports a release history of the given number of revisions
+type fakeHelmManager struct {
+	armadaif.HelmManager
+	revisions int
+}
+
+func (f fakeHelmManager) ReleaseHistory(ctx context.Context) ([]*armadaif.HelmRelease, error) {
+	return make([]*armadaif.HelmRelease, f.revisions), nil
+}
+
+// fakeHelmManagerFactory returns fakeHelmManagers with the revisions of each chart
+type fakeHelmManagerFactory map[string]int
+
+func (f fakeHelmManagerFactory) NewArmadaChartManager(chart *av1.ArmadaChart) armadaif.HelmManager {
+	return fakeHelmManager{revisions: f[chart.GetName()]}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	deployed := av1.NewArmadaChartGroups("openstack")
+	deployed.List.Items = append(deployed.List.Items,
+		newTestChartGroup("infra", av1.StateDeployed, "mariadb"),
+		newTestChartGroup("keystone", av1.StateFailed, "keystone", "memcached", "barbican"),
+		newTestChartGroup("glance", ""))
+	keystone := newTestChart("keystone", av1.StateFailed)
+	keystone.SetNamespace("openstack")
+	keystone.SetGeneration(3)
+	memcached := newTestChart("memcached", av1.StateDeployed)
+	memcached.SetNamespace("openstack")
+	barbican := newTestChart("barbican", av1.StateFailed)
+	barbican.SetNamespace("openstack")
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(&deployed.List.Items[0], &deployed.List.Items[1], &deployed.List.Items[2],
+			&keystone, &memcached, &barbican).Build()
+	helmFactory := fakeHelmManagerFactory{"keystone": 2, "memcached": 2, "barbican": 1}
+
+	// continue enables the next group after the failed one
+	m := manifestmanager{kubeClient: c, deployedResource: deployed, failurePolicy: armadaif.FailurePolicyContinue}
+	g.Expect(m.nextToEnableDespiteFailures().GetName()).To(gomega.Equal("glance"))
+
+	// rollback-group requests the rollback of the failed charts of the failed group once.
+	// Healthy charts and charts without a previous revision are left as is.
+	m.failurePolicy = armadaif.FailurePolicyRollbackGroup
+	failed, err := m.HandleFailures(context.TODO(), helmFactory)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(failed).To(gomega.Equal([]string{"keystone"}))
+
+	chart := &av1.ArmadaChart{}
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "keystone"}, chart)).To(gomega.Succeed())
+	g.Expect(chart.GetAnnotations()).To(gomega.HaveKeyWithValue(armadaif.AnnotationRollbackRequested, "1"))
+	for _, name := range []string{"memcached", "barbican"} {
+		skipped := &av1.ArmadaChart{}
+		g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: name}, skipped)).To(gomega.Succeed())
+		g.Expect(skipped.GetAnnotations()).NotTo(gomega.HaveKey(armadaif.AnnotationRollbackRequested))
+	}
+	g.Expect(deployed.List.Items[1].GetAnnotations()).To(gomega.HaveKeyWithValue(armadaif.AnnotationRollbackRequested, "1"))
+
+	// Once rolled back, the group is deployed but still holds the manifest
+	deployed.List.Items[1].Status.ActualState = av1.StateDeployed
+	chart.Annotations[armadaif.AnnotationRolledBackGeneration] = "3"
+	g.Expect(c.Update(context.TODO(), chart)).To(gomega.Succeed())
+	failed, err = m.failedChartGroups(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(failed).To(gomega.Equal([]string{"keystone"}))
+}
+
+func TestFailedTests(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(apis.AddToScheme(scheme)).To(gomega.Succeed())
+
+	deployed := av1.NewArmadaChartGroups("openstack")
+	deployed.List.Items = append(deployed.List.Items,
+		newTestChartGroup("infra", av1.StateDeployed, "mariadb"),
+		newTestChartGroup("keystone", ""))
+	deployed.List.Items[0].Spec.TestCharts = true
+	deployed.List.Items[0].Status.Conditions = []av1.HelmResourceCondition{
+		{Type: armadaif.ConditionTested, Status: av1.ConditionStatusFalse, Reason: armadaif.ReasonTestFailed},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(&deployed.List.Items[0], &deployed.List.Items[1]).Build()
+	m := manifestmanager{kubeClient: c, deployedResource: deployed, spec: &av1.ArmadaManifestSpec{}}
+
+	// The failed tests hold the next group without failing the reconciliation
+	_, err := m.ReconcileResource(context.TODO())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(m.FailedTests()).To(gomega.Equal([]string{"infra"}))
+
+	chartGroup := &av1.ArmadaChartGroup{}
+	g.Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: "openstack", Name: "keystone"}, chartGroup)).To(gomega.Succeed())
+	g.Expect(chartGroup.Spec.TargetState).NotTo(gomega.Equal(av1.StateDeployed))
+}
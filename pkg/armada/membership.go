@@ -0,0 +1,83 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// chartGroupMembers returns the names of the ArmadaCharts of the ArmadaChartGroup:
+// the ones listed in the Spec, followed by the ones matching its chart_selector.
+// The selected ArmadaCharts are sorted by chart-order label, then by name.
+// Abstract ArmadaCharts are only layering parents, hence never selected.
+func chartGroupMembers(ctx context.Context, c client.Reader, chartGroup *av1.ArmadaChartGroup) ([]string, error) {
+	members := make([]string, 0, len(chartGroup.Spec.Charts))
+	listed := make(map[string]bool)
+	for _, name := range chartGroup.Spec.Charts {
+		members = append(members, name)
+		listed[name] = true
+	}
+
+	ext, err := armadaif.GetArmadaChartGroupSpecExtensions(ctx, c, chartGroup)
+	if err != nil {
+		return members, err
+	}
+	selector, err := ext.GetChartSelector()
+	if err != nil || selector == nil {
+		return members, err
+	}
+
+	selected := &av1.ArmadaChartList{}
+	err = c.List(ctx, selected, client.InNamespace(chartGroup.GetNamespace()), client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return members, err
+	}
+
+	charts := make([]av1.ArmadaChart, 0, len(selected.Items))
+	for _, chart := range selected.Items {
+		if !listed[chart.GetName()] && !armadaif.IsAbstract(chart.GetAnnotations()) {
+			charts = append(charts, chart)
+		}
+	}
+	sort.SliceStable(charts, func(i, j int) bool {
+		oi, oj := chartOrder(&charts[i]), chartOrder(&charts[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return charts[i].GetName() < charts[j].GetName()
+	})
+	for _, chart := range charts {
+		members = append(members, chart.GetName())
+	}
+	return members, nil
+}
+
+// chartOrder returns the value of the chart-order label of the ArmadaChart.
+// Missing or invalid values sort last.
+func chartOrder(chart *av1.ArmadaChart) int {
+	order, err := strconv.Atoi(chart.GetLabels()[armadaif.LabelChartOrder])
+	if err != nil {
+		return math.MaxInt
+	}
+	return order
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestChartGroupMembers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// The ArmadaChartGroups are only known unstructured, as the fake client
+	// would otherwise drop the fields armada-crd does not declare.
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(av1.SchemeGroupVersion, &av1.ArmadaChart{}, &av1.ArmadaChartList{})
+	metav1.AddToGroupVersion(scheme, av1.SchemeGroupVersion)
+
+	newLabeledChart := func(name string, labels map[string]string) *av1.ArmadaChart {
+		chart := newTestChart(name, "")
+		chart.SetNamespace("openstack")
+		chart.SetLabels(labels)
+		return &chart
+	}
+	abstractChart := newLabeledChart("infra-base", map[string]string{"tier": "infra"})
+	abstractChart.SetAnnotations(map[string]string{armadaif.AnnotationAbstract: "true"})
+	newSelectingChartGroup := func(name string, selector map[string]interface{}) *unstructured.Unstructured {
+		doc := av1.NewArmadaChartGroupVersionKind("openstack", name)
+		doc.Object["spec"] = map[string]interface{}{
+			"chart_group":    []interface{}{"ingress", "rabbitmq"},
+			"chart_selector": selector,
+		}
+		return doc
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newSelectingChartGroup("infra", map[string]interface{}{
+			"matchLabels": map[string]interface{}{"tier": "infra"},
+		}),
+		newSelectingChartGroup("invalid", map[string]interface{}{
+			"matchExpressions": []interface{}{
+				map[string]interface{}{"key": "tier", "operator": "In"},
+			},
+		}),
+		newLabeledChart("mariadb", map[string]string{"tier": "infra", armadaif.LabelChartOrder: "1"}),
+		newLabeledChart("rabbitmq", map[string]string{"tier": "infra", armadaif.LabelChartOrder: "2"}),
+		newLabeledChart("memcached", map[string]string{"tier": "infra"}),
+		newLabeledChart("etcd", map[string]string{"tier": "infra"}),
+		newLabeledChart("keystone", map[string]string{"tier": "openstack"}),
+		abstractChart,
+	).Build()
+
+	chartGroup := newTestChartGroup("infra", "", "ingress", "rabbitmq")
+
+	// Listed charts come first, selected charts follow by order then name.
+	// Abstract charts are not selected.
+	members, err := chartGroupMembers(context.TODO(), c, &chartGroup)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(members).To(gomega.Equal([]string{"ingress", "rabbitmq", "mariadb", "etcd", "memcached"}))
+
+	chartGroup = newTestChartGroup("invalid", "", "ingress", "rabbitmq")
+	_, err = chartGroupMembers(context.TODO(), c, &chartGroup)
+	g.Expect(errors.Is(err, armadaif.InvalidArmadaObjectException)).To(gomega.BeTrue())
+}
@@ -23,4 +23,5 @@ func init() {
 	AddToManagerFuncs = append(AddToManagerFuncs, armada.AddArmadaChartController)
 	AddToManagerFuncs = append(AddToManagerFuncs, armada.AddArmadaChartGroupController)
 	AddToManagerFuncs = append(AddToManagerFuncs, armada.AddArmadaManifestController)
+	AddToManagerFuncs = append(AddToManagerFuncs, armada.AddArmadaBackupController)
 }
@@ -0,0 +1,310 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package armada
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	helmmgr "github.com/keleustes/armada-operator/pkg/helm"
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	crtpredicate "sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var abcklog = logf.Log.WithName("abck-controller")
+
+// AddArmadaBackupController creates a new ArmadaBackup Controller and adds it
+// to the Manager. The Manager will set fields on the Controller and Start it
+// when the Manager is Started.
+func AddArmadaBackupController(mgr manager.Manager) error {
+	r := &BackupReconciler{
+		BaseReconciler: BaseReconciler{
+			client:   mgr.GetClient(),
+			scheme:   mgr.GetScheme(),
+			recorder: mgr.GetEventRecorderFor("abck-recorder"),
+		},
+		helmFactory: helmmgr.NewManagerFactory(mgr),
+	}
+
+	// Create a new controller
+	c, err := controller.New("abck-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource ArmadaBackup. A backup is taken once
+	// per generation, hence the status updates are ignored.
+	err = c.Watch(&source.Kind{Type: &av1.ArmadaBackup{}}, &crthandler.EnqueueRequestForObject{},
+		crtpredicate.GenerationChangedPredicate{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var _ reconcile.Reconciler = &BackupReconciler{}
+
+// BackupReconciler snapshots ArmadaCharts and their Helm releases into
+// versioned archives.
+type BackupReconciler struct {
+	BaseReconciler
+	helmFactory armadaif.HelmManagerFactory
+}
+
+// Reconcile writes the archive of the current generation of an ArmadaBackup.
+// The archive holds the listed ArmadaCharts, or all the ArmadaCharts of the
+// namespace if none is listed, their values and the records of their Helm
+// releases. The archives are kept in the storage when the ArmadaBackup is deleted.
+func (r *BackupReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	reclog := abcklog.WithValues("namespace", request.Namespace, "abck", request.Name)
+	reclog.Info("Reconciling")
+
+	instance := &av1.ArmadaBackup{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if apierrors.IsNotFound(err) {
+		// We are working asynchronously. By the time we receive the event,
+		// the object is already gone
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		reclog.Error(err, "Failed to lookup ArmadaBackup")
+		return reconcile.Result{}, err
+	}
+	if instance.GetDeletionTimestamp() != nil || isBackedUp(instance) {
+		return reconcile.Result{}, nil
+	}
+
+	spec, err := armadaif.GetBackupSpec(instance)
+	var storage armadaif.BackupStorage
+	if err == nil {
+		storage, err = armadaif.NewBackupStorage(ctx, r.client, instance.GetNamespace(), spec)
+	}
+	if errors.Is(err, armadaif.InvalidArmadaObjectException) {
+		// Nothing to retry until the spec or its Secrets are fixed.
+		hrc := av1.HelmResourceCondition{
+			Type:         av1.ConditionIrreconcilable,
+			Status:       av1.ConditionStatusTrue,
+			Reason:       armadaif.ReasonBackupError,
+			Message:      err.Error(),
+			ResourceName: instance.GetName(),
+		}
+		r.setBackupCondition(instance, hrc, av1.StateError)
+		r.logAndRecordFailure(instance, &hrc, err)
+		return reconcile.Result{}, r.updateResourceStatus(instance)
+	}
+	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
+
+	hrc := av1.HelmResourceCondition{
+		Type:            av1.ConditionRunning,
+		Status:          av1.ConditionStatusTrue,
+		Reason:          armadaif.ReasonBackupInProgress,
+		ResourceName:    instance.GetName(),
+		ResourceVersion: int32(instance.GetGeneration()),
+	}
+	r.setBackupCondition(instance, hrc, av1.StateRunning)
+	if err := r.updateResourceStatus(instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	backupCtx, cancel := context.WithTimeout(ctx, spec.Timeout())
+	defer cancel()
+	var location string
+	if err == nil {
+		location, err = r.backupArmadaCharts(backupCtx, instance, spec, storage)
+	}
+	instance.Status.RemoveCondition(av1.ConditionRunning)
+	if err != nil {
+		hrc := av1.HelmResourceCondition{
+			Type:            av1.ConditionFailed,
+			Status:          av1.ConditionStatusTrue,
+			Reason:          armadaif.ReasonBackupError,
+			Message:         err.Error(),
+			ResourceName:    instance.GetName(),
+			ResourceVersion: int32(instance.GetGeneration()),
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(backupCtx.Err(), context.DeadlineExceeded) {
+			hrc.Reason = armadaif.ReasonBackupTimeout
+			hrc.Message = fmt.Sprintf("backup did not complete within %s: %s", spec.Timeout(), err)
+		}
+		r.setBackupCondition(instance, hrc, av1.StateFailed)
+		r.logAndRecordFailure(instance, &hrc, err)
+		_ = r.updateResourceStatus(instance)
+		return reconcile.Result{}, err
+	}
+	instance.Status.RemoveCondition(av1.ConditionFailed)
+
+	hrc = av1.HelmResourceCondition{
+		Type:            armadaif.ConditionBackedUp,
+		Status:          av1.ConditionStatusTrue,
+		Reason:          armadaif.ReasonBackupSuccessful,
+		Message:         location,
+		ResourceName:    instance.GetName(),
+		ResourceVersion: int32(instance.GetGeneration()),
+	}
+	r.setBackupCondition(instance, hrc, av1.StateDeployed)
+	r.logAndRecordSuccess(instance, &hrc)
+
+	reclog.Info("Reconciled ArmadaBackup", "archive", location)
+	return reconcile.Result{}, r.updateResourceStatus(instance)
+}
+
+// isBackedUp checks if the archive of the current generation has been written.
+func isBackedUp(instance *av1.ArmadaBackup) bool {
+	helper := av1.HelmResourceConditionListHelper{Items: instance.Status.Conditions}
+	condition := helper.FindCondition(armadaif.ConditionBackedUp, av1.ConditionStatusTrue)
+	return condition != nil && int64(condition.ResourceVersion) == instance.GetGeneration()
+}
+
+// setBackupCondition records the condition and the state reached by the backup.
+func (r BackupReconciler) setBackupCondition(instance *av1.ArmadaBackup, hrc av1.HelmResourceCondition, state av1.HelmResourceState) {
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	instance.Status.ActualState = state
+	instance.Status.Satisfied = state == av1.StateDeployed
+}
+
+// backupArmadaCharts snapshots the ArmadaCharts and writes the archive to the
+// storage. It returns the location of the archive.
+func (r BackupReconciler) backupArmadaCharts(ctx context.Context, instance *av1.ArmadaBackup,
+	spec *armadaif.BackupSpec, storage armadaif.BackupStorage) (string, error) {
+	names := spec.Charts
+	if len(names) == 0 {
+		charts := &av1.ArmadaChartList{}
+		if err := r.client.List(ctx, charts, client.InNamespace(instance.GetNamespace())); err != nil {
+			return "", err
+		}
+		for _, chart := range charts.Items {
+			if !armadaif.IsAbstract(chart.GetAnnotations()) {
+				names = append(names, chart.GetName())
+			}
+		}
+		sort.Strings(names)
+	}
+
+	snapshots := make([]armadaif.ChartSnapshot, 0, len(names))
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		snapshot, err := r.snapshotArmadaChart(ctx, types.NamespacedName{Namespace: instance.GetNamespace(), Name: name})
+		if err != nil {
+			return "", fmt.Errorf("ArmadaChart %s: %w", name, err)
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+
+	var archive bytes.Buffer
+	if err := armadaif.WriteBackupArchive(&archive, armadaif.NewBackupIndex(instance, snapshots), snapshots); err != nil {
+		return "", err
+	}
+	return storage.Put(ctx, fmt.Sprintf("v%d", instance.GetGeneration()), archive.Bytes())
+}
+
+// snapshotArmadaChart collects the spec, the values and the release records of an ArmadaChart.
+// The values are saved before the substitutions, along with the substitutions themselves, so
+// that the values of the Secrets are not exposed by the archive. The release records are read
+// from the Secrets storing the Helm releases.
+func (r BackupReconciler) snapshotArmadaChart(ctx context.Context, key types.NamespacedName) (*armadaif.ChartSnapshot, error) {
+	chart := &av1.ArmadaChart{}
+	if err := r.client.Get(ctx, key, chart); err != nil {
+		return nil, err
+	}
+	layered, substitutions, err := armadaif.LayerArmadaChart(ctx, r.client, chart)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := armadaif.ResolveArmadaChart(ctx, r.client, chart)
+	if err != nil {
+		return nil, err
+	}
+
+	resource, err := runtime.DefaultUnstructuredConverter.ToUnstructured(chart)
+	if err != nil {
+		return nil, err
+	}
+	delete(resource, "status")
+	resource["metadata"] = map[string]interface{}{
+		"name":        chart.GetName(),
+		"namespace":   chart.GetNamespace(),
+		"labels":      chart.GetLabels(),
+		"annotations": chart.GetAnnotations(),
+	}
+
+	spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&layered.Spec)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := spec["values"].(map[string]interface{})
+
+	helmMgr := r.helmFactory.NewArmadaChartManager(resolved)
+	releases, err := helmMgr.ReleaseHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &armadaif.ChartSnapshot{
+		Name:          chart.GetName(),
+		Release:       helmMgr.ReleaseName(),
+		Resource:      resource,
+		Values:        values,
+		Substitutions: substitutions,
+		Releases:      releases,
+	}, nil
+}
+
+// logAndRecordFailure adds a failure event to the recorder
+func (r BackupReconciler) logAndRecordFailure(instance *av1.ArmadaBackup, hrc *av1.HelmResourceCondition, err error) {
+	reclog := abcklog.WithValues("namespace", instance.Namespace, "abck", instance.Name)
+	reclog.Error(err, fmt.Sprintf("%s. ErrorCondition", hrc.Type.String()))
+	r.recorder.Event(instance, corev1.EventTypeWarning, hrc.Type.String(), hrc.Reason.String())
+}
+
+// logAndRecordSuccess adds a success event to the recorder
+func (r BackupReconciler) logAndRecordSuccess(instance *av1.ArmadaBackup, hrc *av1.HelmResourceCondition) {
+	reclog := abcklog.WithValues("namespace", instance.Namespace, "abck", instance.Name)
+	reclog.Info(fmt.Sprintf("%s. SuccessCondition", hrc.Type.String()))
+	r.recorder.Event(instance, corev1.EventTypeNormal, hrc.Type.String(), hrc.Reason.String())
+}
+
+// updateResourceStatus updates the the Status field of the Resource object in the cluster
+func (r BackupReconciler) updateResourceStatus(instance *av1.ArmadaBackup) error {
+	reclog := abcklog.WithValues("namespace", instance.Namespace, "abck", instance.Name)
+
+	helper := av1.HelmResourceConditionListHelper{Items: instance.Status.Conditions}
+	instance.Status.Conditions = helper.InitIfEmpty()
+
+	err := r.client.Status().Update(context.TODO(), instance)
+	if err != nil {
+		reclog.Error(err, "Failure to update BackupStatus")
+	}
+	return err
+}
@@ -16,8 +16,10 @@ package armada
 
 import (
 	"reflect"
+	"strings"
 	"time"
 
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	services "github.com/keleustes/armada-operator/pkg/services"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -50,6 +52,25 @@ func (r *BaseReconciler) contains(slice []string, s string) bool {
 	return false
 }
 
+// newOrphanCondition builds the condition reporting the children which are no
+// longer listed in the spec, along with the policy applied to them.
+func (r *BaseReconciler) newOrphanCondition(policy services.OrphanPolicy, orphans []string, resourceName string) av1.HelmResourceCondition {
+	hrc := av1.HelmResourceCondition{
+		Type:         services.ConditionOrphaned,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonOrphanRetained,
+		Message:      strings.Join(orphans, ", "),
+		ResourceName: resourceName,
+	}
+	switch policy {
+	case services.OrphanPolicyDelete:
+		hrc.Reason = services.ReasonOrphanDeleted
+	case services.OrphanPolicyOrphan:
+		hrc.Reason = services.ReasonOrphanReleased
+	}
+	return hrc
+}
+
 // buildDependentPredicate create the predicates used by subresources watches
 func (r *BaseReconciler) BuildDependentPredicate() *crtpredicate.Funcs {
 
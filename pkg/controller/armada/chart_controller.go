@@ -16,7 +16,11 @@ package armada
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	helmmgr "github.com/keleustes/armada-operator/pkg/helm"
@@ -24,7 +28,11 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -53,6 +61,13 @@ func newReconciler(mgr manager.Manager) reconcile.Reconciler {
 		managerFactory: helmmgr.NewManagerFactory(mgr),
 	}
 
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		actlog.Error(err, "Failed to create clientset. Logs of the failed pods will not be collected")
+	} else {
+		r.podLogs = services.NewPodLogGetter(clientset)
+	}
+
 	return r
 }
 
@@ -83,20 +98,207 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		owner := av1.NewArmadaChartVersionKind("", "")
 		dependentPredicate := racr.BuildDependentPredicate()
 		racr.depResourceWatchUpdater = services.BuildDependentResourceWatchUpdater(mgr, owner, c, *dependentPredicate)
+
+		// Requeue the ArmadaCharts waiting for a prerequisite when the prerequisite changes.
+		// The watches are added once the kinds listed in the wait_for of the charts are known.
+		racr.prereqWatchUpdater = services.BuildKindWatchUpdater(c,
+			crthandler.EnqueueRequestsFromMapFunc(prerequisiteToArmadaCharts(mgr.GetClient())))
 	} else if rrf, isReconcileFunc := r.(*reconcile.Func); isReconcileFunc {
 		// Unit test issue
 		log.Info("UnitTests", "ReconfileFunc", rrf)
 	}
 
+	// The readiness of a Service depends on its Endpoints which are not part of the
+	// release. Watch for changes to the Endpoints and requeue the owner of the Service
+	// with the same name.
+	err = c.Watch(&source.Kind{Type: &corev1.Endpoints{}},
+		crthandler.EnqueueRequestsFromMapFunc(endpointsToArmadaChart(mgr.GetClient())))
+	if err != nil {
+		return err
+	}
+
+	// Requeue the ArmadaCharts waiting for a dependency when the dependency changes.
+	err = c.Watch(&source.Kind{Type: &av1.ArmadaChart{}},
+		crthandler.EnqueueRequestsFromMapFunc(dependencyToArmadaCharts(mgr.GetClient())))
+	if err != nil {
+		return err
+	}
+
+	// Requeue the ArmadaCharts layered on top of a parent when the parent changes.
+	err = c.Watch(&source.Kind{Type: &av1.ArmadaChart{}},
+		crthandler.EnqueueRequestsFromMapFunc(parentToArmadaCharts(mgr.GetClient())))
+	if err != nil {
+		return err
+	}
+
+	// Requeue the ArmadaCharts substituting values from a Secret when the Secret changes.
+	err = c.Watch(&source.Kind{Type: &corev1.Secret{}},
+		crthandler.EnqueueRequestsFromMapFunc(secretToArmadaCharts(mgr.GetClient())))
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// dependencyKey returns the key of a dependency of an ArmadaChart. The dependency
+// is the name of a chart of the same namespace, optionally written "namespace/name".
+// Dependencies on charts of other namespaces are rejected since the operator only
+// watches its own namespace.
+func dependencyKey(namespace string, dependency string) (types.NamespacedName, error) {
+	if i := strings.Index(dependency, "/"); i != -1 {
+		if dependency[:i] != namespace {
+			return types.NamespacedName{}, fmt.Errorf("%w: dependency %s is not in namespace %s",
+				services.InvalidArmadaObjectException, dependency, namespace)
+		}
+		dependency = dependency[i+1:]
+	}
+	return types.NamespacedName{Namespace: namespace, Name: dependency}, nil
+}
+
+// dependencyToArmadaCharts maps an ArmadaChart to the ArmadaCharts of the same
+// namespace depending on it
+func dependencyToArmadaCharts(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		charts := &av1.ArmadaChartList{}
+		if err := c.List(context.TODO(), charts, client.InNamespace(o.GetNamespace())); err != nil {
+			return nil
+		}
+
+		changed := types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}
+		requests := []reconcile.Request{}
+		for _, chart := range charts.Items {
+			for _, dependency := range chart.Spec.Dependencies {
+				if key, err := dependencyKey(chart.GetNamespace(), dependency); err == nil && key == changed {
+					requests = append(requests, reconcile.Request{
+						NamespacedName: types.NamespacedName{Namespace: chart.GetNamespace(), Name: chart.GetName()}})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
+
+// prerequisiteToArmadaCharts maps an object to the ArmadaCharts waiting for it
+func prerequisiteToArmadaCharts(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		charts := &av1.ArmadaChartList{}
+		if err := c.List(context.TODO(), charts); err != nil {
+			return nil
+		}
+
+		gvk := o.GetObjectKind().GroupVersionKind()
+		requests := []reconcile.Request{}
+		for i := range charts.Items {
+			chart := &charts.Items[i]
+			if services.IsAbstract(chart.GetAnnotations()) {
+				continue
+			}
+			ext, err := services.GetArmadaChartSpecExtensions(context.TODO(), c, chart)
+			if err != nil {
+				continue
+			}
+			for _, prereq := range ext.WaitFor {
+				if prereq.Matches(gvk, o) {
+					requests = append(requests, reconcile.Request{
+						NamespacedName: types.NamespacedName{Namespace: chart.GetNamespace(), Name: chart.GetName()}})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
+
+// layeredArmadaCharts returns the ArmadaCharts of the namespace which are layered,
+// directly or not, on top of the ArmadaCharts for which matches returns true.
+func layeredArmadaCharts(c client.Client, namespace string, matches func(chart *av1.ArmadaChart) bool) []reconcile.Request {
+	charts := &av1.ArmadaChartList{}
+	if err := c.List(context.TODO(), charts, client.InNamespace(namespace)); err != nil {
+		return nil
+	}
+
+	byName := make(map[string]*av1.ArmadaChart, len(charts.Items))
+	for i := range charts.Items {
+		byName[charts.Items[i].GetName()] = &charts.Items[i]
+	}
+
+	requests := []reconcile.Request{}
+	for i := range charts.Items {
+		chart := &charts.Items[i]
+		if services.IsAbstract(chart.GetAnnotations()) {
+			continue
+		}
+		visited := map[string]bool{}
+		for current := chart; current != nil && !visited[current.GetName()]; {
+			visited[current.GetName()] = true
+			if matches(current) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: namespace, Name: chart.GetName()}})
+				break
+			}
+			current = byName[current.GetAnnotations()[services.AnnotationLayeringParent]]
+		}
+	}
+	return requests
+}
+
+// parentToArmadaCharts maps an ArmadaChart to the ArmadaCharts layered on top of it
+func parentToArmadaCharts(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		return layeredArmadaCharts(c, o.GetNamespace(), func(chart *av1.ArmadaChart) bool {
+			return chart.GetAnnotations()[services.AnnotationLayeringParent] == o.GetName()
+		})
+	}
+}
+
+// secretToArmadaCharts maps a Secret to the ArmadaCharts substituting its values
+func secretToArmadaCharts(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		return layeredArmadaCharts(c, o.GetNamespace(), func(chart *av1.ArmadaChart) bool {
+			substitutions, err := services.GetSubstitutions(chart.GetAnnotations())
+			if err != nil {
+				return false
+			}
+			for _, substitution := range substitutions {
+				if substitution.Source.Secret == o.GetName() {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// endpointsToArmadaChart maps Endpoints to the ArmadaChart owning the corresponding Service
+func endpointsToArmadaChart(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		service := &corev1.Service{}
+		err := c.Get(context.TODO(), types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}, service)
+		if err != nil {
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+		for _, ref := range service.GetOwnerReferences() {
+			if ref.Kind == "ArmadaChart" {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: o.GetNamespace(), Name: ref.Name}})
+			}
+		}
+		return requests
+	}
+}
+
 var _ reconcile.Reconciler = &ChartReconciler{}
 
 // ChartReconciler reconciles custom resources as Helm releases.
 type ChartReconciler struct {
 	BaseReconciler
-	managerFactory services.HelmManagerFactory
+	managerFactory     services.HelmManagerFactory
+	podLogs            services.PodLogGetter
+	prereqWatchUpdater services.KindWatchUpdater
 }
 
 const (
@@ -131,8 +333,18 @@ func (r *ChartReconciler) Reconcile(ctx context.Context, request reconcile.Reque
 	}
 
 	instance.Init()
-	mgr := r.managerFactory.NewArmadaChartManager(instance)
+	if services.IsAbstract(instance.GetAnnotations()) {
+		reclog.Info("Abstract ArmadaChart; skipping")
+		return reconcile.Result{}, nil
+	}
+
+	resolved, ext, err := r.resolveArmadaChart(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	mgr := r.managerFactory.NewArmadaChartManager(resolved)
 	reclog = reclog.WithValues("release", mgr.ReleaseName())
+	renamedMgr := r.renamedReleaseManager(mgr, resolved, instance)
 
 	var shouldRequeue bool
 	if shouldRequeue, err = r.updateFinalizers(instance); shouldRequeue {
@@ -149,6 +361,11 @@ func (r *ChartReconciler) Reconcile(ctx context.Context, request reconcile.Reque
 	}
 
 	if instance.IsDeleted() {
+		// The release actually installed is the one recorded, even if the
+		// release prefix has been changed since.
+		if renamedMgr != nil {
+			mgr = renamedMgr
+		}
 		if shouldRequeue, err = r.deleteArmadaChart(mgr, instance); shouldRequeue {
 			// Need to requeue because finalizer update does not change metadata.generation
 			return reconcile.Result{Requeue: true}, err
@@ -172,20 +389,46 @@ func (r *ChartReconciler) Reconcile(ctx context.Context, request reconcile.Reque
 	}
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 
+	if rolledBack, err := r.rollbackArmadaChart(mgr, instance); rolledBack || err != nil {
+		return reconcile.Result{RequeueAfter: r.reconcilePeriod}, err
+	}
+
+	if mgr.IsInstalled() {
+		r.recordReleaseName(mgr, instance)
+	}
+
+	// Don't upgrade a release rolled back by the ArmadaManifest again until the ArmadaChart is updated.
+	updateRequired := mgr.IsUpdateRequired() && !isRollbackHeld(instance)
+
+	if !mgr.IsInstalled() || updateRequired {
+		// Uninstall the release recorded before the release prefix was changed
+		// before installing the release under its new name.
+		if renamed, err := r.uninstallRenamedRelease(renamedMgr, mgr, instance); renamed || err != nil {
+			return reconcile.Result{RequeueAfter: r.reconcilePeriod}, err
+		}
+
+		// Don't install or upgrade the release until the charts it depends on are deployed
+		// and its prerequisites are ready. The chart is requeued by the watches on the
+		// ArmadaCharts and on the kinds of the prerequisites.
+		if waiting, err := r.waitForDependencies(instance, ext); waiting || err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	switch {
 	case !mgr.IsInstalled():
 		if shouldRequeue, err = r.installArmadaChart(mgr, instance); shouldRequeue {
 			return reconcile.Result{RequeueAfter: r.reconcilePeriod}, err
 		}
 		return reconcile.Result{}, err
-	case mgr.IsUpdateRequired():
+	case updateRequired:
 		if shouldRequeue, err = r.updateArmadaChart(mgr, instance); shouldRequeue {
 			return reconcile.Result{RequeueAfter: r.reconcilePeriod}, err
 		}
 		return reconcile.Result{}, err
 	}
 
-	forcedRequeue, err := r.reconcileArmadaChart(mgr, instance)
+	forcedRequeue, err := r.reconcileArmadaChart(mgr, instance, ext)
 	if err != nil {
 		// Let's don't force a requeue.
 		return reconcile.Result{}, err
@@ -195,6 +438,17 @@ func (r *ChartReconciler) Reconcile(ctx context.Context, request reconcile.Reque
 		return reconcile.Result{RequeueAfter: r.reconcilePeriod}, nil
 	}
 
+	if instance.Status.ActualState == av1.StateDeployed {
+		testing, err := r.testArmadaChart(mgr, instance, ext)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if testing {
+			// The phase of the test pods is checked again later.
+			return reconcile.Result{RequeueAfter: r.reconcilePeriod}, nil
+		}
+	}
+
 	reclog.Info("Reconciled ArmadaChart")
 	if err = r.updateResourceStatus(instance); err != nil {
 		return reconcile.Result{Requeue: true}, err
@@ -221,8 +475,23 @@ func (r ChartReconciler) updateResource(instance *av1.ArmadaChart) error {
 	return r.client.Update(context.TODO(), instance)
 }
 
-// updateResourceStatus updates the the Status field of the Resource object in the cluster
+// updateResourceStatus updates the the Status field of the Resource object in the cluster.
+// The failures recorded along with the Error condition are kept as long as
+// the condition is set.
 func (r ChartReconciler) updateResourceStatus(instance *av1.ArmadaChart) error {
+	var failures []services.FailureDiagnostic
+	if condition := services.GetCondition(&instance.Status.HelmResourceStatus, av1.ConditionError); condition != nil &&
+		condition.Status == av1.ConditionStatusTrue {
+		if ext, err := services.GetArmadaChartStatusExtensions(context.TODO(), r.client, instance); err == nil {
+			failures = ext.Failures
+		}
+	}
+	return r.updateResourceStatusWithFailures(instance, failures)
+}
+
+// updateResourceStatusWithFailures updates the status of the ArmadaChart,
+// recording the causes of the failure of the release in status.failures.
+func (r ChartReconciler) updateResourceStatusWithFailures(instance *av1.ArmadaChart, failures []services.FailureDiagnostic) error {
 	reclog := actlog.WithValues("namespace", instance.Namespace, "act", instance.Name)
 
 	helper := av1.HelmResourceConditionListHelper{Items: instance.Status.Conditions}
@@ -230,7 +499,8 @@ func (r ChartReconciler) updateResourceStatus(instance *av1.ArmadaChart) error {
 
 	// JEB: Be sure to have update status subresources in the CRD.yaml
 	// JEB: Look for kubebuilder subresources in the _types.go
-	err := r.client.Status().Update(context.TODO(), instance)
+	err := services.UpdateArmadaChartStatus(context.TODO(), r.client, instance,
+		&services.ArmadaChartStatusExtensions{Failures: failures})
 	if err != nil {
 		reclog.Error(err, "Failure to update status. Ignoring")
 		err = nil
@@ -360,6 +630,8 @@ func (r ChartReconciler) installArmadaChart(mgr services.HelmManager, instance *
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
 
+	r.recordReleaseName(mgr, instance)
+
 	if err := r.watchDependentResources(installedResource); err != nil {
 		reclog.Error(err, "Failed to update watch on dependent resources")
 		return false, err
@@ -409,6 +681,8 @@ func (r ChartReconciler) updateArmadaChart(mgr services.HelmManager, instance *a
 		return false, err
 	}
 
+	r.updateFieldConflictCondition(instance, updatedResource)
+
 	hrc := av1.HelmResourceCondition{
 		Type:            av1.ConditionRunning,
 		Status:          av1.ConditionStatusTrue,
@@ -425,11 +699,11 @@ func (r ChartReconciler) updateArmadaChart(mgr services.HelmManager, instance *a
 }
 
 // reconcileArmadaChart reconciles the release with the cluster
-func (r ChartReconciler) reconcileArmadaChart(mgr services.HelmManager, instance *av1.ArmadaChart) (bool, error) {
+func (r ChartReconciler) reconcileArmadaChart(mgr services.HelmManager, instance *av1.ArmadaChart, ext *services.ArmadaChartSpecExtensions) (bool, error) {
 	reclog := actlog.WithValues("namespace", instance.Namespace, "act", instance.Name)
 	reclog.Info("Reconciling ArmadaChart and HelmRelease")
 
-	reconciledResource, err := mgr.ReconcileRelease(context.TODO())
+	reconciledResource, err := mgr.ReconcileRelease(context.TODO(), ext.DriftMode)
 	if err != nil {
 		instance.Status.RemoveCondition(av1.ConditionRunning)
 
@@ -447,27 +721,32 @@ func (r ChartReconciler) reconcileArmadaChart(mgr services.HelmManager, instance
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
+	reconciledResource.SetRolloutDeadline(ext.GetRolloutDeadline())
 
 	if err := r.watchDependentResources(reconciledResource); err != nil {
 		reclog.Error(err, "Failed to update watch on dependent resources")
 		return false, err
 	}
 
+	r.updateDriftCondition(instance, reconciledResource, ext.DriftMode)
+	r.updateFieldConflictCondition(instance, reconciledResource)
+
 	if reconciledResource.IsFailedOrError() {
 		// We reconcile. Everything is ready. The flow is now ok
 		instance.Status.RemoveCondition(av1.ConditionRunning)
 
+		diags := reconciledResource.CollectFailureDiagnostics(context.TODO(), r.podLogs)
 		hrc := av1.HelmResourceCondition{
 			Type:         av1.ConditionError,
 			Status:       av1.ConditionStatusTrue,
 			Reason:       av1.ReasonUnderlyingResourcesError,
-			Message:      "",
+			Message:      services.SummarizeFailureDiagnostics(diags),
 			ResourceName: reconciledResource.Name,
 		}
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 
-		err = r.updateResourceStatus(instance)
+		err = r.updateResourceStatusWithFailures(instance, diags)
 		return false, err
 	}
 
@@ -491,3 +770,394 @@ func (r ChartReconciler) reconcileArmadaChart(mgr services.HelmManager, instance
 
 	return false, nil
 }
+
+// testArmadaChart runs the Helm tests of the release when the ArmadaChartGroup
+// requested a test run the chart has not performed yet. The test pods are not
+// waited for: it returns true while the run is in progress. The outcome is
+// recorded in the Tested condition and the run in the test-completed annotation.
+func (r ChartReconciler) testArmadaChart(mgr services.HelmManager, instance *av1.ArmadaChart, ext *services.ArmadaChartSpecExtensions) (bool, error) {
+	requested, found := instance.GetAnnotations()[services.AnnotationTestRequested]
+	if !found || requested == instance.GetAnnotations()[services.AnnotationTestCompleted] {
+		return false, nil
+	}
+
+	reclog := actlog.WithValues("namespace", instance.Namespace, "act", instance.Name)
+	reclog.Info("Testing")
+
+	options := services.TestOptions{
+		Restart: requested != instance.GetAnnotations()[services.AnnotationTestStarted],
+		Cleanup: ext.GetTestCleanup(),
+	}
+	if options.Restart {
+		if err := r.recordAnnotation(instance, services.AnnotationTestStarted, requested); err != nil {
+			return false, err
+		}
+	}
+
+	testedResource, err := mgr.TestRelease(context.TODO(), options)
+	switch {
+	case errors.Is(err, services.ErrTestInProgress):
+		hrc := av1.HelmResourceCondition{
+			Type:         services.ConditionTested,
+			Status:       av1.ConditionStatusUnknown,
+			Reason:       services.ReasonTestPending,
+			Message:      err.Error(),
+			ResourceName: testedResource.Name,
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		return true, r.updateResourceStatus(instance)
+	case err != nil:
+		hrc := av1.HelmResourceCondition{
+			Type:         services.ConditionTested,
+			Status:       av1.ConditionStatusFalse,
+			Reason:       services.ReasonTestFailed,
+			Message:      err.Error(),
+			ResourceName: testedResource.Name,
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, err)
+	default:
+		hrc := av1.HelmResourceCondition{
+			Type:         services.ConditionTested,
+			Status:       av1.ConditionStatusTrue,
+			Reason:       services.ReasonTestSucceeded,
+			ResourceName: testedResource.Name,
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+	}
+
+	if err := r.updateResourceStatus(instance); err != nil {
+		return false, err
+	}
+	return false, r.recordAnnotation(instance, services.AnnotationTestCompleted, requested)
+}
+
+// rollbackArmadaChart reverts the release to its previous revision when the
+// ArmadaManifest requested a rollback the chart has not performed yet. It
+// returns true if a rollback was attempted. A failed rollback is not recorded
+// as completed, hence retried.
+func (r ChartReconciler) rollbackArmadaChart(mgr services.HelmManager, instance *av1.ArmadaChart) (bool, error) {
+	requested, found := instance.GetAnnotations()[services.AnnotationRollbackRequested]
+	if !found || requested == instance.GetAnnotations()[services.AnnotationRollbackCompleted] {
+		return false, nil
+	}
+
+	reclog := actlog.WithValues("namespace", instance.Namespace, "act", instance.Name)
+	reclog.Info("Rolling back")
+
+	rolledBackResource, rollbackErr := mgr.RollbackRelease(context.TODO())
+	if rollbackErr != nil {
+		hrc := av1.HelmResourceCondition{
+			Type:         services.ConditionRolledBack,
+			Status:       av1.ConditionStatusFalse,
+			Reason:       services.ReasonRollbackError,
+			Message:      rollbackErr.Error(),
+			ResourceName: rolledBackResource.Name,
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, rollbackErr)
+	} else {
+		hrc := av1.HelmResourceCondition{
+			Type:            services.ConditionRolledBack,
+			Status:          av1.ConditionStatusTrue,
+			Reason:          services.ReasonRollbackSuccessful,
+			Message:         rolledBackResource.Info.Description,
+			ResourceName:    rolledBackResource.Name,
+			ResourceVersion: int32(rolledBackResource.Version),
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+	}
+
+	if err := r.updateResourceStatus(instance); err != nil {
+		return true, err
+	}
+	if rollbackErr != nil {
+		// The rollback is retried until it succeeds or the ArmadaManifest
+		// requests another one.
+		return true, rollbackErr
+	}
+
+	generation := strconv.FormatInt(instance.GetGeneration(), 10)
+	if err := r.recordAnnotation(instance, services.AnnotationRolledBackGeneration, generation); err != nil {
+		return true, err
+	}
+	return true, r.recordAnnotation(instance, services.AnnotationRollbackCompleted, requested)
+}
+
+// isRollbackHeld checks if the release has been rolled back since the last
+// update of the ArmadaChart.
+func isRollbackHeld(instance *av1.ArmadaChart) bool {
+	generation := strconv.FormatInt(instance.GetGeneration(), 10)
+	return instance.GetAnnotations()[services.AnnotationRolledBackGeneration] == generation
+}
+
+// waitForDependencies checks that the ArmadaCharts listed in the dependencies
+// are deployed and that the objects listed in wait_for are ready.
+// If not, the Waiting condition names the blocking objects. Invalid dependencies
+// make the chart Irreconcilable until its spec is fixed.
+func (r ChartReconciler) waitForDependencies(instance *av1.ArmadaChart, ext *services.ArmadaChartSpecExtensions) (bool, error) {
+	keys := make([]types.NamespacedName, 0, len(instance.Spec.Dependencies))
+	for _, dependency := range instance.Spec.Dependencies {
+		key, err := dependencyKey(instance.GetNamespace(), dependency)
+		if err != nil {
+			return true, r.setDependenciesIrreconcilable(instance, err)
+		}
+		keys = append(keys, key)
+	}
+
+	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
+
+	if r.prereqWatchUpdater != nil {
+		gvks := make([]schema.GroupVersionKind, 0, len(ext.WaitFor))
+		for _, prereq := range ext.WaitFor {
+			gvks = append(gvks, prereq.GroupVersionKind())
+		}
+		if err := r.prereqWatchUpdater(gvks); err != nil {
+			return false, err
+		}
+	}
+
+	blockers := make([]string, 0)
+	for _, key := range keys {
+		chart := &av1.ArmadaChart{}
+		err := r.client.Get(context.TODO(), key, chart)
+		switch {
+		case apierrors.IsNotFound(err):
+			blockers = append(blockers, fmt.Sprintf("%s (NotFound)", key))
+		case err != nil:
+			return false, err
+		case chart.Status.ActualState != av1.StateDeployed:
+			blockers = append(blockers, fmt.Sprintf("%s (%s)", key, chart.Status.ActualState))
+		}
+	}
+
+	notReady, err := services.NewKubernetesDependency(r.client).CheckPrerequisites(context.TODO(), ext.WaitFor)
+	if err != nil {
+		return false, err
+	}
+	blockers = append(blockers, notReady...)
+
+	if len(blockers) == 0 {
+		instance.Status.RemoveCondition(services.ConditionWaiting)
+		return false, nil
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         services.ConditionWaiting,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonDependenciesNotReady,
+		Message:      strings.Join(blockers, ", "),
+		ResourceName: instance.GetName(),
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordSuccess(instance, &hrc)
+
+	return true, r.updateResourceStatus(instance)
+}
+
+// setDependenciesIrreconcilable records in the status that the dependencies of
+// the ArmadaChart are invalid.
+func (r ChartReconciler) setDependenciesIrreconcilable(instance *av1.ArmadaChart, err error) error {
+	hrc := av1.HelmResourceCondition{
+		Type:         av1.ConditionIrreconcilable,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       av1.ReasonReconcileError,
+		Message:      err.Error(),
+		ResourceName: instance.GetName(),
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordFailure(instance, &hrc, err)
+	return r.updateResourceStatus(instance)
+}
+
+// updateDriftCondition records in the status the objects of the release which
+// did not match the deployed manifest during the last reconciliation.
+func (r ChartReconciler) updateDriftCondition(instance *av1.ArmadaChart, reconciledResource *services.HelmRelease, mode services.DriftMode) {
+	drifted := reconciledResource.GetDriftedResources()
+	if len(drifted) == 0 {
+		instance.Status.RemoveCondition(services.ConditionDrifted)
+		return
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         services.ConditionDrifted,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonDriftHealed,
+		Message:      strings.Join(drifted, ", "),
+		ResourceName: reconciledResource.Name,
+	}
+	if mode == services.DriftModeReportOnly {
+		hrc.Reason = services.ReasonDriftDetected
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, fmt.Errorf("drifted resources: %s", hrc.Message))
+		return
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordSuccess(instance, &hrc)
+}
+
+// recordReleaseName records in the Release condition the name of the release
+// installed for the ArmadaChart. The condition is written along with the next
+// update of the status.
+func (r ChartReconciler) recordReleaseName(mgr services.HelmManager, instance *av1.ArmadaChart) {
+	name := mgr.ReleaseName()
+	if name == "" {
+		return
+	}
+	if current := services.GetCondition(&instance.Status.HelmResourceStatus, services.ConditionRelease); current != nil && current.ResourceName == name {
+		return
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         services.ConditionRelease,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonReleaseInstalled,
+		ResourceName: name,
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+}
+
+// renamedReleaseManager returns a manager of the release recorded in the Release
+// condition when it differs from the release the ArmadaChart maps to, i.e. when
+// the release prefix has been changed since the release was installed. It returns
+// nil otherwise.
+func (r ChartReconciler) renamedReleaseManager(mgr services.HelmManager, resolved *av1.ArmadaChart, instance *av1.ArmadaChart) services.HelmManager {
+	recorded := services.GetCondition(&instance.Status.HelmResourceStatus, services.ConditionRelease)
+	if recorded == nil || recorded.ResourceName == "" || recorded.ResourceName == mgr.ReleaseName() {
+		return nil
+	}
+
+	previous := resolved.DeepCopy()
+	previous.Spec.Release = recorded.ResourceName
+	annotations := make(map[string]string)
+	for key, value := range resolved.GetAnnotations() {
+		if key != services.AnnotationReleasePrefix {
+			annotations[key] = value
+		}
+	}
+	previous.SetAnnotations(annotations)
+	return r.managerFactory.NewArmadaChartManager(previous)
+}
+
+// uninstallRenamedRelease uninstalls the release recorded in the Release
+// condition when the release prefix has been changed, and removes the condition
+// so that the release is installed under its new name by the next reconcile.
+// It returns true if the ArmadaChart has to be requeued.
+func (r ChartReconciler) uninstallRenamedRelease(renamedMgr services.HelmManager, mgr services.HelmManager, instance *av1.ArmadaChart) (bool, error) {
+	if renamedMgr == nil {
+		return false, nil
+	}
+	deployed := renamedMgr.ReleaseName()
+
+	_, err := renamedMgr.UninstallRelease(context.TODO())
+	if err != nil && err != services.ErrNotFound {
+		err = fmt.Errorf("%w: uninstalling %s before installing %s: %s", services.ErrReleaseRenamed, deployed, mgr.ReleaseName(), err)
+		hrc := av1.HelmResourceCondition{
+			Type:         av1.ConditionFailed,
+			Status:       av1.ConditionStatusTrue,
+			Reason:       av1.ReasonUninstallError,
+			Message:      err.Error(),
+			ResourceName: deployed,
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, err)
+
+		_ = r.updateResourceStatus(instance)
+		return false, err
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         av1.ConditionRunning,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonReleaseRenamed,
+		Message:      fmt.Sprintf("release %s uninstalled, installing release %s", deployed, mgr.ReleaseName()),
+		ResourceName: deployed,
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	instance.Status.RemoveCondition(services.ConditionRelease)
+	r.logAndRecordSuccess(instance, &hrc)
+
+	return true, r.updateResourceStatus(instance)
+}
+
+// resolveArmadaChart layers the ArmadaChart on top of its parents and substitutes
+// the values of the Secrets. The resolved ArmadaChart is only handed to the Helm
+// manager: the ArmadaChart stored in the cluster is not modified. The extension
+// fields of the spec are returned along. The release of an ArmadaChart being
+// deleted is uninstalled even if its layering is broken.
+func (r ChartReconciler) resolveArmadaChart(instance *av1.ArmadaChart) (*av1.ArmadaChart, *services.ArmadaChartSpecExtensions, error) {
+	resolved, err := services.ResolveArmadaChart(context.TODO(), r.client, instance)
+	var ext *services.ArmadaChartSpecExtensions
+	if err == nil {
+		ext, err = services.GetArmadaChartSpecExtensions(context.TODO(), r.client, instance)
+	}
+	if err == nil {
+		return resolved, ext, nil
+	}
+	if instance.IsDeleted() {
+		return instance, &services.ArmadaChartSpecExtensions{DriftMode: services.DriftModeHeal}, nil
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         av1.ConditionIrreconcilable,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonLayeringError,
+		Message:      err.Error(),
+		ResourceName: instance.GetName(),
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordFailure(instance, &hrc, err)
+	_ = r.updateResourceStatus(instance)
+	return nil, nil, err
+}
+
+// recordAnnotation sets an annotation of the ArmadaChart. A copy of the
+// ArmadaChart is patched so that the pending status changes of instance
+// are preserved.
+func (r ChartReconciler) recordAnnotation(instance *av1.ArmadaChart, key string, value string) error {
+	if current, found := instance.GetAnnotations()[key]; found && current == value {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	patched := &av1.ArmadaChart{}
+	patched.SetNamespace(instance.GetNamespace())
+	patched.SetName(instance.GetName())
+	if err := r.client.Patch(context.TODO(), patched, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return err
+	}
+
+	instance.SetAnnotations(patched.GetAnnotations())
+	instance.SetResourceVersion(patched.GetResourceVersion())
+	return nil
+}
+
+// updateFieldConflictCondition records in the status the objects of the release
+// which could not be applied because some fields are owned by another manager.
+func (r ChartReconciler) updateFieldConflictCondition(instance *av1.ArmadaChart, resource *services.HelmRelease) {
+	conflicts := resource.GetFieldConflicts()
+	if len(conflicts) == 0 {
+		instance.Status.RemoveCondition(services.ConditionFieldConflict)
+		return
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         services.ConditionFieldConflict,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       services.ReasonFieldConflict,
+		Message:      strings.Join(conflicts, "; "),
+		ResourceName: resource.Name,
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordFailure(instance, &hrc, fmt.Errorf("field ownership conflicts: %s", hrc.Message))
+}
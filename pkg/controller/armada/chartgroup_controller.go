@@ -16,7 +16,9 @@ package armada
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
@@ -25,13 +27,16 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	crtpredicate "sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
@@ -84,6 +89,23 @@ func AddArmadaChartGroupController(mgr manager.Manager) error {
 		return err
 	}
 
+	// Requeue the ArmadaChartGroups waiting for a missing ArmadaChart when it gets created,
+	// the ArmadaChartGroups listing or selecting an ArmadaChart when it gets deleted,
+	// and the ArmadaChartGroups selecting an ArmadaChart when it gets created or relabeled.
+	err = c.Watch(&source.Kind{Type: &av1.ArmadaChart{}},
+		crthandler.EnqueueRequestsFromMapFunc(chartToArmadaChartGroups(mgr.GetClient())),
+		crtpredicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool { return true },
+			DeleteFunc: func(e event.DeleteEvent) bool { return true },
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return !labels.Equals(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+			},
+			GenericFunc: func(e event.GenericEvent) bool { return false },
+		})
+	if err != nil {
+		return err
+	}
+
 	// JEB: Will see later if we need to put the ownership between the backup/restore and the ChartGroup
 	// err = c.Watch(&source.Kind{Type: &av1.ArmadaBackup{}}, &crthandler.EnqueueRequestForOwner{OwnerType: owner},
 	// 	dependentPredicate)
@@ -93,6 +115,42 @@ func AddArmadaChartGroupController(mgr manager.Manager) error {
 	return nil
 }
 
+// chartToArmadaChartGroups maps an ArmadaChart to the ArmadaChartGroups of the same namespace
+// listing it or whose chart_selector matches its labels
+func chartToArmadaChartGroups(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		owners := &av1.ArmadaChartGroupList{}
+		if err := c.List(context.TODO(), owners, client.InNamespace(o.GetNamespace())); err != nil {
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+		for _, owner := range owners.Items {
+			if isChartGroupMember(c, &owner, o) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: owner.GetNamespace(), Name: owner.GetName()}})
+			}
+		}
+		return requests
+	}
+}
+
+// isChartGroupMember checks if the ArmadaChartGroup lists the ArmadaChart or selects it
+// through its chart_selector
+func isChartGroupMember(c client.Reader, owner *av1.ArmadaChartGroup, o client.Object) bool {
+	for _, name := range owner.Spec.Charts {
+		if name == o.GetName() {
+			return true
+		}
+	}
+	ext, err := armadaif.GetArmadaChartGroupSpecExtensions(context.TODO(), c, owner)
+	if err != nil {
+		return false
+	}
+	selector, err := ext.GetChartSelector()
+	return err == nil && selector != nil && selector.Matches(labels.Set(o.GetLabels()))
+}
+
 var _ reconcile.Reconciler = &ChartGroupReconciler{}
 
 // ChartGroupReconciler reconciles a ArmadaChartGroup object
@@ -164,7 +222,7 @@ func (r *ChartGroupReconciler) Reconcile(ctx context.Context, request reconcile.
 		if err != nil {
 			return reconcile.Result{}, err
 		}
-		err = r.client.Status().Update(context.TODO(), instance)
+		err = r.updateResourceStatus(mgr, instance)
 		return reconcile.Result{}, err
 	}
 
@@ -174,6 +232,10 @@ func (r *ChartGroupReconciler) Reconcile(ctx context.Context, request reconcile.
 	}
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 
+	if err := r.handleOrphans(mgr, instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
 	switch {
 	case !mgr.IsInstalled():
 		if shouldRequeue, err = r.installArmadaChartGroup(mgr, instance); shouldRequeue {
@@ -200,7 +262,7 @@ func (r *ChartGroupReconciler) Reconcile(ctx context.Context, request reconcile.
 	}
 
 	reclog.Info("Reconciled ChartGroup")
-	if err = r.updateResourceStatus(instance); err != nil {
+	if err = r.updateResourceStatus(mgr, instance); err != nil {
 		return reconcile.Result{Requeue: true}, err
 	}
 	return reconcile.Result{}, nil
@@ -225,16 +287,20 @@ func (r ChartGroupReconciler) updateResource(o *av1.ArmadaChartGroup) error {
 	return r.client.Update(context.TODO(), o)
 }
 
-// updateResourceStatus updates the the Status field of the Resource object in the cluster
-func (r ChartGroupReconciler) updateResourceStatus(instance *av1.ArmadaChartGroup) error {
+// updateResourceStatus updates the the Status field of the Resource object in the cluster.
+// The progress of the children, as currently reported by them, is recorded along.
+func (r ChartGroupReconciler) updateResourceStatus(mgr armadaif.ArmadaChartGroupManager, instance *av1.ArmadaChartGroup) error {
 	reclog := acglog.WithValues("namespace", instance.Namespace, "acg", instance.Name)
 
+	progress := mgr.Progress(context.TODO())
+	instance.Status.SetCondition(progress.Condition(), instance.Spec.TargetState)
+
 	helper := av1.HelmResourceConditionListHelper{Items: instance.Status.Conditions}
 	instance.Status.Conditions = helper.InitIfEmpty()
 
 	// JEB: Be sure to have update status subresources in the CRD.yaml
 	// JEB: Look for kubebuilder subresources in the _types.go
-	err := r.client.Status().Update(context.TODO(), instance)
+	err := armadaif.UpdateArmadaChartGroupStatus(context.TODO(), r.client, instance, progress)
 	if err != nil {
 		reclog.Error(err, "Failure to update ChartGroupStatus")
 		// err = nil
@@ -246,6 +312,22 @@ func (r ChartGroupReconciler) updateResourceStatus(instance *av1.ArmadaChartGrou
 // ensureSynced checks that the ArmadaChartGroupManager is in sync with the cluster
 func (r ChartGroupReconciler) ensureSynced(mgr armadaif.ArmadaChartGroupManager, instance *av1.ArmadaChartGroup) error {
 	if err := mgr.Sync(context.TODO()); err != nil {
+		var missing *armadaif.MissingResourcesError
+		if errors.As(err, &missing) {
+			// The children are created by their authors. Wait for them to show up.
+			hrc := av1.HelmResourceCondition{
+				Type:    armadaif.ConditionWaiting,
+				Status:  av1.ConditionStatusTrue,
+				Reason:  armadaif.ReasonResourcesNotFound,
+				Message: err.Error(),
+			}
+			instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+			r.logAndRecordSuccess(instance, &hrc)
+
+			_ = r.updateResourceStatus(mgr, instance)
+			return err
+		}
+
 		hrc := av1.HelmResourceCondition{
 			Type:    av1.ConditionIrreconcilable,
 			Status:  av1.ConditionStatusTrue,
@@ -255,13 +337,37 @@ func (r ChartGroupReconciler) ensureSynced(mgr armadaif.ArmadaChartGroupManager,
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return err
 	}
+	instance.Status.RemoveCondition(armadaif.ConditionWaiting)
 	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
 	return nil
 }
 
+// handleOrphans applies the orphan policy to the children no longer listed in
+// the spec and reports them in the status
+func (r ChartGroupReconciler) handleOrphans(mgr armadaif.ArmadaChartGroupManager, instance *av1.ArmadaChartGroup) error {
+	orphans, err := mgr.HandleOrphans(context.TODO())
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		instance.Status.RemoveCondition(armadaif.ConditionOrphaned)
+		return nil
+	}
+
+	policy := mgr.OrphanPolicy()
+	hrc := r.newOrphanCondition(policy, orphans, instance.GetName())
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	if policy == armadaif.OrphanPolicyRetainAndWarn {
+		r.logAndRecordFailure(instance, &hrc, fmt.Errorf("orphans retained: %s", hrc.Message))
+	} else {
+		r.logAndRecordSuccess(instance, &hrc)
+	}
+	return nil
+}
+
 // updateFinalizers asserts that the finalizers match what is expected based on
 // whether the instance is currently being deleted or not. It returns true if
 // the finalizers were changed, false otherwise
@@ -277,34 +383,6 @@ func (r ChartGroupReconciler) updateFinalizers(instance *av1.ArmadaChartGroup) (
 	return false, nil
 }
 
-// watchArmadaCharts updates all resources which are dependent on this one
-func (r ChartGroupReconciler) watchArmadaCharts(instance *av1.ArmadaChartGroup, toWatchList *av1.ArmadaCharts) error {
-	reclog := acglog.WithValues("namespace", instance.Namespace, "acg", instance.Name)
-
-	errs := make([]error, 0)
-	for _, toWatch := range (*toWatchList).List.Items {
-		found := toWatch.FromArmadaChart()
-		err := r.client.Get(context.TODO(), types.NamespacedName{Name: found.GetName(), Namespace: found.GetNamespace()}, found)
-		if err == nil {
-			if err1 := controllerutil.SetControllerReference(instance, found, r.scheme); err1 != nil {
-				reclog.Error(err1, "Can't get ownership of ArmadaChart", "name", found.GetName())
-				errs = append(errs, err1)
-				continue
-			}
-			if err2 := r.client.Update(context.TODO(), found); err2 != nil {
-				reclog.Error(err2, "Can't get ownership of ArmadaChart", "name", found.GetName())
-				errs = append(errs, err2)
-				continue
-			}
-		} else {
-			reclog.Error(err, "Can't get ownership of ArmadaChart", "name", found.GetName())
-			errs = append(errs, err)
-		}
-	}
-
-	return nil
-}
-
 // deleteArmadaChartGroup deletes an instance of an ArmadaChartGroup. It returns true if the reconciler should be re-enqueueed
 func (r ChartGroupReconciler) deleteArmadaChartGroup(mgr armadaif.ArmadaChartGroupManager, instance *av1.ArmadaChartGroup) (bool, error) {
 	reclog := acglog.WithValues("namespace", instance.Namespace, "acg", instance.Name)
@@ -317,6 +395,21 @@ func (r ChartGroupReconciler) deleteArmadaChartGroup(mgr armadaif.ArmadaChartGro
 	}
 
 	uninstalledResource, err := mgr.UninstallResource(context.TODO())
+	if errors.Is(err, armadaif.ErrUninstallInProgress) {
+		// The children are torn down one at a time. Keep the finalizer until
+		// the last one is gone.
+		hrc := av1.HelmResourceCondition{
+			Type:         av1.ConditionRunning,
+			Status:       av1.ConditionStatusTrue,
+			Reason:       armadaif.ReasonUninstallInProgress,
+			Message:      err.Error(),
+			ResourceName: uninstalledResource.GetName(),
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+
+		return true, r.updateResourceStatus(mgr, instance)
+	}
 	if err != nil && err != armadaif.ErrNotFound {
 		hrc := av1.HelmResourceCondition{
 			Type:         av1.ConditionFailed,
@@ -328,7 +421,7 @@ func (r ChartGroupReconciler) deleteArmadaChartGroup(mgr armadaif.ArmadaChartGro
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
@@ -344,7 +437,7 @@ func (r ChartGroupReconciler) deleteArmadaChartGroup(mgr armadaif.ArmadaChartGro
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 	}
-	if err := r.updateResourceStatus(instance); err != nil {
+	if err := r.updateResourceStatus(mgr, instance); err != nil {
 		return false, err
 	}
 
@@ -382,15 +475,11 @@ func (r ChartGroupReconciler) installArmadaChartGroup(mgr armadaif.ArmadaChartGr
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
 
-	if err := r.watchArmadaCharts(instance, installedResource); err != nil {
-		return false, err
-	}
-
 	hrc := av1.HelmResourceCondition{
 		Type:         av1.ConditionRunning,
 		Status:       av1.ConditionStatusTrue,
@@ -401,7 +490,7 @@ func (r ChartGroupReconciler) installArmadaChartGroup(mgr armadaif.ArmadaChartGr
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 	r.logAndRecordSuccess(instance, &hrc)
 
-	err = r.updateResourceStatus(instance)
+	err = r.updateResourceStatus(mgr, instance)
 	return true, err
 }
 
@@ -427,15 +516,11 @@ func (r ChartGroupReconciler) updateArmadaChartGroup(mgr armadaif.ArmadaChartGro
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
 
-	if err := r.watchArmadaCharts(instance, updatedResource); err != nil {
-		return false, err
-	}
-
 	hrc := av1.HelmResourceCondition{
 		Type:         av1.ConditionRunning,
 		Status:       av1.ConditionStatusTrue,
@@ -446,7 +531,7 @@ func (r ChartGroupReconciler) updateArmadaChartGroup(mgr armadaif.ArmadaChartGro
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 	r.logAndRecordSuccess(instance, &hrc)
 
-	err = r.updateResourceStatus(instance)
+	err = r.updateResourceStatus(mgr, instance)
 	return true, err
 }
 
@@ -464,19 +549,24 @@ func (r ChartGroupReconciler) reconcileArmadaChartGroup(mgr armadaif.ArmadaChart
 			Message:      err.Error(),
 			ResourceName: reconciledResource.GetName(),
 		}
+		if errors.Is(err, armadaif.DependencyException) {
+			// The dependencies of the charts contain a cycle. Retrying will not
+			// help until the charts are updated.
+			hrc.Reason = armadaif.ReasonDependencyError
+			instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+			r.logAndRecordFailure(instance, &hrc, err)
+
+			err = r.updateResourceStatus(mgr, instance)
+			return false, err
+		}
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
 
-	if err := r.watchArmadaCharts(instance, reconciledResource); err != nil {
-		reclog.Error(err, "Failed to update watch on dependent resources")
-		return false, err
-	}
-
 	if reconciledResource.IsFailedOrError() {
 		// We reconcile. Everything is ready. The flow is now ok
 		instance.Status.RemoveCondition(av1.ConditionRunning)
@@ -491,7 +581,7 @@ func (r ChartGroupReconciler) reconcileArmadaChartGroup(mgr armadaif.ArmadaChart
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 
-		err = r.updateResourceStatus(instance)
+		err = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 
@@ -509,7 +599,11 @@ func (r ChartGroupReconciler) reconcileArmadaChartGroup(mgr armadaif.ArmadaChart
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 
-		err = r.updateResourceStatus(instance)
+		if instance.Spec.TestCharts {
+			return r.testArmadaChartGroup(mgr, instance)
+		}
+
+		err = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 
@@ -517,3 +611,42 @@ func (r ChartGroupReconciler) reconcileArmadaChartGroup(mgr armadaif.ArmadaChart
 	// is updated.
 	return true, nil
 }
+
+// testArmadaChartGroup runs the Helm tests of the ArmadaCharts once the group is
+// deployed and aggregates the results in the Tested condition. It returns true
+// while some tests are pending.
+func (r ChartGroupReconciler) testArmadaChartGroup(mgr armadaif.ArmadaChartGroupManager, instance *av1.ArmadaChartGroup) (bool, error) {
+	results, err := mgr.TestResource(context.TODO())
+	if err != nil {
+		_ = r.updateResourceStatus(mgr, instance)
+		return false, err
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         armadaif.ConditionTested,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       armadaif.ReasonTestSucceeded,
+		Message:      fmt.Sprintf("passed: %s", strings.Join(results.Passed, ", ")),
+		ResourceName: instance.GetName(),
+	}
+	switch {
+	case len(results.Failed) != 0:
+		hrc.Status = av1.ConditionStatusFalse
+		hrc.Reason = armadaif.ReasonTestFailed
+		hrc.Message = fmt.Sprintf("failed: %s", strings.Join(results.Failed, ", "))
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, armadaif.ErrTestFailed)
+	case len(results.Pending) != 0:
+		hrc.Status = av1.ConditionStatusUnknown
+		hrc.Reason = armadaif.ReasonTestPending
+		hrc.Message = fmt.Sprintf("pending: %s", strings.Join(results.Pending, ", "))
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+	default:
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+	}
+
+	err = r.updateResourceStatus(mgr, instance)
+	return len(results.Failed) == 0 && len(results.Pending) != 0, err
+}
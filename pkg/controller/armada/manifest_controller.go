@@ -16,22 +16,30 @@ package armada
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	armadamgr "github.com/keleustes/armada-operator/pkg/armada"
+	helmmgr "github.com/keleustes/armada-operator/pkg/helm"
 	armadaif "github.com/keleustes/armada-operator/pkg/services"
 
+	yaml "gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	crthandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	crtpredicate "sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
@@ -52,6 +60,7 @@ func AddArmadaManifestController(mgr manager.Manager) error {
 			reconcilePeriod: reconcilePeriod,
 		},
 		managerFactory: armadamgr.NewManagerFactory(mgr),
+		helmFactory:    helmmgr.NewManagerFactory(mgr),
 	}
 
 	// Create a new controller
@@ -84,6 +93,19 @@ func AddArmadaManifestController(mgr manager.Manager) error {
 		return err
 	}
 
+	// Requeue the ArmadaManifests waiting for a missing ArmadaChartGroup when it gets created.
+	err = c.Watch(&source.Kind{Type: &av1.ArmadaChartGroup{}},
+		crthandler.EnqueueRequestsFromMapFunc(chartGroupToArmadaManifests(mgr.GetClient())),
+		crtpredicate.Funcs{
+			CreateFunc:  func(e event.CreateEvent) bool { return true },
+			DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+			UpdateFunc:  func(e event.UpdateEvent) bool { return false },
+			GenericFunc: func(e event.GenericEvent) bool { return false },
+		})
+	if err != nil {
+		return err
+	}
+
 	// JEB: Will see later if we need to put the ownership between the backup/restore and the Manifest
 	// err = c.Watch(&source.Kind{Type: &av1.ArmadaBackup{}}, &crthandler.EnqueueRequestForOwner{OwnerType: owner},
 	// 	dependentPredicate)
@@ -93,12 +115,35 @@ func AddArmadaManifestController(mgr manager.Manager) error {
 	return nil
 }
 
+// chartGroupToArmadaManifests maps an ArmadaChartGroup to the ArmadaManifests of the same namespace listing it
+func chartGroupToArmadaManifests(c client.Client) crthandler.MapFunc {
+	return func(o client.Object) []reconcile.Request {
+		owners := &av1.ArmadaManifestList{}
+		if err := c.List(context.TODO(), owners, client.InNamespace(o.GetNamespace())); err != nil {
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+		for _, owner := range owners.Items {
+			for _, name := range owner.Spec.ChartGroups {
+				if name == o.GetName() {
+					requests = append(requests, reconcile.Request{
+						NamespacedName: types.NamespacedName{Namespace: owner.GetNamespace(), Name: owner.GetName()}})
+					break
+				}
+			}
+		}
+		return requests
+	}
+}
+
 var _ reconcile.Reconciler = &ManifestReconciler{}
 
 // ManifestReconciler reconciles a ArmadaManifest object
 type ManifestReconciler struct {
 	BaseReconciler
 	managerFactory armadaif.ArmadaManagerFactory
+	helmFactory    armadaif.HelmManagerFactory
 }
 
 const (
@@ -135,6 +180,11 @@ func (r *ManifestReconciler) Reconcile(ctx context.Context, request reconcile.Re
 	mgr := r.managerFactory.NewArmadaManifestManager(instance)
 	reclog = reclog.WithValues("amf", mgr.ResourceName())
 
+	if armadaif.IsDryRun(instance.GetAnnotations()) && !instance.IsDeleted() {
+		// Compute the plan only. Nothing is enabled, adopted or finalized.
+		return reconcile.Result{}, r.planArmadaManifest(mgr, instance)
+	}
+
 	var shouldRequeue bool
 	if shouldRequeue, err = r.updateFinalizers(instance); shouldRequeue {
 		// Need to requeue because finalizer update does not change metadata.generation
@@ -163,7 +213,7 @@ func (r *ManifestReconciler) Reconcile(ctx context.Context, request reconcile.Re
 		if err != nil {
 			return reconcile.Result{}, err
 		}
-		err = r.client.Status().Update(context.TODO(), instance)
+		err = r.updateResourceStatus(mgr, instance)
 		return reconcile.Result{}, err
 	}
 
@@ -173,6 +223,14 @@ func (r *ManifestReconciler) Reconcile(ctx context.Context, request reconcile.Re
 	}
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 
+	if err := r.handleOrphans(mgr, instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := r.handleFailures(mgr, instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
 	switch {
 	case !mgr.IsInstalled():
 		if shouldRequeue, err = r.installArmadaManifest(mgr, instance); shouldRequeue {
@@ -197,7 +255,7 @@ func (r *ManifestReconciler) Reconcile(ctx context.Context, request reconcile.Re
 	}
 
 	reclog.Info("Reconciled ArmadaManifest")
-	if err = r.updateResourceStatus(instance); err != nil {
+	if err = r.updateResourceStatus(mgr, instance); err != nil {
 		return reconcile.Result{Requeue: true}, err
 	}
 	return reconcile.Result{}, nil
@@ -222,16 +280,20 @@ func (r ManifestReconciler) updateResource(o *av1.ArmadaManifest) error {
 	return r.client.Update(context.TODO(), o)
 }
 
-// updateResourceStatus updates the the Status field of the Resource object in the cluster
-func (r ManifestReconciler) updateResourceStatus(instance *av1.ArmadaManifest) error {
+// updateResourceStatus updates the the Status field of the Resource object in the cluster.
+// The progress of the children, as currently reported by them, is recorded along.
+func (r ManifestReconciler) updateResourceStatus(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) error {
 	reclog := amflog.WithValues("namespace", instance.Namespace, "amf", instance.Name)
 
+	progress := mgr.Progress(context.TODO())
+	instance.Status.SetCondition(progress.Condition(), instance.Spec.TargetState)
+
 	helper := av1.HelmResourceConditionListHelper{Items: instance.Status.Conditions}
 	instance.Status.Conditions = helper.InitIfEmpty()
 
 	// JEB: Be sure to have update status subresources in the CRD.yaml
 	// JEB: Look for kubebuilder subresources in the _types.go
-	err := r.client.Status().Update(context.TODO(), instance)
+	err := armadaif.UpdateArmadaManifestStatus(context.TODO(), r.client, instance, progress)
 	if err != nil {
 		reclog.Error(err, "Failure to update ManifestStatus")
 	}
@@ -242,6 +304,22 @@ func (r ManifestReconciler) updateResourceStatus(instance *av1.ArmadaManifest) e
 // ensureSynced checks that the ArmadaManifestManager is in sync with the cluster
 func (r ManifestReconciler) ensureSynced(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) error {
 	if err := mgr.Sync(context.TODO()); err != nil {
+		var missing *armadaif.MissingResourcesError
+		if errors.As(err, &missing) {
+			// The children are created by their authors. Wait for them to show up.
+			hrc := av1.HelmResourceCondition{
+				Type:    armadaif.ConditionWaiting,
+				Status:  av1.ConditionStatusTrue,
+				Reason:  armadaif.ReasonResourcesNotFound,
+				Message: err.Error(),
+			}
+			instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+			r.logAndRecordSuccess(instance, &hrc)
+
+			_ = r.updateResourceStatus(mgr, instance)
+			return err
+		}
+
 		hrc := av1.HelmResourceCondition{
 			Type:    av1.ConditionIrreconcilable,
 			Status:  av1.ConditionStatusTrue,
@@ -251,13 +329,150 @@ func (r ManifestReconciler) ensureSynced(mgr armadaif.ArmadaManifestManager, ins
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return err
 	}
+	instance.Status.RemoveCondition(armadaif.ConditionWaiting)
 	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
 	return nil
 }
 
+// handleOrphans applies the orphan policy to the children no longer listed in
+// the spec and reports them in the status
+func (r ManifestReconciler) handleOrphans(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) error {
+	orphans, err := mgr.HandleOrphans(context.TODO())
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		instance.Status.RemoveCondition(armadaif.ConditionOrphaned)
+		return nil
+	}
+
+	policy := mgr.OrphanPolicy()
+	hrc := r.newOrphanCondition(policy, orphans, instance.GetName())
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	if policy == armadaif.OrphanPolicyRetainAndWarn {
+		r.logAndRecordFailure(instance, &hrc, fmt.Errorf("orphans retained: %s", hrc.Message))
+	} else {
+		r.logAndRecordSuccess(instance, &hrc)
+	}
+	return nil
+}
+
+// planArmadaManifest computes the actions the operator would take to deploy the
+// ArmadaManifest and records them in the <name>-plan Secret
+func (r ManifestReconciler) planArmadaManifest(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) error {
+	reclog := amflog.WithValues("namespace", instance.Namespace, "amf", instance.Name)
+	reclog.Info("Planning")
+
+	plan, err := mgr.PlanResource(context.TODO(), r.helmFactory)
+	if err == nil {
+		err = r.writePlan(instance, plan)
+	}
+	if err != nil {
+		hrc := av1.HelmResourceCondition{
+			Type:         armadaif.ConditionPlanned,
+			Status:       av1.ConditionStatusFalse,
+			Reason:       armadaif.ReasonPlanError,
+			Message:      err.Error(),
+			ResourceName: instance.GetName(),
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordFailure(instance, &hrc, err)
+
+		_ = r.updateResourceStatus(mgr, instance)
+		return err
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         armadaif.ConditionPlanned,
+		Status:       av1.ConditionStatusTrue,
+		Reason:       armadaif.ReasonPlanReady,
+		Message:      fmt.Sprintf("%s. See Secret %s-plan", plan.Summary(), instance.GetName()),
+		ResourceName: instance.GetName(),
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordSuccess(instance, &hrc)
+
+	return r.updateResourceStatus(mgr, instance)
+}
+
+// writePlan creates or updates the Secret holding the plan of the ArmadaManifest.
+// A Secret is used since the diffs contain the rendered values of the releases.
+func (r ManifestReconciler) writePlan(instance *av1.ArmadaManifest, plan *armadaif.ManifestPlan) error {
+	data, err := yaml.Marshal(plan)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace: instance.GetNamespace(),
+		Name:      instance.GetName() + "-plan",
+	}}
+	_, err = controllerutil.CreateOrUpdate(context.TODO(), r.client, secret, func() error {
+		secret.Type = corev1.SecretTypeOpaque
+		secret.Data = map[string][]byte{
+			"plan.yaml": data,
+			"summary":   []byte(plan.Summary()),
+		}
+		return controllerutil.SetControllerReference(instance, secret, r.scheme)
+	})
+	return err
+}
+
+// updateTestCondition reports the ArmadaChartGroups whose tests failed. The next
+// ArmadaChartGroups stay disabled and the manifest is requeued by the watch on the
+// ArmadaChartGroups when the failed ones are tested again.
+func (r ManifestReconciler) updateTestCondition(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) {
+	failed := mgr.FailedTests()
+	if len(failed) == 0 {
+		instance.Status.RemoveCondition(armadaif.ConditionTested)
+		return
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         armadaif.ConditionTested,
+		Status:       av1.ConditionStatusFalse,
+		Reason:       armadaif.ReasonTestFailed,
+		Message:      strings.Join(failed, ", "),
+		ResourceName: instance.GetName(),
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordFailure(instance, &hrc, fmt.Errorf("%w: ArmadaChartGroups %s", armadaif.ErrTestFailed, hrc.Message))
+}
+
+// handleFailures applies the failure policy to the failed ArmadaChartGroups
+// and reports the action taken in the status
+func (r ManifestReconciler) handleFailures(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) error {
+	failed, err := mgr.HandleFailures(context.TODO(), r.helmFactory)
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		instance.Status.RemoveCondition(armadaif.ConditionChartGroupFailed)
+		return nil
+	}
+
+	hrc := av1.HelmResourceCondition{
+		Type:         armadaif.ConditionChartGroupFailed,
+		Status:       av1.ConditionStatusTrue,
+		Message:      strings.Join(failed, ", "),
+		ResourceName: instance.GetName(),
+	}
+	switch mgr.FailurePolicy() {
+	case armadaif.FailurePolicyContinue:
+		hrc.Reason = armadaif.ReasonFailureContinued
+	case armadaif.FailurePolicyRollbackGroup:
+		hrc.Reason = armadaif.ReasonFailureRolledBack
+	default:
+		hrc.Reason = armadaif.ReasonFailureHalted
+	}
+	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+	r.logAndRecordFailure(instance, &hrc, fmt.Errorf("failed ArmadaChartGroups: %s", hrc.Message))
+	return nil
+}
+
 // updateFinalizers asserts that the finalizers match what is expected based on
 // whether the instance is currently being deleted or not. It returns true if
 // the finalizers were changed, false otherwise
@@ -273,34 +488,6 @@ func (r ManifestReconciler) updateFinalizers(instance *av1.ArmadaManifest) (bool
 	return false, nil
 }
 
-// watchArmadaChartGroups updates all resources which are dependent on this one
-func (r ManifestReconciler) watchArmadaChartGroups(instance *av1.ArmadaManifest, toWatchList *av1.ArmadaChartGroups) error {
-	reclog := amflog.WithValues("namespace", instance.Namespace, "amf", instance.Name)
-
-	errs := make([]error, 0)
-	for _, toWatch := range (*toWatchList).List.Items {
-		found := toWatch.FromArmadaChartGroup()
-		err := r.client.Get(context.TODO(), types.NamespacedName{Name: found.GetName(), Namespace: found.GetNamespace()}, found)
-		if err == nil {
-			if err1 := controllerutil.SetControllerReference(instance, found, r.scheme); err1 != nil {
-				reclog.Error(err1, "Can't get ownership of ArmadaChartGroup", "name", found.GetName())
-				errs = append(errs, err1)
-				continue
-			}
-			if err2 := r.client.Update(context.TODO(), found); err2 != nil {
-				reclog.Error(err2, "Can't get ownership of ArmadaChartGroup", "name", found.GetName())
-				errs = append(errs, err2)
-				continue
-			}
-		} else {
-			reclog.Error(err, "Can't get ownership of ArmadaChartGroup", "name", found.GetName())
-			errs = append(errs, err)
-		}
-	}
-
-	return nil
-}
-
 // deleteArmadaManifest deletes an instance of an ArmadaManifest. It returns true if the reconciler should be re-enqueueed
 func (r ManifestReconciler) deleteArmadaManifest(mgr armadaif.ArmadaManifestManager, instance *av1.ArmadaManifest) (bool, error) {
 	reclog := amflog.WithValues("namespace", instance.Namespace, "amf", instance.Name)
@@ -313,6 +500,21 @@ func (r ManifestReconciler) deleteArmadaManifest(mgr armadaif.ArmadaManifestMana
 	}
 
 	uninstalledResource, err := mgr.UninstallResource(context.TODO())
+	if errors.Is(err, armadaif.ErrUninstallInProgress) {
+		// The children are torn down one at a time. Keep the finalizer until
+		// the last one is gone.
+		hrc := av1.HelmResourceCondition{
+			Type:         av1.ConditionRunning,
+			Status:       av1.ConditionStatusTrue,
+			Reason:       armadaif.ReasonUninstallInProgress,
+			Message:      err.Error(),
+			ResourceName: uninstalledResource.GetName(),
+		}
+		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
+		r.logAndRecordSuccess(instance, &hrc)
+
+		return true, r.updateResourceStatus(mgr, instance)
+	}
 	if err != nil && err != armadaif.ErrNotFound {
 		hrc := av1.HelmResourceCondition{
 			Type:         av1.ConditionFailed,
@@ -324,7 +526,7 @@ func (r ManifestReconciler) deleteArmadaManifest(mgr armadaif.ArmadaManifestMana
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
@@ -340,7 +542,7 @@ func (r ManifestReconciler) deleteArmadaManifest(mgr armadaif.ArmadaManifestMana
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 	}
-	if err := r.updateResourceStatus(instance); err != nil {
+	if err := r.updateResourceStatus(mgr, instance); err != nil {
 		return false, err
 	}
 
@@ -378,15 +580,11 @@ func (r ManifestReconciler) installArmadaManifest(mgr armadaif.ArmadaManifestMan
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
 
-	if err := r.watchArmadaChartGroups(instance, installedResource); err != nil {
-		return false, err
-	}
-
 	hrc := av1.HelmResourceCondition{
 		Type:         av1.ConditionRunning,
 		Status:       av1.ConditionStatusTrue,
@@ -397,7 +595,7 @@ func (r ManifestReconciler) installArmadaManifest(mgr armadaif.ArmadaManifestMan
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 	r.logAndRecordSuccess(instance, &hrc)
 
-	err = r.updateResourceStatus(instance)
+	err = r.updateResourceStatus(mgr, instance)
 	return true, err
 }
 
@@ -423,15 +621,11 @@ func (r ManifestReconciler) updateArmadaManifest(mgr armadaif.ArmadaManifestMana
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionFailed)
 
-	if err := r.watchArmadaChartGroups(instance, updatedResource); err != nil {
-		return false, err
-	}
-
 	hrc := av1.HelmResourceCondition{
 		Type:         av1.ConditionRunning,
 		Status:       av1.ConditionStatusTrue,
@@ -442,7 +636,7 @@ func (r ManifestReconciler) updateArmadaManifest(mgr armadaif.ArmadaManifestMana
 	instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 	r.logAndRecordSuccess(instance, &hrc)
 
-	err = r.updateResourceStatus(instance)
+	err = r.updateResourceStatus(mgr, instance)
 	return true, err
 }
 
@@ -465,15 +659,11 @@ func (r ManifestReconciler) reconcileArmadaManifest(mgr armadaif.ArmadaManifestM
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordFailure(instance, &hrc, err)
 
-		_ = r.updateResourceStatus(instance)
+		_ = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 	instance.Status.RemoveCondition(av1.ConditionIrreconcilable)
-
-	if err := r.watchArmadaChartGroups(instance, reconciledResource); err != nil {
-		reclog.Error(err, "Failed to update watch on dependent resources")
-		return false, err
-	}
+	r.updateTestCondition(mgr, instance)
 
 	if reconciledResource.IsFailedOrError() {
 		// We reconcile. Everything is ready. The flow is now ok
@@ -489,7 +679,7 @@ func (r ManifestReconciler) reconcileArmadaManifest(mgr armadaif.ArmadaManifestM
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 
-		err = r.updateResourceStatus(instance)
+		err = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 
@@ -507,7 +697,7 @@ func (r ManifestReconciler) reconcileArmadaManifest(mgr armadaif.ArmadaManifestM
 		instance.Status.SetCondition(hrc, instance.Spec.TargetState)
 		r.logAndRecordSuccess(instance, &hrc)
 
-		err = r.updateResourceStatus(instance)
+		err = r.updateResourceStatus(mgr, instance)
 		return false, err
 	}
 
@@ -25,7 +25,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"time"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
 	helmif "github.com/keleustes/armada-operator/pkg/services"
@@ -35,16 +36,20 @@ import (
 	"helm.sh/helm/v3/pkg/kube"
 	rpb "helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/storage"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type chartmanager struct {
 	storageBackend *storage.Storage
 	helmKubeClient *kube.Client
+	kubeClient     client.Client
 	chartLocation  *av1.ArmadaChartSource
 
 	renderer    interface{}
 	releaseName string
 	namespace   string
+	testTimeout time.Duration
 
 	spec   interface{}
 	status *av1.ArmadaChartStatus
@@ -52,6 +57,7 @@ type chartmanager struct {
 	isInstalled      bool
 	isUpdateRequired bool
 	deployedRelease  *helmif.HelmRelease
+	candidateRelease *rpb.Release
 	chart            *cpb.Chart
 	config           *map[string]interface{}
 }
@@ -108,6 +114,7 @@ func (m *chartmanager) Sync(ctx context.Context) error {
 		return fmt.Errorf("failed to get deployed release: %s", err)
 	}
 	m.deployedRelease = &helmif.HelmRelease{Release: deployedRelease}
+	m.deployedRelease.SetReader(m.kubeClient)
 	m.isInstalled = true
 
 	// Get the next candidate release to determine if an update is necessary.
@@ -115,6 +122,7 @@ func (m *chartmanager) Sync(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get candidate release: %s", err)
 	}
+	m.candidateRelease = candidateRelease
 	if deployedRelease.Manifest != candidateRelease.Manifest {
 		m.isUpdateRequired = true
 	}
@@ -177,7 +185,7 @@ func (m chartmanager) loadChartAndConfig() (*cpb.Chart, *map[string]interface{},
 func (m chartmanager) getDeployedRelease() (*rpb.Release, error) {
 	deployedRelease, err := m.storageBackend.Deployed(m.releaseName)
 	if err != nil {
-		if strings.Contains(err.Error(), "has no deployed releases") {
+		if noDeployedErr(err) {
 			return nil, helmif.ErrNotFound
 		}
 		return nil, err
@@ -197,25 +205,92 @@ func (m chartmanager) InstallRelease(ctx context.Context) (*helmif.HelmRelease,
 	return &helmif.HelmRelease{Release: installedRelease}, nil
 }
 
-// UpdateRelease performs a Helm release update.
+// UpdateRelease performs a Helm release update. The rendered objects of
+// the candidate release are server-side applied and the candidate is recorded
+// as a new revision, superseding the deployed one, as helm upgrade does.
 func (m chartmanager) UpdateRelease(ctx context.Context) (*helmif.HelmRelease, *helmif.HelmRelease, error) {
-	// updatedRelease, err := updateRelease(ctx, m.renderer, m.releaseName, m.chart, m.config)
-	var updatedRelease = &rpb.Release{}
-	return m.deployedRelease, &helmif.HelmRelease{Release: updatedRelease}, nil
+	candidateRelease, err := m.getCandidateRelease(ctx, m.renderer, m.releaseName, m.chart, m.config)
+	if err != nil {
+		return m.deployedRelease, &helmif.HelmRelease{Release: &rpb.Release{Name: m.releaseName}}, err
+	}
+	updatedRelease, err := upgradeRelease(m.storageBackend, m.helmKubeClient, m.kubeClient, m.namespace, m.releaseName, candidateRelease)
+	return m.deployedRelease, updatedRelease, err
 }
 
 // ReconcileRelease creates or patches resources as necessary to match the
-// deployed release's manifest.
-func (m chartmanager) ReconcileRelease(ctx context.Context) (*helmif.HelmRelease, error) {
-	// err := reconcileRelease(ctx, m.helmKubeClient, m.namespace, m.deployedRelease.Manifest)
-	return m.deployedRelease, nil
+// deployed release's manifest, unless the drift mode is report-only.
+func (m chartmanager) ReconcileRelease(ctx context.Context, mode helmif.DriftMode) (*helmif.HelmRelease, error) {
+	if m.deployedRelease == nil || m.deployedRelease.Release == nil {
+		return m.deployedRelease, nil
+	}
+	err := reconcileRelease(m.helmKubeClient, m.namespace, mode, m.deployedRelease)
+	return m.deployedRelease, err
 }
 
 // UninstallRelease performs a Helm release uninstall.
 func (m chartmanager) UninstallRelease(ctx context.Context) (*helmif.HelmRelease, error) {
-	// uninstalledRelease, err := uninstallRelease(ctx, m.storageBackend, m.renderer, m.releaseName)
-	var uninstalledRelease = &rpb.Release{}
-	return &helmif.HelmRelease{Release: uninstalledRelease}, nil
+	uninstalledRelease, err := uninstallRelease(m.storageBackend, m.helmKubeClient, m.namespace, m.releaseName)
+	if uninstalledRelease == nil {
+		uninstalledRelease = &helmif.HelmRelease{Release: &rpb.Release{Name: m.releaseName}}
+	}
+	return uninstalledRelease, err
+}
+
+// TestRelease runs the tests of the deployed release. The progress of the run
+// is recorded in the hooks of the deployed release.
+func (m chartmanager) TestRelease(ctx context.Context, options helmif.TestOptions) (*helmif.HelmRelease, error) {
+	if m.deployedRelease == nil || m.deployedRelease.Release == nil {
+		return &helmif.HelmRelease{Release: &rpb.Release{Name: m.releaseName}}, helmif.ErrNotFound
+	}
+	err := testRelease(m.helmKubeClient, m.namespace, m.deployedRelease.Release, options, m.testTimeout)
+	if updateErr := m.storageBackend.Update(m.deployedRelease.Release); updateErr != nil && err == nil {
+		err = updateErr
+	}
+	return m.deployedRelease, err
+}
+
+// DiffRelease returns the differences between the manifest of the deployed
+// release and the manifest of the candidate release. It does not modify anything.
+func (m chartmanager) DiffRelease(ctx context.Context) (string, error) {
+	candidateRelease := m.candidateRelease
+	if candidateRelease == nil {
+		var err error
+		candidateRelease, err = m.getCandidateRelease(ctx, m.renderer, m.releaseName, m.chart, m.config)
+		if err != nil {
+			return "", fmt.Errorf("failed to get candidate release: %s", err)
+		}
+	}
+
+	deployedManifest := ""
+	if m.deployedRelease != nil && m.deployedRelease.Release != nil {
+		deployedManifest = m.deployedRelease.Manifest
+	}
+	return helmif.DiffManifests(deployedManifest, candidateRelease.Manifest), nil
+}
+
+// RollbackRelease reverts the release to its previous deployed revision.
+func (m chartmanager) RollbackRelease(ctx context.Context) (*helmif.HelmRelease, error) {
+	rolledBackRelease, err := rollbackRelease(m.storageBackend, m.helmKubeClient, m.kubeClient, m.namespace, m.releaseName)
+	if rolledBackRelease == nil {
+		rolledBackRelease = &helmif.HelmRelease{Release: &rpb.Release{Name: m.releaseName}}
+	}
+	return rolledBackRelease, err
+}
+
+// ReleaseHistory returns the revisions of the release recorded in the storage
+// backend, oldest first.
+func (m chartmanager) ReleaseHistory(ctx context.Context) ([]*helmif.HelmRelease, error) {
+	history, err := m.storageBackend.History(m.releaseName)
+	if err != nil && !notFoundErr(err) {
+		return nil, fmt.Errorf("failed to retrieve release history: %s", err)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+
+	releases := make([]*helmif.HelmRelease, 0, len(history))
+	for _, rel := range history {
+		releases = append(releases, &helmif.HelmRelease{Release: rel})
+	}
+	return releases, nil
 }
 
 func (m chartmanager) getChart() (*cpb.Chart, error) {
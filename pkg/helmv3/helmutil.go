@@ -21,3 +21,9 @@ import (
 func notFoundErr(err error) bool {
 	return strings.Contains(err.Error(), "not found")
 }
+
+// noDeployedErr checks if the storage backend found revisions of the release
+// but none of them is deployed.
+func noDeployedErr(err error) bool {
+	return strings.Contains(err.Error(), "has no deployed releases")
+}
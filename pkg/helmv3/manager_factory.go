@@ -16,7 +16,12 @@ package helmv3
 
 import (
 	"os"
+	"sync"
+	"time"
 
+	"k8s.io/client-go/kubernetes"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
@@ -28,34 +33,86 @@ import (
 )
 
 type managerFactory struct {
-	storageBackend *storage.Storage
+	storage        *releaseStorage
 	helmKubeClient *kube.Client
+	kubeClient     client.Client
+}
+
+// maxHistory is the number of revisions of a release kept in the storage.
+const maxHistory = 10
+
+// releaseStorage keeps the storage of the releases of each namespace. The
+// releases are stored in Secrets of their namespace, as helm does, so that
+// their history survives restarts of the operator.
+type releaseStorage struct {
+	sync.Mutex
+	clientset kubernetes.Interface
+	backends  map[string]*storage.Storage
+}
+
+// backend returns the storage of the releases of the namespace.
+func (s *releaseStorage) backend(namespace string) *storage.Storage {
+	s.Lock()
+	defer s.Unlock()
+	if backend, found := s.backends[namespace]; found {
+		return backend
+	}
+	backend := storage.Init(driver.NewSecrets(s.clientset.CoreV1().Secrets(namespace)))
+	backend.MaxHistory = maxHistory
+	s.backends[namespace] = backend
+	return backend
 }
 
+// sharedStorage is shared by the factories of the operator so that the
+// ArmadaManifest and ArmadaBackup controllers read the releases installed by
+// the ArmadaChart controller through the same storage.
+var (
+	sharedStorage     *releaseStorage
+	sharedStorageOnce sync.Once
+)
+
 // NewManagerFactory returns a new Helm manager factory capable of installing and uninstalling releases.
 func NewManagerFactory(mgr manager.Manager) helmif.HelmManagerFactory {
-	// Create Tiller's storage backend and kubernetes client
-	storageBackend := storage.Init(driver.NewMemory())
+	// Create Tiller's kubernetes client
 	helmKubeClient, err := NewFromManager(mgr)
 	if err != nil {
-		log.Error(err, "Failed to create new Tiller client.", storageBackend, helmKubeClient)
+		log.Error(err, "Failed to create new Tiller client.")
 		os.Exit(1)
 	}
 
-	return &managerFactory{storageBackend, helmKubeClient}
+	sharedStorageOnce.Do(func() {
+		clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			log.Error(err, "Failed to create the client of the release storage.")
+			os.Exit(1)
+		}
+		sharedStorage = &releaseStorage{clientset: clientset, backends: make(map[string]*storage.Storage)}
+	})
+
+	return &managerFactory{sharedStorage, helmKubeClient, mgr.GetClient()}
 }
 
 func (f managerFactory) NewArmadaChartManager(r *av1.ArmadaChart) helmif.HelmManager {
 	return &chartmanager{
-		storageBackend: f.storageBackend,
+		storageBackend: f.storage.backend(r.GetNamespace()),
 		helmKubeClient: f.helmKubeClient,
+		kubeClient:     f.kubeClient,
 		chartLocation:  r.Spec.Source,
 
 		renderer:    nil,
-		releaseName: r.Spec.Release,
+		releaseName: helmif.GetReleaseName(r.Spec.Release, r.GetAnnotations()),
 		namespace:   r.GetNamespace(),
+		testTimeout: getTestTimeout(r.Spec.Test),
 
 		spec:   r.Spec,
 		status: &r.Status,
 	}
 }
+
+// getTestTimeout returns the timeout of the tests of the ArmadaChart, specified in seconds.
+func getTestTimeout(test *av1.ArmadaTest) time.Duration {
+	if test == nil || test.Timeout <= 0 {
+		return defaultTestTimeout
+	}
+	return time.Duration(test.Timeout) * time.Second
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	rpb "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReleaseStorage(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	clientset := fake.NewSimpleClientset()
+	s := &releaseStorage{clientset: clientset, backends: make(map[string]*storage.Storage)}
+	g.Expect(s.backend("openstack")).To(gomega.BeIdenticalTo(s.backend("openstack")))
+
+	// The releases are stored in Secrets of their namespace
+	g.Expect(s.backend("openstack").Create(newRelease(1, rpb.StatusDeployed))).To(gomega.Succeed())
+	secrets, err := clientset.CoreV1().Secrets("openstack").List(context.TODO(), metav1.ListOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(secrets.Items).To(gomega.HaveLen(1))
+
+	_, err = s.backend("ceph").Deployed("keystone")
+	g.Expect(err).To(gomega.HaveOccurred())
+	deployed, err := s.backend("openstack").Deployed("keystone")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(deployed.Version).To(gomega.Equal(1))
+}
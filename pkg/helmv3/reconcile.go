@@ -0,0 +1,162 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"bytes"
+	"fmt"
+
+	helmif "github.com/keleustes/armada-operator/pkg/services"
+
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// fieldManager is the name under which the operator owns the fields of
+// the objects it applies.
+const fieldManager = "armada-operator"
+
+// reconcileRelease compares every object of the release manifest with its
+// live state in the cluster. Deleted objects and drifted fields are applied
+// back using server-side apply unless the mode is DriftModeReportOnly.
+// Fields owned by other managers, for instance the replicas of a Deployment
+// scaled by an HPA, are left untouched. The drifted objects, the field
+// ownership conflicts and the live objects are recorded in the HelmRelease.
+func reconcileRelease(helmKubeClient *kube.Client, namespace string, mode helmif.DriftMode, release *helmif.HelmRelease) error {
+	expectedInfos, err := buildManifest(helmKubeClient, namespace, release.Manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, expected := range expectedInfos {
+		id := resourceID(expected)
+
+		existing, err := newHelper(expected).Get(expected.Namespace, expected.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get %s: %s", id, err)
+		}
+
+		if err == nil {
+			// Let the API server compute the result of the apply
+			// to figure out if any of the fields we own drifted.
+			dryRun, err := applyObject(newHelper(expected).DryRun(true), expected)
+			if apierrors.IsConflict(err) {
+				release.AddToConflicts(fmt.Sprintf("%s: %s", id, err))
+				addToCache(release, existing)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to dry-run apply %s: %s", id, err)
+			}
+			if !isDrifted(existing, dryRun) {
+				addToCache(release, existing)
+				continue
+			}
+		}
+
+		release.AddToDrifted(id)
+		if mode == helmif.DriftModeReportOnly {
+			if existing != nil {
+				addToCache(release, existing)
+			}
+			continue
+		}
+
+		applied, err := applyObject(newHelper(expected), expected)
+		if apierrors.IsConflict(err) {
+			release.AddToConflicts(fmt.Sprintf("%s: %s", id, err))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %s", id, err)
+		}
+		log.Info("Applied drifted resource", "resource", id)
+		addToCache(release, applied)
+	}
+
+	return nil
+}
+
+// buildManifest splits a rendered manifest into the objects it contains.
+// The builder is created from the factory since the namespace field
+// of the kube.Client is shared across all the releases.
+func buildManifest(helmKubeClient *kube.Client, namespace string, manifest string) ([]*resource.Info, error) {
+	infos, err := helmKubeClient.Factory.NewBuilder().
+		Unstructured().
+		ContinueOnError().
+		NamespaceParam(namespace).
+		DefaultNamespace().
+		Stream(bytes.NewBufferString(manifest), "").
+		Flatten().
+		Do().
+		Infos()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build release manifest: %s", err)
+	}
+	return infos, nil
+}
+
+// newHelper returns a resource.Helper acting as the operator field manager.
+func newHelper(info *resource.Info) *resource.Helper {
+	return resource.NewHelper(info.Client, info.Mapping).WithFieldManager(fieldManager)
+}
+
+// applyObject server-side applies the object described by info. Conflicts
+// with other field managers are not forced and are returned as errors.
+func applyObject(helper *resource.Helper, info *resource.Info) (runtime.Object, error) {
+	data, err := runtime.Encode(unstructured.UnstructuredJSONScheme, info.Object)
+	if err != nil {
+		return nil, err
+	}
+	force := false
+	return helper.Patch(info.Namespace, info.Name, apitypes.ApplyPatchType, data, &metav1.PatchOptions{Force: &force})
+}
+
+// isDrifted compares the live object with the result of applying the
+// manifest. Bookkeeping fields updated by the API server are ignored.
+func isDrifted(existing, applied runtime.Object) bool {
+	existingU, ok1 := existing.(*unstructured.Unstructured)
+	appliedU, ok2 := applied.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		return true
+	}
+
+	existingU = existingU.DeepCopy()
+	appliedU = appliedU.DeepCopy()
+	for _, u := range []*unstructured.Unstructured{existingU, appliedU} {
+		u.SetManagedFields(nil)
+		u.SetResourceVersion("")
+		u.SetGeneration(0)
+	}
+	return !equality.Semantic.DeepEqual(existingU.Object, appliedU.Object)
+}
+
+// resourceID builds a human readable identifier of an object of the release.
+func resourceID(info *resource.Info) string {
+	return fmt.Sprintf("%s/%s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+}
+
+// addToCache stores the live version of an object in the release.
+func addToCache(release *helmif.HelmRelease, obj runtime.Object) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		release.AddToCache(*u)
+	}
+}
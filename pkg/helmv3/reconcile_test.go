@@ -0,0 +1,53 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newConfigMap(data map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      "foo",
+			"namespace": "default",
+		},
+		"data": data,
+	}}
+	return u
+}
+
+func TestIsDrifted(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	existing := newConfigMap(map[string]interface{}{"key": "value"})
+	existing.SetResourceVersion("12")
+
+	// Bookkeeping done by the API server is not drift
+	applied := newConfigMap(map[string]interface{}{"key": "value"})
+	applied.SetResourceVersion("13")
+	applied.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: fieldManager}})
+	g.Expect(isDrifted(existing, applied)).To(gomega.BeFalse())
+
+	// Fields of the manifest which have been modified are drift
+	applied = newConfigMap(map[string]interface{}{"key": "modified"})
+	g.Expect(isDrifted(existing, applied)).To(gomega.BeTrue())
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"fmt"
+
+	helmif "github.com/keleustes/armada-operator/pkg/services"
+
+	"helm.sh/helm/v3/pkg/kube"
+	rpb "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// previousRelease returns the most recent revision of the release preceding
+// current which has been successfully deployed.
+func previousRelease(history []*rpb.Release, current *rpb.Release) *rpb.Release {
+	var previous *rpb.Release
+	for _, rel := range history {
+		if rel.Version >= current.Version {
+			continue
+		}
+		if rel.Info == nil || (rel.Info.Status != rpb.StatusDeployed && rel.Info.Status != rpb.StatusSuperseded) {
+			continue
+		}
+		if previous == nil || rel.Version > previous.Version {
+			previous = rel
+		}
+	}
+	return previous
+}
+
+// rollbackRelease reverts the release to its previous deployed revision. The
+// objects of the previous revision are applied back, the objects which only
+// exist in the current revision are deleted, and the result is recorded as a
+// new revision, as helm rollback does.
+func rollbackRelease(storageBackend *storage.Storage, helmKubeClient *kube.Client, kubeClient client.Client, namespace string, releaseName string) (*helmif.HelmRelease, error) {
+	current, err := storageBackend.Last(releaseName)
+	if err != nil {
+		if notFoundErr(err) {
+			return nil, helmif.ErrNotFound
+		}
+		return nil, err
+	}
+
+	history, err := storageBackend.History(releaseName)
+	if err != nil {
+		return nil, err
+	}
+	previous := previousRelease(history, current)
+	if previous == nil {
+		return nil, fmt.Errorf("%w: no previous revision of release %s", helmif.ErrNotFound, releaseName)
+	}
+
+	rolledBack := &rpb.Release{
+		Name:      releaseName,
+		Namespace: current.Namespace,
+		Chart:     previous.Chart,
+		Config:    previous.Config,
+		Manifest:  previous.Manifest,
+		Hooks:     previous.Hooks,
+		Version:   current.Version + 1,
+		Info: &rpb.Info{
+			LastDeployed: helmtime.Now(),
+			Status:       rpb.StatusPendingRollback,
+			Description:  fmt.Sprintf("Rollback to %d", previous.Version),
+		},
+	}
+	if current.Info != nil {
+		rolledBack.Info.FirstDeployed = current.Info.FirstDeployed
+	}
+	release := &helmif.HelmRelease{Release: rolledBack}
+	release.SetReader(kubeClient)
+
+	err = reconcileRelease(helmKubeClient, namespace, helmif.DriftModeHeal, release)
+	if err == nil {
+		err = deleteRemovedObjects(helmKubeClient, namespace, current.Manifest, previous.Manifest)
+	}
+	if err != nil {
+		rolledBack.Info.Status = rpb.StatusFailed
+		rolledBack.Info.Description = fmt.Sprintf("Rollback to %d failed: %s", previous.Version, err)
+		_ = storageBackend.Create(rolledBack)
+		return release, err
+	}
+
+	if err := supersedeDeployed(storageBackend, releaseName); err != nil {
+		return release, err
+	}
+	rolledBack.Info.Status = rpb.StatusDeployed
+	return release, storageBackend.Create(rolledBack)
+}
+
+// deleteRemovedObjects deletes the objects of the current manifest which are not
+// part of the target manifest.
+func deleteRemovedObjects(helmKubeClient *kube.Client, namespace string, current string, target string) error {
+	currentInfos, err := buildManifest(helmKubeClient, namespace, current)
+	if err != nil {
+		return err
+	}
+	targetInfos, err := buildManifest(helmKubeClient, namespace, target)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, info := range targetInfos {
+		kept[resourceID(info)] = true
+	}
+	removed := make(kube.ResourceList, 0)
+	for _, info := range currentInfos {
+		if !kept[resourceID(info)] {
+			removed = append(removed, info)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if _, errs := helmKubeClient.Delete(removed); len(errs) != 0 {
+		return fmt.Errorf("failed to delete objects removed from the release: %s", errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	rpb "helm.sh/helm/v3/pkg/release"
+)
+
+func newRelease(version int, status rpb.Status) *rpb.Release {
+	return &rpb.Release{Name: "keystone", Version: version, Info: &rpb.Info{Status: status}}
+}
+
+func TestPreviousRelease(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	history := []*rpb.Release{
+		newRelease(1, rpb.StatusSuperseded),
+		newRelease(2, rpb.StatusSuperseded),
+		newRelease(3, rpb.StatusFailed),
+		newRelease(4, rpb.StatusFailed),
+	}
+
+	// Failed revisions are skipped
+	previous := previousRelease(history, history[3])
+	g.Expect(previous).NotTo(gomega.BeNil())
+	g.Expect(previous.Version).To(gomega.Equal(2))
+
+	// The first revision has nothing to roll back to
+	g.Expect(previousRelease(history, history[0])).To(gomega.BeNil())
+}
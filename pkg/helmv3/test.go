@@ -0,0 +1,177 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	helmif "github.com/keleustes/armada-operator/pkg/services"
+
+	"helm.sh/helm/v3/pkg/kube"
+	rpb "helm.sh/helm/v3/pkg/release"
+	helmtime "helm.sh/helm/v3/pkg/time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// defaultTestTimeout is used when the ArmadaChart does not specify test.timeout.
+const defaultTestTimeout = 300 * time.Second
+
+// testRelease runs the test hooks of the release one at a time, by increasing
+// weight, as helm test does. It does not wait for the tests: each call starts
+// the next test, or checks the phase of the running one, and returns
+// ErrTestInProgress until the run completed. The outcome of each test is
+// recorded in the LastRun of its hook. restart discards the outcome of the
+// previous run, and cleanup deletes the test objects once the run completed.
+func testRelease(helmKubeClient *kube.Client, namespace string, release *rpb.Release, options helmif.TestOptions, timeout time.Duration) error {
+	tests := make([]*rpb.Hook, 0)
+	for _, hook := range release.Hooks {
+		for _, event := range hook.Events {
+			if event == rpb.HookTest {
+				tests = append(tests, hook)
+				break
+			}
+		}
+	}
+	sort.SliceStable(tests, func(i, j int) bool { return tests[i].Weight < tests[j].Weight })
+
+	if options.Restart {
+		for _, test := range tests {
+			test.LastRun = rpb.HookExecution{}
+		}
+	}
+
+	for _, test := range tests {
+		infos, err := buildManifest(helmKubeClient, namespace, test.Manifest)
+		if err != nil {
+			return fmt.Errorf("failed to build test %s: %s", test.Name, err)
+		}
+		resources := kube.ResourceList(infos)
+
+		switch test.LastRun.Phase {
+		case rpb.HookPhaseSucceeded:
+			continue
+		case rpb.HookPhaseFailed:
+			return completeTestRun(helmKubeClient, namespace, tests, options,
+				fmt.Errorf("%w: %s", helmif.ErrTestFailed, test.Name))
+		case rpb.HookPhaseRunning:
+			phase, err := testPhase(resources)
+			if err != nil {
+				return fmt.Errorf("failed to check test %s: %s", test.Name, err)
+			}
+			if phase == rpb.HookPhaseRunning && time.Since(test.LastRun.StartedAt.Time) > timeout {
+				phase = rpb.HookPhaseFailed
+			}
+			if phase == rpb.HookPhaseRunning {
+				return fmt.Errorf("%w: %s", helmif.ErrTestInProgress, test.Name)
+			}
+			test.LastRun.Phase = phase
+			test.LastRun.CompletedAt = helmtime.Now()
+			if phase == rpb.HookPhaseFailed {
+				return completeTestRun(helmKubeClient, namespace, tests, options,
+					fmt.Errorf("%w: %s", helmif.ErrTestFailed, test.Name))
+			}
+			continue
+		}
+
+		// The objects left by a previous run are deleted first.
+		if _, errs := helmKubeClient.Delete(resources); len(errs) == 0 {
+			if err := helmKubeClient.WaitForDelete(resources, timeout); err != nil {
+				return fmt.Errorf("failed to delete previous run of test %s: %s", test.Name, err)
+			}
+		}
+
+		test.LastRun = rpb.HookExecution{StartedAt: helmtime.Now(), Phase: rpb.HookPhaseRunning}
+		if _, err := helmKubeClient.Create(resources); err != nil {
+			test.LastRun.Phase = rpb.HookPhaseFailed
+			test.LastRun.CompletedAt = helmtime.Now()
+			return completeTestRun(helmKubeClient, namespace, tests, options,
+				fmt.Errorf("%w: failed to create test %s: %s", helmif.ErrTestFailed, test.Name, err))
+		}
+		return fmt.Errorf("%w: %s", helmif.ErrTestInProgress, test.Name)
+	}
+	return completeTestRun(helmKubeClient, namespace, tests, options, nil)
+}
+
+// completeTestRun deletes the test objects when cleanup is requested and
+// returns the outcome of the run.
+func completeTestRun(helmKubeClient *kube.Client, namespace string, tests []*rpb.Hook, options helmif.TestOptions, outcome error) error {
+	if !options.Cleanup {
+		return outcome
+	}
+	for _, test := range tests {
+		infos, err := buildManifest(helmKubeClient, namespace, test.Manifest)
+		if err != nil {
+			return fmt.Errorf("failed to build test %s: %s", test.Name, err)
+		}
+		if _, errs := helmKubeClient.Delete(kube.ResourceList(infos)); len(errs) != 0 && !apierrors.IsNotFound(errs[0]) {
+			log.Info("Failed to clean up test", "name", test.Name, "error", errs[0].Error())
+		}
+	}
+	return outcome
+}
+
+// testPhase returns the phase of the test objects: the phase of the Pods and
+// the completion of the Jobs. Other objects are complete once created.
+func testPhase(resources kube.ResourceList) (rpb.HookPhase, error) {
+	phase := rpb.HookPhaseSucceeded
+	for _, info := range resources {
+		if err := info.Get(); err != nil {
+			if apierrors.IsNotFound(err) {
+				return rpb.HookPhaseFailed, nil
+			}
+			return rpb.HookPhaseUnknown, err
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(info.Object)
+		if err != nil {
+			return rpb.HookPhaseUnknown, err
+		}
+
+		switch info.Mapping.GroupVersionKind.Kind {
+		case "Pod":
+			podPhase, _, _ := unstructured.NestedString(obj, "status", "phase")
+			switch podPhase {
+			case "Succeeded":
+			case "Failed":
+				return rpb.HookPhaseFailed, nil
+			default:
+				phase = rpb.HookPhaseRunning
+			}
+		case "Job":
+			conditions, _, _ := unstructured.NestedSlice(obj, "status", "conditions")
+			complete := false
+			for _, c := range conditions {
+				condition, _ := c.(map[string]interface{})
+				if condition["status"] != "True" {
+					continue
+				}
+				switch condition["type"] {
+				case "Complete":
+					complete = true
+				case "Failed":
+					return rpb.HookPhaseFailed, nil
+				}
+			}
+			if !complete {
+				phase = rpb.HookPhaseRunning
+			}
+		}
+	}
+	return phase, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"fmt"
+
+	helmif "github.com/keleustes/armada-operator/pkg/services"
+
+	"helm.sh/helm/v3/pkg/kube"
+	rpb "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+)
+
+// uninstallRelease deletes the objects of the last revision of the release and
+// purges the revisions of the release from the storage backend, as helm
+// uninstall does.
+func uninstallRelease(storageBackend *storage.Storage, helmKubeClient *kube.Client, namespace string, releaseName string) (*helmif.HelmRelease, error) {
+	last, err := storageBackend.Last(releaseName)
+	if err != nil {
+		if notFoundErr(err) {
+			return nil, helmif.ErrNotFound
+		}
+		return nil, err
+	}
+
+	infos, err := buildManifest(helmKubeClient, namespace, last.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 0 {
+		if _, errs := helmKubeClient.Delete(infos); len(errs) != 0 {
+			return nil, fmt.Errorf("failed to delete the objects of release %s: %s", releaseName, errs[0])
+		}
+	}
+
+	history, err := storageBackend.History(releaseName)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range history {
+		if _, err := storageBackend.Delete(rel.Name, rel.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	if last.Info != nil {
+		last.Info.Status = rpb.StatusUninstalled
+		last.Info.Description = "Uninstallation complete"
+	}
+	return &helmif.HelmRelease{Release: last}, nil
+}
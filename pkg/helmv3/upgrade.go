@@ -0,0 +1,113 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"fmt"
+
+	helmif "github.com/keleustes/armada-operator/pkg/services"
+
+	"helm.sh/helm/v3/pkg/kube"
+	rpb "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// upgradeRelease applies the objects of the candidate release, deletes the
+// objects dropped from the deployed release, and records the candidate as the
+// next revision of the release. The deployed revision is superseded once the
+// objects have been applied, so that the following reconciliations heal the
+// cluster towards the upgraded manifest.
+func upgradeRelease(storageBackend *storage.Storage, helmKubeClient *kube.Client, kubeClient client.Client, namespace string, releaseName string, candidate *rpb.Release) (*helmif.HelmRelease, error) {
+	current, err := storageBackend.Deployed(releaseName)
+	if err != nil && !notFoundErr(err) && !noDeployedErr(err) {
+		return &helmif.HelmRelease{Release: &rpb.Release{Name: releaseName}}, err
+	}
+	version, err := nextVersion(storageBackend, releaseName)
+	if err != nil {
+		return &helmif.HelmRelease{Release: &rpb.Release{Name: releaseName}}, err
+	}
+
+	upgraded := &rpb.Release{
+		Name:      releaseName,
+		Namespace: namespace,
+		Chart:     candidate.Chart,
+		Config:    candidate.Config,
+		Manifest:  candidate.Manifest,
+		Hooks:     candidate.Hooks,
+		Version:   version,
+		Info: &rpb.Info{
+			LastDeployed: helmtime.Now(),
+			Status:       rpb.StatusPendingUpgrade,
+			Description:  "Preparing upgrade",
+		},
+	}
+	if current != nil && current.Info != nil {
+		upgraded.Info.FirstDeployed = current.Info.FirstDeployed
+	}
+	release := &helmif.HelmRelease{Release: upgraded}
+	release.SetReader(kubeClient)
+
+	err = reconcileRelease(helmKubeClient, namespace, helmif.DriftModeHeal, release)
+	if err == nil && current != nil {
+		err = deleteRemovedObjects(helmKubeClient, namespace, current.Manifest, upgraded.Manifest)
+	}
+	if err != nil {
+		upgraded.Info.Status = rpb.StatusFailed
+		upgraded.Info.Description = fmt.Sprintf("Upgrade %q failed: %s", releaseName, err)
+		_ = storageBackend.Create(upgraded)
+		return release, err
+	}
+
+	if err := supersedeDeployed(storageBackend, releaseName); err != nil {
+		return release, err
+	}
+	upgraded.Info.Status = rpb.StatusDeployed
+	upgraded.Info.Description = "Upgrade complete"
+	return release, storageBackend.Create(upgraded)
+}
+
+// nextVersion returns the version of the next revision of the release, which
+// follows the last revision whatever its status.
+func nextVersion(storageBackend *storage.Storage, releaseName string) (int, error) {
+	last, err := storageBackend.Last(releaseName)
+	if err != nil {
+		if notFoundErr(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+	return last.Version + 1, nil
+}
+
+// supersedeDeployed marks the deployed revisions of the release as superseded,
+// so that the revision recorded next is the only deployed one.
+func supersedeDeployed(storageBackend *storage.Storage, releaseName string) error {
+	deployed, err := storageBackend.DeployedAll(releaseName)
+	if err != nil {
+		if notFoundErr(err) || noDeployedErr(err) {
+			return nil
+		}
+		return err
+	}
+	for _, rel := range deployed {
+		rel.Info.Status = rpb.StatusSuperseded
+		if err := storageBackend.Update(rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helmv3
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	rpb "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func TestSupersedeDeployed(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	storageBackend := storage.Init(driver.NewMemory())
+	version, err := nextVersion(storageBackend, "keystone")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(version).To(gomega.Equal(1))
+	g.Expect(supersedeDeployed(storageBackend, "keystone")).To(gomega.Succeed())
+
+	// A failed upgrade leaves the deployed revision in place
+	g.Expect(storageBackend.Create(newRelease(1, rpb.StatusDeployed))).To(gomega.Succeed())
+	g.Expect(storageBackend.Create(newRelease(2, rpb.StatusFailed))).To(gomega.Succeed())
+	deployed, err := storageBackend.Deployed("keystone")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(deployed.Version).To(gomega.Equal(1))
+
+	// The next revision follows the failed one and supersedes the deployed one
+	version, err = nextVersion(storageBackend, "keystone")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(version).To(gomega.Equal(3))
+	g.Expect(supersedeDeployed(storageBackend, "keystone")).To(gomega.Succeed())
+	g.Expect(storageBackend.Create(newRelease(version, rpb.StatusDeployed))).To(gomega.Succeed())
+
+	deployedAll, err := storageBackend.DeployedAll("keystone")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(deployedAll).To(gomega.HaveLen(1))
+	g.Expect(deployedAll[0].Version).To(gomega.Equal(3))
+}
@@ -0,0 +1,369 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package importer converts the documents of the Python implementation of
+// Armada (schema armada/Chart/v1, armada/ChartGroup/v1 and armada/Manifest/v1)
+// into ArmadaChart, ArmadaChartGroup and ArmadaManifest custom resources.
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// APIVersion is the apiVersion of the converted custom resources.
+const APIVersion = "armada.airshipit.org/v1alpha1"
+
+// fields lists the fields supported under a legacy field. A nil fields
+// means the value is copied as is, without further validation.
+type fields map[string]fields
+
+var (
+	sourceFields = fields{
+		"auth_method":  nil,
+		"location":     nil,
+		"proxy_server": nil,
+		"reference":    nil,
+		"subpath":      nil,
+		"type":         nil,
+	}
+
+	waitFields = fields{
+		"labels":  nil,
+		"native":  {"enabled": nil},
+		"timeout": nil,
+		"resources": {
+			"labels":    nil,
+			"min_ready": nil,
+			"type":      nil,
+		},
+	}
+
+	upgradeFields = fields{
+		"no_hooks": nil,
+		"options": {
+			"force":         nil,
+			"recreate_pods": nil,
+		},
+		"post": {"create": nil},
+		"pre": {
+			"create": nil,
+			"delete": nil,
+			"update": nil,
+		},
+	}
+
+	testFields = fields{
+		"enabled": nil,
+		"options": {"cleanup": nil},
+		"timeout": nil,
+	}
+
+	chartFields = fields{
+		"chart_name":   nil,
+		"delete":       {"timeout": nil},
+		"dependencies": nil,
+		"namespace":    nil,
+		"protected":    {"continue_processing": nil},
+		"release":      nil,
+		"source":       sourceFields,
+		"test":         testFields,
+		"timeout":      nil,
+		"upgrade":      upgradeFields,
+		"values":       nil,
+		"wait":         waitFields,
+	}
+
+	chartGroupFields = fields{
+		"chart_group": nil,
+		"description": nil,
+		"name":        nil,
+		"sequenced":   nil,
+		"test_charts": nil,
+	}
+
+	manifestFields = fields{
+		"chart_groups":   nil,
+		"release_prefix": nil,
+	}
+)
+
+// kind describes the conversion of a legacy schema.
+type kind struct {
+	kind        string
+	fields      fields
+	required    []string
+	references  []string
+	targetState string
+}
+
+// kinds are the supported legacy schemas, indexed by schema without version.
+var kinds = map[string]kind{
+	"armada/Chart": {
+		kind:        "ArmadaChart",
+		fields:      chartFields,
+		required:    []string{"chart_name", "release", "source"},
+		targetState: "uninitialized",
+	},
+	"armada/ChartGroup": {
+		kind:        "ArmadaChartGroup",
+		fields:      chartGroupFields,
+		required:    []string{"chart_group"},
+		references:  []string{"chart_group"},
+		targetState: "uninitialized",
+	},
+	"armada/Manifest": {
+		kind:        "ArmadaManifest",
+		fields:      manifestFields,
+		required:    []string{"release_prefix", "chart_groups"},
+		references:  []string{"chart_groups"},
+		targetState: "deployed",
+	},
+}
+
+// Convert reads the legacy documents of a multi-document YAML stream and
+// returns the corresponding custom resources, in document order. Documents
+// which are not Armada documents, such as the Deckhand ones, are skipped.
+// The resources are created in namespace when it is not empty. All the
+// invalid documents are reported, each error wrapping
+// InvalidArmadaObjectException.
+func Convert(r io.Reader, namespace string) ([]*unstructured.Unstructured, error) {
+	decoder := yaml.NewDecoder(r)
+	objs := make([]*unstructured.Unstructured, 0)
+	errs := make([]error, 0)
+	for index := 0; ; index++ {
+		var document interface{}
+		if err := decoder.Decode(&document); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%w: document %d: %s", armadaif.InvalidArmadaObjectException, index, err)
+		}
+		if document == nil {
+			continue
+		}
+		doc, ok := normalize(document).(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: document %d is not an object", armadaif.InvalidArmadaObjectException, index))
+			continue
+		}
+		obj, err := ConvertDocument(doc, namespace)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if obj != nil {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, errors.Join(errs...)
+}
+
+// ConvertDocument converts a legacy document into a custom resource. A nil
+// resource is returned for documents which are not Armada documents. The
+// ArmadaChart is created in the namespace of its release, which must match
+// namespace when it is not empty. The dependencies of a legacy chart are Helm
+// subcharts, such as helm-toolkit, and not charts to deploy first: they are
+// dropped.
+func ConvertDocument(doc map[string]interface{}, namespace string) (*unstructured.Unstructured, error) {
+	schema, _ := doc["schema"].(string)
+	if !strings.HasPrefix(schema, "armada/") {
+		return nil, nil
+	}
+
+	metadata, _ := doc["metadata"].(map[string]interface{})
+	legacyName, _ := metadata["name"].(string)
+	if legacyName == "" {
+		return nil, fmt.Errorf("%w: %s document without metadata.name", armadaif.InvalidArmadaObjectException, schema)
+	}
+
+	index := strings.LastIndex(schema, "/")
+	k, found := kinds[schema[:index]]
+	if !found || schema[index+1:] != "v1" {
+		return nil, fmt.Errorf("%w: %s: unsupported schema %s", armadaif.InvalidArmadaObjectException, legacyName, schema)
+	}
+
+	data, ok := doc["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: data must be an object", armadaif.InvalidArmadaObjectException, legacyName)
+	}
+
+	// Python Armada accepts a boolean to enable or disable the tests
+	if enabled, ok := data["test"].(bool); ok {
+		data["test"] = map[string]interface{}{"enabled": enabled}
+	}
+
+	errs := checkFields(legacyName, "data", data, k.fields)
+	if releaseNamespace, ok := data["namespace"].(string); ok && releaseNamespace != "" {
+		if namespace != "" && namespace != releaseNamespace {
+			errs = append(errs, fmt.Errorf("%w: %s: data.namespace %s conflicts with namespace %s",
+				armadaif.InvalidArmadaObjectException, legacyName, releaseNamespace, namespace))
+		}
+		namespace = releaseNamespace
+	}
+	delete(data, "dependencies")
+	for _, field := range k.required {
+		if _, found := data[field]; !found {
+			errs = append(errs, fmt.Errorf("%w: %s: missing field data.%s",
+				armadaif.InvalidArmadaObjectException, legacyName, field))
+		}
+	}
+
+	name, err := resourceName(legacyName)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, field := range k.references {
+		refs, err := references(legacyName, field, data[field])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		data[field] = refs
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if _, found := data["target_state"]; !found {
+		data["target_state"] = k.targetState
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": data}}
+	obj.SetAPIVersion(APIVersion)
+	obj.SetKind(k.kind)
+	obj.SetName(name)
+	if namespace != "" {
+		obj.SetNamespace(namespace)
+	}
+	if labels, ok := metadata["labels"].(map[string]interface{}); ok {
+		obj.Object["metadata"].(map[string]interface{})["labels"] = labels
+	}
+	return obj, nil
+}
+
+// Write writes the custom resources as a multi-document YAML stream.
+func Write(w io.Writer, objs []*unstructured.Unstructured) error {
+	for _, obj := range objs {
+		out, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFields reports the fields of value which are not part of supported.
+// The items of a list are checked one by one.
+func checkFields(name string, path string, value interface{}, supported fields) []error {
+	if supported == nil {
+		return nil
+	}
+
+	errs := make([]error, 0)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			children, found := supported[key]
+			if !found {
+				errs = append(errs, fmt.Errorf("%w: %s: unsupported field %s.%s",
+					armadaif.InvalidArmadaObjectException, name, path, key))
+				continue
+			}
+			errs = append(errs, checkFields(name, path+"."+key, v[key], children)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			errs = append(errs, checkFields(name, fmt.Sprintf("%s[%d]", path, i), item, supported)...)
+		}
+	case nil:
+	default:
+		errs = append(errs, fmt.Errorf("%w: %s: %s must be an object",
+			armadaif.InvalidArmadaObjectException, name, path))
+	}
+	return errs
+}
+
+// references converts a list of legacy document names into resource names.
+func references(name string, field string, value interface{}) ([]interface{}, error) {
+	if value == nil {
+		return []interface{}{}, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: data.%s must be a list", armadaif.InvalidArmadaObjectException, name, field)
+	}
+	refs := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		ref, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s: data.%s must only contain names", armadaif.InvalidArmadaObjectException, name, field)
+		}
+		converted, err := resourceName(ref)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, converted)
+	}
+	return refs, nil
+}
+
+// resourceName converts the name of a legacy document into the name of a
+// custom resource. Python Armada allows upper case letters and underscores.
+func resourceName(name string) (string, error) {
+	converted := strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	if msgs := validation.IsDNS1123Subdomain(converted); len(msgs) != 0 {
+		return "", fmt.Errorf("%w: invalid name %s: %s", armadaif.InvalidArmadaObjectException, name, strings.Join(msgs, ", "))
+	}
+	return converted, nil
+}
+
+// normalize converts the maps decoded by yaml into maps keyed by strings,
+// and the integers into int64, as expected by unstructured objects.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+		return v
+	case int:
+		return int64(v)
+	default:
+		return v
+	}
+}
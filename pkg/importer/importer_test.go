@@ -0,0 +1,151 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	armadaif "github.com/keleustes/armada-operator/pkg/services"
+
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const legacyDocuments = `
+schema: deckhand/LayeringPolicy/v1
+metadata:
+  name: layering-policy
+data:
+  layerOrder:
+    - global
+---
+schema: armada/Chart/v1
+metadata:
+  name: keystone
+  labels:
+    name: keystone-global
+data:
+  chart_name: keystone
+  release: keystone
+  namespace: openstack
+  wait:
+    timeout: 1800
+    resources:
+      - type: job
+  protected:
+    continue_processing: true
+  test: true
+  source:
+    type: local
+    location: /opt/armada/helm-charts/keystone
+  dependencies:
+    - helm_toolkit
+---
+schema: armada/ChartGroup/v1
+metadata:
+  name: openstack_keystone
+data:
+  sequenced: true
+  chart_group:
+    - keystone
+---
+schema: armada/Manifest/v1
+metadata:
+  name: armada-manifest
+data:
+  release_prefix: armada
+  chart_groups:
+    - openstack_keystone
+`
+
+func TestConvert(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	objs, err := Convert(strings.NewReader(legacyDocuments), "openstack")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs).To(gomega.HaveLen(3))
+
+	chart := objs[0]
+	g.Expect(chart.GetKind()).To(gomega.Equal("ArmadaChart"))
+	g.Expect(chart.GetNamespace()).To(gomega.Equal("openstack"))
+	g.Expect(chart.GetLabels()).To(gomega.HaveKeyWithValue("name", "keystone-global"))
+	enabled, _, _ := unstructured.NestedBool(chart.Object, "spec", "test", "enabled")
+	g.Expect(enabled).To(gomega.BeTrue())
+	timeout, _, _ := unstructured.NestedInt64(chart.Object, "spec", "wait", "timeout")
+	g.Expect(timeout).To(gomega.Equal(int64(1800)))
+	_, found, _ := unstructured.NestedFieldNoCopy(chart.Object, "spec", "dependencies")
+	g.Expect(found).To(gomega.BeFalse())
+	state, _, _ := unstructured.NestedString(chart.Object, "spec", "target_state")
+	g.Expect(state).To(gomega.Equal("uninitialized"))
+
+	g.Expect(objs[1].GetKind()).To(gomega.Equal("ArmadaChartGroup"))
+	g.Expect(objs[1].GetName()).To(gomega.Equal("openstack-keystone"))
+
+	manifest := objs[2]
+	g.Expect(manifest.GetKind()).To(gomega.Equal("ArmadaManifest"))
+	groups, _, _ := unstructured.NestedStringSlice(manifest.Object, "spec", "chart_groups")
+	g.Expect(groups).To(gomega.Equal([]string{"openstack-keystone"}))
+	state, _, _ = unstructured.NestedString(manifest.Object, "spec", "target_state")
+	g.Expect(state).To(gomega.Equal("deployed"))
+
+	var out strings.Builder
+	g.Expect(Write(&out, objs)).To(gomega.Succeed())
+	g.Expect(out.String()).To(gomega.ContainSubstring("apiVersion: armada.airshipit.org/v1alpha1\nkind: ArmadaManifest\n"))
+}
+
+func TestConvertNamespace(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	objs, err := Convert(strings.NewReader(legacyDocuments), "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(objs[0].GetNamespace()).To(gomega.Equal("openstack"))
+	g.Expect(objs[1].GetNamespace()).To(gomega.BeEmpty())
+
+	_, err = Convert(strings.NewReader(legacyDocuments), "ucp")
+	g.Expect(errors.Is(err, armadaif.InvalidArmadaObjectException)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("keystone: data.namespace openstack conflicts with namespace ucp"))
+}
+
+func TestConvertUnsupportedFields(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	_, err := Convert(strings.NewReader(`
+schema: armada/Chart/v1
+metadata:
+  name: keystone
+data:
+  chart_name: keystone
+  release: keystone
+  install:
+    no_hooks: false
+  wait:
+    resources:
+      - type: job
+        required: false
+  source:
+    type: local
+---
+schema: armada/Chart/v2
+metadata:
+  name: mariadb
+data: {}
+`), "")
+	g.Expect(errors.Is(err, armadaif.InvalidArmadaObjectException)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("unsupported field data.install"))
+	g.Expect(err.Error()).To(gomega.ContainSubstring("unsupported field data.wait.resources[0].required"))
+	g.Expect(err.Error()).To(gomega.ContainSubstring("unsupported schema armada/Chart/v2"))
+}
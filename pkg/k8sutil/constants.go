@@ -31,4 +31,10 @@ const (
 	// PodNameEnvVar is the constant for env variable POD_NAME
 	// which is the name of the current pod.
 	PodNameEnvVar = "POD_NAME"
+
+	// ReadinessRulesConfigMapEnvVar is the constant for env variable
+	// READINESS_RULES_CONFIGMAP which is the name of the ConfigMap, in the
+	// namespace of the operator, containing the readiness rules of the
+	// third-party custom resources.
+	ReadinessRulesConfigMapEnvVar = "READINESS_RULES_CONFIGMAP"
 )
@@ -0,0 +1,140 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// AnnotationDefaultMaxConcurrency is set by the ArmadaManifest on the
+	// ArmadaChartGroups it enables, out of its max_concurrency. It is
+	// overridden by the max_concurrency of the ArmadaChartGroup.
+	AnnotationDefaultMaxConcurrency = "armada.airshipit.org/default-max-concurrency"
+
+	// AnnotationUninstallStepTimeout is the time given to each child of a
+	// sequenced ArmadaChartGroup or ArmadaManifest to finish uninstalling.
+	AnnotationUninstallStepTimeout = "armada.airshipit.org/uninstall-step-timeout"
+
+	// AnnotationReleasePrefix is the release_prefix of the ArmadaManifest,
+	// propagated to its ArmadaChartGroups and to their ArmadaCharts.
+	AnnotationReleasePrefix = "armada.airshipit.org/release-prefix"
+
+	// AnnotationTestRequested is set by the ArmadaChartGroup on its ArmadaCharts
+	// to request a run of the Helm tests. The value identifies the test run.
+	AnnotationTestRequested = "armada.airshipit.org/test-requested"
+
+	// AnnotationTestStarted records the test run in progress on the ArmadaChart.
+	AnnotationTestStarted = "armada.airshipit.org/test-started"
+
+	// AnnotationTestCompleted records the last test run performed by the ArmadaChart.
+	AnnotationTestCompleted = "armada.airshipit.org/test-completed"
+
+	// AnnotationRollbackRequested is set by the ArmadaManifest on the ArmadaCharts
+	// of a failed ArmadaChartGroup, and on the group itself, to request the
+	// rollback of the releases. The value identifies the rollback.
+	AnnotationRollbackRequested = "armada.airshipit.org/rollback-requested"
+
+	// AnnotationRollbackCompleted records the last rollback performed by the ArmadaChart.
+	AnnotationRollbackCompleted = "armada.airshipit.org/rollback-completed"
+
+	// AnnotationRolledBackGeneration records the generation of the ArmadaChart
+	// when its release was rolled back. The release is not upgraded again until
+	// the ArmadaChart is updated.
+	AnnotationRolledBackGeneration = "armada.airshipit.org/rolled-back-generation"
+
+	// AnnotationDryRun turns an ArmadaManifest into a plan: the actions the
+	// operator would take are computed and recorded without being applied.
+	AnnotationDryRun = "armada.airshipit.org/dry-run"
+
+	// LabelChartOrder orders the ArmadaCharts selected by the chart_selector
+	// of an ArmadaChartGroup.
+	// Charts are sorted by increasing integer value, then by name. Charts without
+	// the label come last.
+	LabelChartOrder = "armada.airshipit.org/chart-order"
+
+	// AnnotationAbstract marks an ArmadaChart as an abstract parent document.
+	// Abstract ArmadaCharts are only layered into other ArmadaCharts and are
+	// never deployed.
+	AnnotationAbstract = "armada.airshipit.org/abstract"
+
+	// AnnotationLayeringParent is the name of the ArmadaChart of the same
+	// namespace the spec of the ArmadaChart is layered on top of.
+	AnnotationLayeringParent = "armada.airshipit.org/parent"
+
+	// AnnotationLayeringActions lists, in YAML or JSON, the merge, replace and
+	// delete actions applied to the spec of the parent.
+	AnnotationLayeringActions = "armada.airshipit.org/layering-actions"
+
+	// AnnotationSubstitutions lists, in YAML or JSON, the values copied from
+	// Secrets into the spec of the ArmadaChart.
+	AnnotationSubstitutions = "armada.airshipit.org/substitutions"
+)
+
+// DefaultUninstallStepTimeout is used when AnnotationUninstallStepTimeout is not set.
+const DefaultUninstallStepTimeout = 5 * time.Minute
+
+// IsDryRun checks if the annotations of an ArmadaManifest request a plan only.
+func IsDryRun(annotations map[string]string) bool {
+	dryRun, err := strconv.ParseBool(annotations[AnnotationDryRun])
+	return err == nil && dryRun
+}
+
+// IsAbstract checks if the annotations of an ArmadaChart mark it as abstract.
+func IsAbstract(annotations map[string]string) bool {
+	abstract, err := strconv.ParseBool(annotations[AnnotationAbstract])
+	return err == nil && abstract
+}
+
+// GetDefaultMaxConcurrency returns the maximum number of charts installing or
+// upgrading at once propagated by the ArmadaManifest to an ArmadaChartGroup.
+// 0 means unlimited. Invalid values are ignored.
+func GetDefaultMaxConcurrency(annotations map[string]string) int {
+	value, found := annotations[AnnotationDefaultMaxConcurrency]
+	if !found {
+		return 0
+	}
+	maxConcurrency, err := strconv.Atoi(value)
+	if err != nil || maxConcurrency < 0 {
+		log.Info("Ignoring invalid annotation", "annotation", AnnotationDefaultMaxConcurrency, "value", value)
+		return 0
+	}
+	return maxConcurrency
+}
+
+// GetUninstallStepTimeout returns the time given to each child to finish
+// uninstalling. Invalid values are ignored.
+func GetUninstallStepTimeout(annotations map[string]string) time.Duration {
+	value, found := annotations[AnnotationUninstallStepTimeout]
+	if !found {
+		return DefaultUninstallStepTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Info("Ignoring invalid annotation", "annotation", AnnotationUninstallStepTimeout, "value", value)
+		return DefaultUninstallStepTimeout
+	}
+	return timeout
+}
+
+// GetReleaseName returns the effective name of the Helm release of an
+// ArmadaChart, i.e. "<prefix>-<release>" when a release prefix is set.
+func GetReleaseName(release string, annotations map[string]string) string {
+	if prefix := annotations[AnnotationReleasePrefix]; prefix != "" {
+		return prefix + "-" + release
+	}
+	return release
+}
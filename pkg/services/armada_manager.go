@@ -30,6 +30,18 @@ type ArmadaChartGroupManager interface {
 	UpdateResource(context.Context) (*av1.ArmadaCharts, *av1.ArmadaCharts, error)
 	ReconcileResource(context.Context) (*av1.ArmadaCharts, error)
 	UninstallResource(context.Context) (*av1.ArmadaCharts, error)
+	HandleOrphans(context.Context) ([]string, error)
+	OrphanPolicy() OrphanPolicy
+	TestResource(context.Context) (*ChartTestResults, error)
+	Progress(context.Context) *Progress
+}
+
+// ChartTestResults sorts the ArmadaCharts of an ArmadaChartGroup by outcome
+// of their Helm tests.
+type ChartTestResults struct {
+	Passed  []string
+	Failed  []string
+	Pending []string
 }
 
 // ArmdaManifestManager manages a Armada Chart Group. It can install, update, reconcile,
@@ -43,4 +55,11 @@ type ArmadaManifestManager interface {
 	UpdateResource(context.Context) (*av1.ArmadaChartGroups, *av1.ArmadaChartGroups, error)
 	ReconcileResource(context.Context) (*av1.ArmadaChartGroups, error)
 	UninstallResource(context.Context) (*av1.ArmadaChartGroups, error)
+	HandleOrphans(context.Context) ([]string, error)
+	HandleFailures(context.Context, HelmManagerFactory) ([]string, error)
+	OrphanPolicy() OrphanPolicy
+	FailurePolicy() FailurePolicy
+	FailedTests() []string
+	Progress(context.Context) *Progress
+	PlanResource(context.Context, HelmManagerFactory) (*ManifestPlan, error)
 }
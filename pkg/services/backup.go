@@ -0,0 +1,235 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// BackupArchiveVersion identifies the layout of the archives written by the
+// ArmadaBackup controller. It is recorded in the index of each archive.
+const BackupArchiveVersion = "armada.airshipit.org/backup/v1"
+
+// DefaultBackupTimeout is used when backupPolicy.timeoutInSecond is not set.
+const DefaultBackupTimeout = 5 * time.Minute
+
+// BackupStorageType is the kind of storage receiving the backup archives.
+type BackupStorageType string
+
+const (
+	// BackupStorageTypeOffsite writes the archives to an S3 compatible object store.
+	BackupStorageTypeOffsite BackupStorageType = "offsite"
+
+	// BackupStorageTypeCeph writes the archives through the S3 API of the Ceph
+	// RADOS Gateway.
+	BackupStorageTypeCeph BackupStorageType = "ceph"
+)
+
+// BackupPolicy configures the backup process.
+type BackupPolicy struct {
+	TimeoutInSecond int64 `json:"timeoutInSecond,omitempty"`
+}
+
+// OffsiteBackupSource is the object store receiving the archives.
+type OffsiteBackupSource struct {
+	Endpoint       string `json:"endpoint,omitempty"`
+	ForcePathStyle bool   `json:"forcePathStyle"`
+	OffsiteSecret  string `json:"offsiteSecret"`
+	Path           string `json:"path"`
+}
+
+// CephBackupSource is the Ceph cluster receiving the archives.
+type CephBackupSource struct {
+	CephSecret string `json:"cephSecret,omitempty"`
+	Path       string `json:"path"`
+}
+
+// BackupSpec mirrors the spec of an ArmadaBackup.
+type BackupSpec struct {
+	StorageType     BackupStorageType    `json:"storageType"`
+	BackupPolicy    *BackupPolicy        `json:"backupPolicy,omitempty"`
+	Offsite         *OffsiteBackupSource `json:"offsite,omitempty"`
+	Ceph            *CephBackupSource    `json:"ceph,omitempty"`
+	Charts          []string             `json:"charts,omitempty"`
+	ClientTLSSecret string               `json:"clientTLSSecret,omitempty"`
+	ArmadaEndpoints []string             `json:"armadaEndpoints,omitempty"`
+	TargetState     string               `json:"targetState,omitempty"`
+}
+
+// GetBackupSpec returns the spec of the ArmadaBackup, checking that the storage
+// matching the storageType is configured.
+func GetBackupSpec(backup *av1.ArmadaBackup) (*BackupSpec, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&backup.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidArmadaObjectException, err)
+	}
+	spec := &BackupSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(data, spec); err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidArmadaObjectException, err)
+	}
+
+	switch spec.StorageType {
+	case BackupStorageTypeOffsite:
+		if spec.Offsite == nil || spec.Offsite.Path == "" {
+			return nil, fmt.Errorf("%w: offsite.path is required by storageType %s", InvalidArmadaObjectException, spec.StorageType)
+		}
+	case BackupStorageTypeCeph:
+		if spec.Ceph == nil || spec.Ceph.Path == "" {
+			return nil, fmt.Errorf("%w: ceph.path is required by storageType %s", InvalidArmadaObjectException, spec.StorageType)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported storageType %q", InvalidArmadaObjectException, spec.StorageType)
+	}
+	return spec, nil
+}
+
+// Timeout returns the time allowed for the entire backup process.
+func (s *BackupSpec) Timeout() time.Duration {
+	if s.BackupPolicy == nil || s.BackupPolicy.TimeoutInSecond <= 0 {
+		return DefaultBackupTimeout
+	}
+	return time.Duration(s.BackupPolicy.TimeoutInSecond) * time.Second
+}
+
+// ChartSnapshot is the state of an ArmadaChart saved in a backup archive.
+type ChartSnapshot struct {
+	// Name is the name of the ArmadaChart.
+	Name string
+
+	// Release is the name of the Helm release of the ArmadaChart.
+	Release string
+
+	// Resource is the ArmadaChart, without its status.
+	Resource map[string]interface{}
+
+	// Values are the values of the ArmadaChart, once layered. The values of
+	// the Secrets are not substituted, so that they are not saved in clear.
+	Values map[string]interface{}
+
+	// Substitutions are the substitutions of the ArmadaChart and of its
+	// parents, which restore the values of the Secrets.
+	Substitutions []Substitution
+
+	// Releases are the revisions of the Helm release, oldest first, as
+	// stored by Helm in the Secrets of the namespace.
+	Releases []*HelmRelease
+}
+
+// BackupChartIndex describes an ArmadaChart saved in a backup archive.
+type BackupChartIndex struct {
+	Name      string `json:"name" yaml:"name"`
+	Release   string `json:"release" yaml:"release"`
+	Revisions []int  `json:"revisions" yaml:"revisions"`
+}
+
+// BackupIndex describes the content of a backup archive. It is stored as
+// index.yaml at the root of the archive.
+type BackupIndex struct {
+	Version    string             `json:"version" yaml:"version"`
+	Backup     string             `json:"backup" yaml:"backup"`
+	Namespace  string             `json:"namespace" yaml:"namespace"`
+	Generation int64              `json:"generation" yaml:"generation"`
+	CreatedAt  string             `json:"createdAt" yaml:"createdAt"`
+	Charts     []BackupChartIndex `json:"charts" yaml:"charts"`
+}
+
+// NewBackupIndex returns the index of the archive of an ArmadaBackup.
+func NewBackupIndex(backup *av1.ArmadaBackup, snapshots []ChartSnapshot) *BackupIndex {
+	index := &BackupIndex{
+		Version:    BackupArchiveVersion,
+		Backup:     backup.GetName(),
+		Namespace:  backup.GetNamespace(),
+		Generation: backup.GetGeneration(),
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		Charts:     make([]BackupChartIndex, 0, len(snapshots)),
+	}
+	for _, snapshot := range snapshots {
+		chart := BackupChartIndex{Name: snapshot.Name, Release: snapshot.Release, Revisions: make([]int, 0)}
+		for _, rel := range snapshot.Releases {
+			chart.Revisions = append(chart.Revisions, rel.Version)
+		}
+		index.Charts = append(index.Charts, chart)
+	}
+	return index
+}
+
+// WriteBackupArchive writes the snapshots as a gzipped tar archive:
+//
+//	index.yaml
+//	charts/<chart>/armadachart.yaml
+//	charts/<chart>/values.yaml
+//	charts/<chart>/substitutions.yaml
+//	charts/<chart>/releases/<release>.v<revision>.json
+//
+// The Helm release records are JSON encoded, as in the Helm storage drivers.
+func WriteBackupArchive(w io.Writer, index *BackupIndex, snapshots []ChartSnapshot) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	modTime := time.Now()
+
+	if err := writeArchiveFile(tw, "index.yaml", modTime, yaml.Marshal, index); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		dir := path.Join("charts", snapshot.Name)
+		if err := writeArchiveFile(tw, path.Join(dir, "armadachart.yaml"), modTime, yaml.Marshal, snapshot.Resource); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, path.Join(dir, "values.yaml"), modTime, yaml.Marshal, snapshot.Values); err != nil {
+			return err
+		}
+		if len(snapshot.Substitutions) != 0 {
+			if err := writeArchiveFile(tw, path.Join(dir, "substitutions.yaml"), modTime, yaml.Marshal, snapshot.Substitutions); err != nil {
+				return err
+			}
+		}
+		for _, rel := range snapshot.Releases {
+			name := path.Join(dir, "releases", fmt.Sprintf("%s.v%d.json", rel.Name, rel.Version))
+			if err := writeArchiveFile(tw, name, modTime, json.Marshal, rel.Release); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeArchiveFile encodes the value and adds it to the archive.
+func writeArchiveFile(tw *tar.Writer, name string, modTime time.Time, encode func(interface{}) ([]byte, error), value interface{}) error {
+	data, err := encode(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", name, err)
+	}
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the Secrets holding the credentials of the backup storage. The
+// credentials and config files use the format of the AWS CLI, with the
+// "default" profile.
+const (
+	BackupSecretCredentials = "credentials"
+	BackupSecretConfig      = "config"
+
+	// BackupSecretEndpoint is the URL of the Ceph RADOS Gateway.
+	BackupSecretEndpoint = "endpoint"
+)
+
+// Keys of the Secret named by the clientTLSSecret of an ArmadaBackup. The client
+// certificate is presented to the storage, and the CA is trusted in addition to
+// the system ones.
+const (
+	BackupTLSClientCert = "armada-client.crt"
+	BackupTLSClientKey  = "armada-client.key"
+	BackupTLSClientCA   = "armada-client-ca.crt"
+)
+
+// defaultBackupRegion is used when the config file does not specify the region.
+const defaultBackupRegion = "us-east-1"
+
+// BackupStorage receives the backup archives.
+type BackupStorage interface {
+	// Put writes the archive of a version of the backup and returns its location.
+	Put(ctx context.Context, version string, data []byte) (string, error)
+}
+
+// NewBackupStorage returns the storage configured in the spec of an ArmadaBackup.
+// The credentials and the client TLS certificates are read from Secrets of the
+// namespace of the ArmadaBackup.
+func NewBackupStorage(ctx context.Context, reader client.Reader, namespace string, spec *BackupSpec) (BackupStorage, error) {
+	var secretName, endpoint, location string
+	forcePathStyle := true
+	switch spec.StorageType {
+	case BackupStorageTypeOffsite:
+		secretName, endpoint, location = spec.Offsite.OffsiteSecret, spec.Offsite.Endpoint, spec.Offsite.Path
+		forcePathStyle = spec.Offsite.ForcePathStyle
+	case BackupStorageTypeCeph:
+		secretName, location = spec.Ceph.CephSecret, spec.Ceph.Path
+	default:
+		return nil, fmt.Errorf("%w: unsupported storageType %q", InvalidArmadaObjectException, spec.StorageType)
+	}
+
+	bucket, key, found := strings.Cut(strings.Trim(location, "/"), "/")
+	if !found || bucket == "" || key == "" {
+		return nil, fmt.Errorf("%w: backup path %q is not <bucket>/<path-to-backup-file>", InvalidArmadaObjectException, location)
+	}
+	if secretName == "" {
+		return nil, fmt.Errorf("%w: the secret of storageType %s is required", InvalidArmadaObjectException, spec.StorageType)
+	}
+
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: secretName}, secret); err != nil {
+		return nil, fmt.Errorf("backup secret %s: %s", secretName, err)
+	}
+	credentials := parseProfile(secret.Data[BackupSecretCredentials], "default")
+	config := parseProfile(secret.Data[BackupSecretConfig], "default")
+	if spec.StorageType == BackupStorageTypeCeph {
+		endpoint = strings.TrimSpace(string(secret.Data[BackupSecretEndpoint]))
+		if endpoint == "" {
+			return nil, fmt.Errorf("%w: backup secret %s: %s is required by storageType %s",
+				InvalidArmadaObjectException, secretName, BackupSecretEndpoint, spec.StorageType)
+		}
+	}
+
+	httpClient, err := newBackupHTTPClient(ctx, reader, namespace, spec.ClientTLSSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &s3Storage{
+		bucket:         bucket,
+		key:            key,
+		accessKey:      credentials["aws_access_key_id"],
+		secretKey:      credentials["aws_secret_access_key"],
+		sessionToken:   credentials["aws_session_token"],
+		region:         config["region"],
+		forcePathStyle: forcePathStyle,
+		client:         httpClient,
+	}
+	if storage.accessKey == "" || storage.secretKey == "" {
+		return nil, fmt.Errorf("%w: backup secret %s: no access key in the default profile of %s",
+			InvalidArmadaObjectException, secretName, BackupSecretCredentials)
+	}
+	if storage.region == "" {
+		storage.region = defaultBackupRegion
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", storage.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: backup endpoint %q is not an http or https URL", InvalidArmadaObjectException, endpoint)
+	}
+	storage.endpoint = u
+	return storage, nil
+}
+
+// newBackupHTTPClient returns the HTTP client configured by the clientTLSSecret.
+// The default client is used when no secret is named.
+func newBackupHTTPClient(ctx context.Context, reader client.Reader, namespace string, secretName string) (*http.Client, error) {
+	if secretName == "" {
+		return http.DefaultClient, nil
+	}
+
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: secretName}, secret); err != nil {
+		return nil, fmt.Errorf("client TLS secret %s: %s", secretName, err)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	certPEM, keyPEM := secret.Data[BackupTLSClientCert], secret.Data[BackupTLSClientKey]
+	if len(certPEM) != 0 || len(keyPEM) != 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: client TLS secret %s: %s", InvalidArmadaObjectException, secretName, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caPEM, found := secret.Data[BackupTLSClientCA]; found {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%w: client TLS secret %s: no certificate found in %s",
+				InvalidArmadaObjectException, secretName, BackupTLSClientCA)
+		}
+		config.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseProfile returns the keys of a profile of an AWS CLI credentials or
+// config file. The config file prefixes the profiles with "profile ".
+func parseProfile(data []byte, profile string) map[string]string {
+	values := make(map[string]string)
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimPrefix(strings.TrimSpace(line[1:len(line)-1]), "profile ")
+		case current == profile:
+			if key, value, found := strings.Cut(line, "="); found {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return values
+}
+
+// s3Storage writes the archives to a bucket of an S3 compatible object store,
+// using requests signed with AWS Signature Version 4.
+type s3Storage struct {
+	endpoint       *url.URL
+	bucket         string
+	key            string
+	accessKey      string
+	secretKey      string
+	sessionToken   string
+	region         string
+	forcePathStyle bool
+	client         *http.Client
+}
+
+// Put uploads the archive as <path-to-backup-file>.<version>.tar.gz.
+func (s *s3Storage) Put(ctx context.Context, version string, data []byte) (string, error) {
+	key := fmt.Sprintf("%s.%s.tar.gz", s.key, version)
+
+	u := *s.endpoint
+	if s.forcePathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	s.sign(req, data, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("failed to upload s3://%s/%s: %s: %s", s.bucket, key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (s *s3Storage) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath encodes the path as S3 does: only the unreserved characters
+// and the slashes are kept.
+func s3EscapePath(path string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(path) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DriftMode describes the behavior of the reconciler when drift is detected.
+type DriftMode string
+
+const (
+	// DriftModeHeal recreates deleted objects and patches drifted fields.
+	DriftModeHeal DriftMode = "heal"
+
+	// DriftModeReportOnly only records the drifted objects in the status.
+	DriftModeReportOnly DriftMode = "report-only"
+)
+
+// ArmadaChartSpecExtensions holds the fields of the spec of an ArmadaChart
+// which are declared in the armadacharts CRD shipped with the operator but
+// are not part of the ArmadaChartSpec of armada-crd.
+type ArmadaChartSpecExtensions struct {
+	// DriftMode selects how the controller reacts when the live objects of
+	// the release no longer match the deployed manifest. Defaults to heal.
+	DriftMode DriftMode `json:"drift_mode,omitempty"`
+
+	// WaitFor lists the objects which must be ready before the release is
+	// installed or upgraded.
+	WaitFor []Prerequisite `json:"wait_for,omitempty"`
+
+	// RolloutDeadline is the time, in seconds, given to the statefulsets and
+	// the daemonsets of the release to complete their rollout before the
+	// release is reported as failed. Defaults to 600.
+	RolloutDeadline int64 `json:"rollout_deadline,omitempty"`
+
+	// Test holds the options of the Helm tests, which the ArmadaTest of
+	// armada-crd does not declare.
+	Test *ArmadaTestExtensions `json:"test,omitempty"`
+}
+
+// ArmadaTestExtensions holds the test options of an ArmadaChart.
+type ArmadaTestExtensions struct {
+	Options *ArmadaTestOptions `json:"options,omitempty"`
+}
+
+// ArmadaTestOptions tune the runs of the Helm tests of the release.
+type ArmadaTestOptions struct {
+	// Cleanup deletes the test pods once the tests completed.
+	Cleanup bool `json:"cleanup,omitempty"`
+}
+
+// GetTestCleanup checks if the test pods are deleted once the tests completed.
+func (ext *ArmadaChartSpecExtensions) GetTestCleanup() bool {
+	return ext.Test != nil && ext.Test.Options != nil && ext.Test.Options.Cleanup
+}
+
+// GetRolloutDeadline returns the rollout deadline as a duration. Zero selects
+// the default deadline.
+func (ext *ArmadaChartSpecExtensions) GetRolloutDeadline() time.Duration {
+	return time.Duration(ext.RolloutDeadline) * time.Second
+}
+
+// GetArmadaChartSpecExtensions reads the ArmadaChart, layered on top of its
+// parents, from the cluster and returns the extension fields of its spec.
+func GetArmadaChartSpecExtensions(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (*ArmadaChartSpecExtensions, error) {
+	data, err := resolveChartSpecData(ctx, reader, chart)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := &ArmadaChartSpecExtensions{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(data, ext); err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidArmadaObjectException, err)
+	}
+
+	switch ext.DriftMode {
+	case "":
+		ext.DriftMode = DriftModeHeal
+	case DriftModeHeal, DriftModeReportOnly:
+	default:
+		return nil, fmt.Errorf("%w: unknown drift_mode %q", InvalidArmadaObjectException, ext.DriftMode)
+	}
+
+	if ext.RolloutDeadline < 0 {
+		return nil, fmt.Errorf("%w: negative rollout_deadline %d", InvalidArmadaObjectException, ext.RolloutDeadline)
+	}
+
+	if err := defaultPrerequisites(ext.WaitFor, chart.GetNamespace()); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetArmadaChartSpecExtensions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	parent := newChartDocument("keystone-global", map[string]string{AnnotationAbstract: "true"},
+		map[string]interface{}{"release": "keystone", "drift_mode": "report-only"})
+	child := newChartDocument("keystone", map[string]string{AnnotationLayeringParent: "keystone-global"},
+		map[string]interface{}{"target_state": "deployed"})
+	plain := newChartDocument("glance", nil, map[string]interface{}{"release": "glance"})
+	invalid := newChartDocument("heat", nil, map[string]interface{}{"drift_mode": "ignore"})
+	slow := newChartDocument("ceph-osd", nil, map[string]interface{}{"rollout_deadline": int64(1800)})
+	tested := newChartDocument("cinder", nil, map[string]interface{}{
+		"test": map[string]interface{}{"enabled": true, "options": map[string]interface{}{"cleanup": true}}})
+	waiting := newChartDocument("nova", nil, map[string]interface{}{
+		"wait_for": []interface{}{
+			map[string]interface{}{"kind": "Service", "name": "mariadb"},
+			map[string]interface{}{"kind": "Pod", "labels": map[string]interface{}{"application": "memcached"}},
+		}})
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(parent, child, plain, invalid, waiting, slow, tested).Build()
+
+	chartOf := func(doc *metav1.ObjectMeta) *av1.ArmadaChart {
+		return &av1.ArmadaChart{ObjectMeta: *doc}
+	}
+
+	// The drift mode is inherited from the parent
+	ext, err := GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "keystone", Annotations: child.GetAnnotations()}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.DriftMode).To(gomega.Equal(DriftModeReportOnly))
+
+	ext, err = GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "glance"}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.DriftMode).To(gomega.Equal(DriftModeHeal))
+	g.Expect(ext.GetRolloutDeadline()).To(gomega.BeZero())
+	g.Expect(ext.GetTestCleanup()).To(gomega.BeFalse())
+
+	ext, err = GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "cinder"}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.GetTestCleanup()).To(gomega.BeTrue())
+
+	ext, err = GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "ceph-osd"}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.GetRolloutDeadline()).To(gomega.Equal(30 * time.Minute))
+
+	_, err = GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "heat"}))
+	g.Expect(errors.Is(err, InvalidArmadaObjectException)).To(gomega.BeTrue())
+
+	// The prerequisites default to the namespace of the chart
+	ext, err = GetArmadaChartSpecExtensions(context.TODO(), c,
+		chartOf(&metav1.ObjectMeta{Namespace: "openstack", Name: "nova"}))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.WaitFor).To(gomega.HaveLen(2))
+	g.Expect(ext.WaitFor[0].String()).To(gomega.Equal("Service/openstack/mariadb"))
+	g.Expect(ext.WaitFor[1].String()).To(gomega.Equal("Pod/openstack/{application=memcached}"))
+}
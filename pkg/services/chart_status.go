@@ -0,0 +1,101 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ArmadaChartStatusExtensions holds the fields of the status of an ArmadaChart
+// which are not part of the ArmadaChartStatus of the CRD library. They are
+// read and written along with the typed status through unstructured documents.
+type ArmadaChartStatusExtensions struct {
+	// Failures lists the concrete causes of the failure of the underlying
+	// resources of the release.
+	Failures []FailureDiagnostic `json:"failures,omitempty"`
+}
+
+// GetArmadaChartStatusExtensions reads the ArmadaChart from the cluster and
+// returns the extension fields of its status.
+func GetArmadaChartStatusExtensions(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (*ArmadaChartStatusExtensions, error) {
+	doc := av1.NewArmadaChartVersionKind(chart.GetNamespace(), chart.GetName())
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: chart.GetNamespace(), Name: chart.GetName()}, doc); err != nil {
+		return nil, err
+	}
+
+	ext := &ArmadaChartStatusExtensions{}
+	status, found := doc.Object["status"].(map[string]interface{})
+	if !found {
+		return ext, nil
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(status, ext); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// UpdateArmadaChartStatus writes the typed status of the ArmadaChart along
+// with the extension fields, which a typed status update would drop. The
+// resourceVersion of the ArmadaChart is updated accordingly.
+func UpdateArmadaChartStatus(ctx context.Context, c client.Client, chart *av1.ArmadaChart, ext *ArmadaChartStatusExtensions) error {
+	doc := av1.NewArmadaChartVersionKind(chart.GetNamespace(), chart.GetName())
+	if ext == nil {
+		return updateStatus(ctx, c, chart, doc, nil)
+	}
+	return updateStatus(ctx, c, chart, doc, ext)
+}
+
+// updateStatus writes the typed status of the custom resource, merged with
+// the extension fields, through the unstructured document doc.
+func updateStatus(ctx context.Context, c client.Client, obj client.Object, doc *unstructured.Unstructured, ext interface{}) error {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	for key, value := range data {
+		if key != "apiVersion" && key != "kind" {
+			doc.Object[key] = value
+		}
+	}
+
+	if ext != nil {
+		extData, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ext)
+		if err != nil {
+			return err
+		}
+		status, _ := doc.Object["status"].(map[string]interface{})
+		if status == nil {
+			status = make(map[string]interface{})
+		}
+		for key, value := range extData {
+			status[key] = value
+		}
+		doc.Object["status"] = status
+	}
+
+	if err := c.Status().Update(ctx, doc); err != nil {
+		return err
+	}
+	obj.SetResourceVersion(doc.GetResourceVersion())
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"testing"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"github.com/onsi/gomega"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUpdateArmadaChartStatus(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	doc := newChartDocument("keystone", nil, map[string]interface{}{"release": "keystone"})
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(doc).Build()
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(doc), doc)).To(gomega.Succeed())
+
+	chart := &av1.ArmadaChart{}
+	chart.SetNamespace(doc.GetNamespace())
+	chart.SetName(doc.GetName())
+	chart.SetResourceVersion(doc.GetResourceVersion())
+	chart.Status.ActualState = av1.StateFailed
+
+	// The failures are written along with the typed status
+	failures := []FailureDiagnostic{{Kind: "Pod", Name: "keystone-api", Reason: "CrashLoopBackOff",
+		Logs: []string{"connection refused"}}}
+	err := UpdateArmadaChartStatus(context.TODO(), c, chart, &ArmadaChartStatusExtensions{Failures: failures})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	ext, err := GetArmadaChartStatusExtensions(context.TODO(), c, chart)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.Failures).To(gomega.Equal(failures))
+
+	// and cleared by an update without extension
+	chart.Status.ActualState = av1.StateDeployed
+	g.Expect(UpdateArmadaChartStatus(context.TODO(), c, chart, nil)).To(gomega.Succeed())
+	ext, err = GetArmadaChartStatusExtensions(context.TODO(), c, chart)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.Failures).To(gomega.BeEmpty())
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(doc), doc)).To(gomega.Succeed())
+	g.Expect(doc.Object["status"]).To(gomega.HaveKeyWithValue("actual_state", string(av1.StateDeployed)))
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OrphanPolicy describes the handling of the children removed from the spec.
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyDelete deletes the children, hence uninstalls the releases.
+	OrphanPolicyDelete OrphanPolicy = "delete"
+
+	// OrphanPolicyOrphan drops the owner reference and keeps the children running.
+	OrphanPolicyOrphan OrphanPolicy = "orphan"
+
+	// OrphanPolicyRetainAndWarn keeps the children owned and reports them.
+	OrphanPolicyRetainAndWarn OrphanPolicy = "retain-and-warn"
+)
+
+// ArmadaChartGroupSpecExtensions holds the fields of the spec of an
+// ArmadaChartGroup which are declared in the armadachartgroups CRD shipped
+// with the operator but are not part of the ArmadaChartGroupSpec of armada-crd.
+type ArmadaChartGroupSpecExtensions struct {
+	// MaxConcurrency caps the number of charts of a non-sequenced group which
+	// are installing or upgrading at once. 0 defers to the ArmadaManifest,
+	// which defaults to unlimited.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// OrphanPolicy selects how the group handles the ArmadaCharts it still
+	// owns but which are no longer listed in its spec. Defaults to retain-and-warn.
+	OrphanPolicy OrphanPolicy `json:"orphan_policy,omitempty"`
+
+	// ChartSelector adds the matching ArmadaCharts of the namespace to the
+	// ones listed in chart_group.
+	ChartSelector *metav1.LabelSelector `json:"chart_selector,omitempty"`
+}
+
+// GetChartSelector returns the chart_selector of the group as a selector, or
+// nil when the group does not select charts by label.
+func (ext *ArmadaChartGroupSpecExtensions) GetChartSelector() (labels.Selector, error) {
+	if ext.ChartSelector == nil {
+		return nil, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ext.ChartSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid chart_selector: %s", InvalidArmadaObjectException, err)
+	}
+	return selector, nil
+}
+
+// GetArmadaChartGroupSpecExtensions reads the ArmadaChartGroup from the cluster
+// and returns the extension fields of its spec.
+func GetArmadaChartGroupSpecExtensions(ctx context.Context, reader client.Reader, group *av1.ArmadaChartGroup) (*ArmadaChartGroupSpecExtensions, error) {
+	doc := av1.NewArmadaChartGroupVersionKind(group.GetNamespace(), group.GetName())
+	ext := &ArmadaChartGroupSpecExtensions{}
+	if err := readSpecExtensions(ctx, reader, doc, ext); err != nil {
+		return nil, err
+	}
+
+	if ext.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("%w: negative max_concurrency %d", InvalidArmadaObjectException, ext.MaxConcurrency)
+	}
+	policy, err := defaultOrphanPolicy(ext.OrphanPolicy)
+	if err != nil {
+		return nil, err
+	}
+	ext.OrphanPolicy = policy
+	if _, err := ext.GetChartSelector(); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// defaultOrphanPolicy validates an orphan_policy and defaults it to
+// OrphanPolicyRetainAndWarn.
+func defaultOrphanPolicy(policy OrphanPolicy) (OrphanPolicy, error) {
+	switch policy {
+	case "":
+		return OrphanPolicyRetainAndWarn, nil
+	case OrphanPolicyDelete, OrphanPolicyOrphan, OrphanPolicyRetainAndWarn:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%w: unknown orphan_policy %q", InvalidArmadaObjectException, policy)
+	}
+}
+
+// readSpecExtensions reads the custom resource from the cluster, unstructured
+// so that the fields unknown to armada-crd are kept, and decodes its spec
+// into ext.
+func readSpecExtensions(ctx context.Context, reader client.Reader, doc *unstructured.Unstructured, ext interface{}) error {
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: doc.GetNamespace(), Name: doc.GetName()}, doc); err != nil {
+		return err
+	}
+	spec, _, err := unstructured.NestedMap(doc.Object, "spec")
+	if err != nil {
+		return fmt.Errorf("%w: %s", InvalidArmadaObjectException, err)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, ext); err != nil {
+		return fmt.Errorf("%w: %s", InvalidArmadaObjectException, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+)
+
+// Conditions and reasons reported by the armada-operator controllers
+// in addition to the ones defined along with the CRDs.
+const (
+	// ConditionDrifted indicates that some objects of the release differ
+	// from the deployed manifest.
+	ConditionDrifted av1.HelmResourceConditionType = "Drifted"
+
+	// ConditionFieldConflict indicates that some objects of the release
+	// could not be applied because another field manager owns some fields.
+	ConditionFieldConflict av1.HelmResourceConditionType = "FieldConflict"
+
+	// ConditionWaiting indicates that the resource is waiting for other
+	// resources before proceeding.
+	ConditionWaiting av1.HelmResourceConditionType = "Waiting"
+
+	// ConditionOrphaned indicates that the resource still owns children
+	// which are no longer listed in its spec.
+	ConditionOrphaned av1.HelmResourceConditionType = "Orphaned"
+
+	// ConditionTested reports the outcome of the Helm tests of the release,
+	// or of the ArmadaCharts of the group.
+	ConditionTested av1.HelmResourceConditionType = "Tested"
+
+	// ConditionChartGroupFailed reports the failed ArmadaChartGroups of an
+	// ArmadaManifest. The reason is the action taken by the failure policy.
+	ConditionChartGroupFailed av1.HelmResourceConditionType = "ChartGroupFailed"
+
+	// ConditionRolledBack reports the rollback of the release to its previous revision.
+	ConditionRolledBack av1.HelmResourceConditionType = "RolledBack"
+
+	// ConditionPlanned reports the plan computed for an ArmadaManifest in dry-run mode.
+	ConditionPlanned av1.HelmResourceConditionType = "Planned"
+
+	// ConditionBackedUp reports the archive written for the current generation
+	// of an ArmadaBackup.
+	ConditionBackedUp av1.HelmResourceConditionType = "BackedUp"
+
+	// ConditionRelease records in its ResourceName the name of the Helm release
+	// installed for an ArmadaChart.
+	ConditionRelease av1.HelmResourceConditionType = "Release"
+
+	// ConditionProgress reports in its message the number of deployed children
+	// of an ArmadaChartGroup or of an ArmadaManifest out of the total.
+	ConditionProgress av1.HelmResourceConditionType = "Progress"
+)
+
+const (
+	ReasonDriftDetected        av1.HelmResourceConditionReason = "DriftDetected"
+	ReasonDriftHealed          av1.HelmResourceConditionReason = "DriftHealed"
+	ReasonFieldConflict        av1.HelmResourceConditionReason = "FieldManagerConflict"
+	ReasonDependencyError      av1.HelmResourceConditionReason = "DependencyException"
+	ReasonDependenciesNotReady av1.HelmResourceConditionReason = "DependenciesNotReady"
+	ReasonResourcesNotFound    av1.HelmResourceConditionReason = "ResourcesNotFound"
+	ReasonOrphanDeleted        av1.HelmResourceConditionReason = "OrphanDeleted"
+	ReasonOrphanReleased       av1.HelmResourceConditionReason = "OrphanReleased"
+	ReasonOrphanRetained       av1.HelmResourceConditionReason = "OrphanRetained"
+	ReasonUninstallInProgress  av1.HelmResourceConditionReason = "UninstallInProgress"
+	ReasonReleaseRenamed       av1.HelmResourceConditionReason = "ReleaseRenamed"
+	ReasonReleaseInstalled     av1.HelmResourceConditionReason = "ReleaseInstalled"
+	ReasonTestSucceeded        av1.HelmResourceConditionReason = "TestSucceeded"
+	ReasonTestFailed           av1.HelmResourceConditionReason = "TestFailed"
+	ReasonTestPending          av1.HelmResourceConditionReason = "TestPending"
+	ReasonFailureHalted        av1.HelmResourceConditionReason = "Halted"
+	ReasonFailureContinued     av1.HelmResourceConditionReason = "Continued"
+	ReasonFailureRolledBack    av1.HelmResourceConditionReason = "RolledBack"
+	ReasonRollbackSuccessful   av1.HelmResourceConditionReason = "RollbackSuccessful"
+	ReasonRollbackError        av1.HelmResourceConditionReason = "RollbackError"
+	ReasonPlanReady            av1.HelmResourceConditionReason = "PlanReady"
+	ReasonPlanError            av1.HelmResourceConditionReason = "PlanError"
+	ReasonLayeringError        av1.HelmResourceConditionReason = "LayeringError"
+	ReasonBackupInProgress     av1.HelmResourceConditionReason = "BackupInProgress"
+	ReasonBackupSuccessful     av1.HelmResourceConditionReason = "BackupSuccessful"
+	ReasonBackupError          av1.HelmResourceConditionReason = "BackupError"
+	ReasonBackupTimeout        av1.HelmResourceConditionReason = "BackupTimeout"
+	ReasonChildrenDeployed     av1.HelmResourceConditionReason = "ChildrenDeployed"
+	ReasonChildrenPending      av1.HelmResourceConditionReason = "ChildrenPending"
+)
+
+// GetCondition returns the condition of the given type, or nil if the status
+// does not contain it.
+func GetCondition(status *av1.HelmResourceStatus, conditionType av1.HelmResourceConditionType) *av1.HelmResourceCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
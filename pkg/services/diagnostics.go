@@ -0,0 +1,279 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// maxFailureDiagnostics bounds the number of causes reported for a release
+	maxFailureDiagnostics = 10
+
+	// failedPodLogLines is the number of log lines collected from a failed job pod
+	failedPodLogLines = 10
+)
+
+// waitingFailureReasons are the reasons of a waiting container which
+// will not recover without intervention
+var waitingFailureReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// FailureDiagnostic is a concrete cause of the failure of a release
+type FailureDiagnostic struct {
+	Kind      string   `json:"kind"`
+	Namespace string   `json:"namespace,omitempty"`
+	Name      string   `json:"name"`
+	Container string   `json:"container,omitempty"`
+	Reason    string   `json:"reason"`
+	Message   string   `json:"message,omitempty"`
+	Logs      []string `json:"logs,omitempty"`
+}
+
+// String returns a one line summary of the diagnostic
+func (d FailureDiagnostic) String() string {
+	res := fmt.Sprintf("%s/%s", d.Kind, d.Name)
+	if d.Container != "" {
+		res = fmt.Sprintf("%s[%s]", res, d.Container)
+	}
+	res = fmt.Sprintf("%s: %s", res, d.Reason)
+	if d.Message != "" {
+		res = fmt.Sprintf("%s: %s", res, d.Message)
+	}
+	return res
+}
+
+// SummarizeFailureDiagnostics builds the message of a condition out of the
+// diagnostics. Only the failed objects and the reasons are reported, the
+// messages and the logs are recorded in the failures of the status.
+func SummarizeFailureDiagnostics(diags []FailureDiagnostic) string {
+	lines := make([]string, 0, len(diags))
+	for _, diag := range diags {
+		summary := FailureDiagnostic{Kind: diag.Kind, Name: diag.Name, Container: diag.Container, Reason: diag.Reason}
+		lines = append(lines, summary.String())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// PodLogGetter retrieves the last lines of the logs of a container
+type PodLogGetter interface {
+	GetPodLogs(ctx context.Context, namespace string, pod string, container string, tailLines int64) ([]string, error)
+}
+
+type clientsetPodLogGetter struct {
+	clientset kubernetes.Interface
+}
+
+// NewPodLogGetter returns a PodLogGetter using the logs subresource of the pods
+func NewPodLogGetter(clientset kubernetes.Interface) PodLogGetter {
+	return &clientsetPodLogGetter{clientset: clientset}
+}
+
+// GetPodLogs returns the last tailLines lines of the logs of the container
+func (g *clientsetPodLogGetter) GetPodLogs(ctx context.Context, namespace string, pod string, container string, tailLines int64) ([]string, error) {
+	opts := &corev1.PodLogOptions{Container: container, TailLines: &tailLines}
+	data, err := g.clientset.CoreV1().Pods(namespace).GetLogs(pod, opts).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// CollectFailureDiagnostics looks for the concrete causes of the failure of the
+// release in its pods and in the pods of its workloads and jobs. The logs of the
+// failed job pods are collected if logs is not nil.
+func (release *HelmRelease) CollectFailureDiagnostics(ctx context.Context, logs PodLogGetter) []FailureDiagnostic {
+	collector := &diagnosticsCollector{reader: release.reader, logs: logs}
+
+	items := release.GetDependentResources()
+	for i := range items {
+		collector.collect(ctx, &items[i])
+		if collector.full() {
+			break
+		}
+	}
+	return collector.diags
+}
+
+type diagnosticsCollector struct {
+	reader client.Reader
+	logs   PodLogGetter
+	diags  []FailureDiagnostic
+}
+
+func (c *diagnosticsCollector) full() bool {
+	return len(c.diags) >= maxFailureDiagnostics
+}
+
+func (c *diagnosticsCollector) add(diag FailureDiagnostic) {
+	if !c.full() {
+		c.diags = append(c.diags, diag)
+	}
+}
+
+// collect dispatches the object according to its kind
+func (c *diagnosticsCollector) collect(ctx context.Context, u *unstructured.Unstructured) {
+	switch u.GetKind() {
+	case "Pod":
+		pod := corev1.Pod{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pod); err != nil {
+			return
+		}
+		c.collectPod(ctx, &pod, false)
+	case "Job":
+		job := batchv1.Job{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &job); err != nil {
+			return
+		}
+		c.collectJob(ctx, &job)
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet":
+		selector := metav1.LabelSelector{}
+		if err := extractSelector(u, &selector); err != nil {
+			return
+		}
+		for _, pod := range c.listPods(ctx, u.GetNamespace(), &selector) {
+			c.collectPod(ctx, &pod, false)
+		}
+	}
+}
+
+// collectJob reports the failed pods of a failed job along with their logs
+func (c *diagnosticsCollector) collectJob(ctx context.Context, job *batchv1.Job) {
+	var failed *batchv1.JobCondition
+	for i := range job.Status.Conditions {
+		cond := &job.Status.Conditions[i]
+		if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+			failed = cond
+		}
+	}
+
+	before := len(c.diags)
+	if job.Spec.Selector != nil {
+		for _, pod := range c.listPods(ctx, job.Namespace, job.Spec.Selector) {
+			c.collectPod(ctx, &pod, failed != nil)
+		}
+	}
+
+	if failed != nil && len(c.diags) == before {
+		c.add(FailureDiagnostic{Kind: "Job", Namespace: job.Namespace, Name: job.Name,
+			Reason: failed.Reason, Message: failed.Message})
+	}
+}
+
+// collectPod reports the scheduling and container failures of a pod. The
+// logs of the failed containers are collected when withLogs is set.
+func (c *diagnosticsCollector) collectPod(ctx context.Context, pod *corev1.Pod, withLogs bool) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse &&
+			cond.Reason == corev1.PodReasonUnschedulable {
+			c.add(FailureDiagnostic{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name,
+				Reason: cond.Reason, Message: cond.Message})
+		}
+	}
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...),
+		pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		diag := FailureDiagnostic{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, Container: status.Name}
+
+		switch {
+		case status.State.Waiting != nil && waitingFailureReasons[status.State.Waiting.Reason]:
+			diag.Reason = status.State.Waiting.Reason
+			diag.Message = status.State.Waiting.Message
+			if terminated := status.LastTerminationState.Terminated; terminated != nil && terminated.Reason == "OOMKilled" {
+				diag.Message = fmt.Sprintf("last terminated with OOMKilled, exit code %d", terminated.ExitCode)
+			}
+		case status.State.Terminated != nil && status.State.Terminated.Reason == "OOMKilled":
+			diag.Reason = status.State.Terminated.Reason
+			diag.Message = fmt.Sprintf("exit code %d", status.State.Terminated.ExitCode)
+		case withLogs && pod.Status.Phase == corev1.PodFailed &&
+			status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+			diag.Reason = status.State.Terminated.Reason
+			if diag.Reason == "" {
+				diag.Reason = "Error"
+			}
+			diag.Message = fmt.Sprintf("exit code %d", status.State.Terminated.ExitCode)
+		default:
+			continue
+		}
+
+		if withLogs && c.logs != nil {
+			lines, err := c.logs.GetPodLogs(ctx, pod.Namespace, pod.Name, status.Name, failedPodLogLines)
+			if err != nil {
+				log.Info("Failed to get pod logs", "namespace", pod.Namespace, "pod", pod.Name,
+					"container", status.Name, "error", err.Error())
+			}
+			diag.Logs = lines
+		}
+		c.add(diag)
+	}
+}
+
+// listPods returns the pods matching the selector
+func (c *diagnosticsCollector) listPods(ctx context.Context, namespace string, selector *metav1.LabelSelector) []corev1.Pod {
+	if c.reader == nil {
+		return nil
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil || labelSelector.Empty() {
+		return nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := c.reader.List(ctx, pods, client.InNamespace(namespace),
+		client.MatchingLabelsSelector{Selector: labelSelector}); err != nil {
+		log.Info("Failed to list pods", "namespace", namespace, "selector", labelSelector.String(), "error", err.Error())
+		return nil
+	}
+	return pods.Items
+}
+
+// extractSelector reads the spec.selector of a workload
+func extractSelector(u *unstructured.Unstructured, selector *metav1.LabelSelector) error {
+	content, found, err := unstructured.NestedMap(u.Object, "spec", "selector")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrFieldNotFound
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(content, selector)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakePodLogGetter struct{}
+
+func (f fakePodLogGetter) GetPodLogs(ctx context.Context, namespace string, pod string, container string, tailLines int64) ([]string, error) {
+	return []string{"connection refused"}, nil
+}
+
+func toUnstructured(t *testing.T, obj runtime.Object) unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unstructured.Unstructured{Object: content}
+}
+
+func TestCollectFailureDiagnostics(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	crashing := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api"},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionTrue}},
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "api",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason: "CrashLoopBackOff", Message: "back-off restarting failed container"}},
+				LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+					Reason: "OOMKilled", ExitCode: 137}},
+			}},
+		},
+	}
+	pending := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse,
+				Reason: corev1.PodReasonUnschedulable, Message: "0/3 nodes are available"}},
+		},
+	}
+	job := &batchv1.Job{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-init"},
+		Spec: batchv1.JobSpec{Selector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"job-name": "db-init"}}},
+		Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+			Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}}},
+	}
+	jobPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-init-x2x8z",
+			Labels: map[string]string{"job-name": "db-init"}},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "init",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: 1}},
+			}},
+		},
+	}
+
+	release := &HelmRelease{}
+	release.SetReader(fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(jobPod).Build())
+	release.AddToCache(toUnstructured(t, crashing))
+	release.AddToCache(toUnstructured(t, pending))
+	release.AddToCache(toUnstructured(t, job))
+
+	diags := release.CollectFailureDiagnostics(context.TODO(), fakePodLogGetter{})
+	g.Expect(diags).To(gomega.HaveLen(3))
+	g.Expect(diags[0].Reason).To(gomega.Equal("CrashLoopBackOff"))
+	g.Expect(diags[0].Message).To(gomega.ContainSubstring("OOMKilled"))
+	g.Expect(diags[1].Reason).To(gomega.Equal(corev1.PodReasonUnschedulable))
+	g.Expect(diags[2].Name).To(gomega.Equal("db-init-x2x8z"))
+	g.Expect(diags[2].Reason).To(gomega.Equal("Error"))
+	g.Expect(diags[2].Logs).To(gomega.Equal([]string{"connection refused"}))
+
+	g.Expect(SummarizeFailureDiagnostics(diags)).To(gomega.ContainSubstring("Pod/api[api]: CrashLoopBackOff"))
+	g.Expect(SummarizeFailureDiagnostics(diags)).NotTo(gomega.ContainSubstring("connection refused"))
+}
@@ -16,6 +16,8 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 )
 
 var (
@@ -239,4 +241,45 @@ var (
 
 	// Exception that occurs when an Armada object is not declared.
 	InvalidArmadaObjectException = errors.New("An Armada object failed internal validation")
+
+	// ErrLayeringFailed indicates the parents or the substitutions of an ArmadaChart could not be resolved.
+	ErrLayeringFailed = errors.New("failed to resolve the layering of the ArmadaChart")
+
+	// ErrFieldNotFound indicates the field extracted from an object does not exist.
+	ErrFieldNotFound = errors.New("field not found")
+
+	// ErrInvalidFieldPath indicates the path of a field is not a valid JSONPath.
+	ErrInvalidFieldPath = errors.New("invalid field path")
+
+	// ErrAmbiguousField indicates the path of a field matches more than one value.
+	ErrAmbiguousField = errors.New("field path matches multiple values")
+
+	// ErrOwnershipConflict indicates the resource is already controlled by another owner.
+	ErrOwnershipConflict = errors.New("resource is already controlled by another owner")
+
+	// ErrUninstallInProgress indicates the children are being uninstalled one at a time.
+	ErrUninstallInProgress = errors.New("uninstall in progress")
+
+	// ErrUninstallTimeout indicates a child did not finish uninstalling in time.
+	ErrUninstallTimeout = errors.New("uninstall timed out")
+
+	// ErrReleaseRenamed indicates the release name of a chart differs from the deployed release.
+	ErrReleaseRenamed = errors.New("release renamed")
+
+	// ErrTestFailed indicates that the Helm tests of a release or of a chart group failed.
+	ErrTestFailed = errors.New("helm tests failed")
+
+	// ErrTestInProgress indicates that the Helm tests of a release are still running.
+	ErrTestInProgress = errors.New("helm tests in progress")
 )
+
+// MissingResourcesError indicates that some resources referenced by name
+// in the spec of an Armada resource do not exist yet.
+type MissingResourcesError struct {
+	Kind  string
+	Names []string
+}
+
+func (e *MissingResourcesError) Error() string {
+	return fmt.Sprintf("%s not found: %s", e.Kind, strings.Join(e.Names, ", "))
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// FieldError is returned when a field can not be extracted from an object.
+// Err is one of ErrFieldNotFound, ErrInvalidFieldPath or ErrAmbiguousField.
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Path)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// normalizePath accepts the "status.phase", ".status.phase" and
+// "{.status.phase}" notations
+func normalizePath(path string) string {
+	if strings.HasPrefix(path, "{") {
+		return path
+	}
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "[") {
+		path = "." + path
+	}
+	return "{" + path + "}"
+}
+
+// ExtractField returns the value found at a JSONPath in an Unstructured object.
+// Array indices, filters and non-string leaves are supported. Leaves which are
+// not strings are formatted, maps and arrays being rendered as JSON.
+func ExtractField(path string, u *unstructured.Unstructured) (string, error) {
+	if u == nil {
+		return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+	}
+
+	parser := jsonpath.New(path)
+	if err := parser.Parse(normalizePath(path)); err != nil {
+		return "", &FieldError{Path: path, Err: ErrInvalidFieldPath}
+	}
+
+	results, err := parser.FindResults(u.UnstructuredContent())
+	if err != nil {
+		return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+	}
+
+	values := make([]reflect.Value, 0)
+	for _, result := range results {
+		values = append(values, result...)
+	}
+	switch {
+	case len(values) == 0:
+		return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+	case len(values) > 1:
+		return "", &FieldError{Path: path, Err: ErrAmbiguousField}
+	}
+
+	return formatFieldValue(path, values[0])
+}
+
+// formatFieldValue converts the leaf found by ExtractField into a string
+func formatFieldValue(path string, value reflect.Value) (string, error) {
+	if !value.IsValid() {
+		return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+	}
+	if value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Map, reflect.Slice:
+		if value.IsNil() {
+			return "", &FieldError{Path: path, Err: ErrFieldNotFound}
+		}
+		data, err := json.Marshal(value.Interface())
+		if err != nil {
+			return "", &FieldError{Path: path, Err: err}
+		}
+		return string(data), nil
+	default:
+		return fmt.Sprint(value.Interface()), nil
+	}
+}
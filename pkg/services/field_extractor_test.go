@@ -0,0 +1,73 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestExtractField(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	workflow := newUnstructured("Workflow", map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"status": map[string]interface{}{
+			"phase":    "Running",
+			"progress": int64(3),
+			"finished": false,
+			"nodes": []interface{}{
+				map[string]interface{}{"name": "a", "phase": "Succeeded"},
+				map[string]interface{}{"name": "b", "phase": "Failed"},
+			},
+		},
+	})
+
+	tcs := []struct {
+		path     string
+		expected string
+		err      error
+	}{
+		{path: "status.phase", expected: "Running"},
+		{path: ".status.progress", expected: "3"},
+		{path: "{.status.finished}", expected: "false"},
+		{path: "status.nodes[1].phase", expected: "Failed"},
+		{path: `status.nodes[?(@.name=="a")].phase`, expected: "Succeeded"},
+		{path: "status.nodes[*].phase", err: ErrAmbiguousField},
+		{path: "status.missing", err: ErrFieldNotFound},
+		{path: "status.phase.nested", err: ErrFieldNotFound},
+		{path: "status.nodes[", err: ErrInvalidFieldPath},
+	}
+
+	for _, tc := range tcs {
+		value, err := ExtractField(tc.path, workflow)
+		if tc.err != nil {
+			g.Expect(errors.Is(err, tc.err)).To(gomega.BeTrue(), tc.path)
+			continue
+		}
+		g.Expect(err).NotTo(gomega.HaveOccurred(), tc.path)
+		g.Expect(value).To(gomega.Equal(tc.expected), tc.path)
+	}
+
+	nostatus := newUnstructured("Workflow", map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"status":     nil,
+	})
+	dep := &KubernetesDependency{}
+	g.Expect(dep.IsUnstructuredReady(nostatus)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredFailedOrError(nostatus)).To(gomega.BeFalse())
+}
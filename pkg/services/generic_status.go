@@ -0,0 +1,155 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// GenericStatus is the summarized state of an arbitrary resource, computed
+// from the conventions used by most of the custom resources.
+type GenericStatus string
+
+// Summarized states of an arbitrary resource
+const (
+	GenericStatusInProgress GenericStatus = "InProgress"
+	GenericStatusCurrent    GenericStatus = "Current"
+	GenericStatusFailed     GenericStatus = "Failed"
+)
+
+// Well known condition types
+const (
+	genericConditionReady       = "Ready"
+	genericConditionAvailable   = "Available"
+	genericConditionStalled     = "Stalled"
+	genericConditionReconciling = "Reconciling"
+)
+
+// genericCondition is the subset of the standard condition used by
+// the generic evaluator.
+type genericCondition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+}
+
+// ComputeGenericStatus summarizes the state of an arbitrary resource using
+// the status.observedGeneration and the standard status.conditions.
+// A resource without status is considered Current.
+func ComputeGenericStatus(u *unstructured.Unstructured) (GenericStatus, string) {
+	if u == nil {
+		return GenericStatusInProgress, "resource not found"
+	}
+
+	conditions := getGenericConditions(u)
+
+	// A stalled resource will not make any progress without intervention.
+	if cond, found := conditions[genericConditionStalled]; found && cond.Status == "True" {
+		return GenericStatusFailed, cond.describe()
+	}
+
+	observedGeneration, found, err := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+	if err == nil && found && observedGeneration < u.GetGeneration() {
+		return GenericStatusInProgress, fmt.Sprintf("observedGeneration %d lags generation %d",
+			observedGeneration, u.GetGeneration())
+	}
+
+	if cond, found := conditions[genericConditionReconciling]; found && cond.Status == "True" {
+		return GenericStatusInProgress, cond.describe()
+	}
+
+	// Ready takes precedence over Available when both are present.
+	for _, condType := range []string{genericConditionReady, genericConditionAvailable} {
+		if cond, found := conditions[condType]; found {
+			if cond.Status == "True" {
+				return GenericStatusCurrent, ""
+			}
+			return GenericStatusInProgress, cond.describe()
+		}
+	}
+
+	return GenericStatusCurrent, ""
+}
+
+// getGenericConditions extracts the status.conditions indexed by type.
+// Malformed entries are ignored.
+func getGenericConditions(u *unstructured.Unstructured) map[string]genericCondition {
+	res := make(map[string]genericCondition)
+
+	items, found, err := unstructured.NestedSlice(u.Object, "status", "conditions")
+	if err != nil || !found {
+		return res
+	}
+
+	for _, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		cond := genericCondition{}
+		cond.Type, _ = fields["type"].(string)
+		cond.Status, _ = fields["status"].(string)
+		cond.Reason, _ = fields["reason"].(string)
+		cond.Message, _ = fields["message"].(string)
+		if cond.Type != "" {
+			res[cond.Type] = cond
+		}
+	}
+	return res
+}
+
+// describe builds a human readable description of the condition
+func (c genericCondition) describe() string {
+	parts := []string{c.Type + "=" + c.Status}
+	if c.Reason != "" {
+		parts = append(parts, c.Reason)
+	}
+	if c.Message != "" {
+		parts = append(parts, c.Message)
+	}
+	return strings.Join(parts, ": ")
+}
+
+// Check the generic status of an arbitrary resource
+func (obj *KubernetesDependency) IsGenericReady(u *unstructured.Unstructured) bool {
+	status, _ := ComputeGenericStatus(u)
+	return status == GenericStatusCurrent
+}
+
+// Check if the arbitrary resource is stalled
+func (obj *KubernetesDependency) IsGenericFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+	status, _ := ComputeGenericStatus(u)
+	return status == GenericStatusFailed
+}
+
+// Did the generic status of the arbitrary resource changed
+func (obj *KubernetesDependency) GenericStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	statusu, messageu := ComputeGenericStatus(u)
+	statusv, messagev := ComputeGenericStatus(v)
+	oldv := fmt.Sprintf("%s|%s", statusu, messageu)
+	newv := fmt.Sprintf("%s|%s", statusv, messagev)
+	return oldv != newv, oldv, newv
+}
@@ -27,6 +27,19 @@ type HelmManager interface {
 	Sync(context.Context) error
 	InstallRelease(context.Context) (*HelmRelease, error)
 	UpdateRelease(context.Context) (*HelmRelease, *HelmRelease, error)
-	ReconcileRelease(context.Context) (*HelmRelease, error)
+	ReconcileRelease(context.Context, DriftMode) (*HelmRelease, error)
 	UninstallRelease(context.Context) (*HelmRelease, error)
+	TestRelease(context.Context, TestOptions) (*HelmRelease, error)
+	RollbackRelease(context.Context) (*HelmRelease, error)
+	DiffRelease(context.Context) (string, error)
+	ReleaseHistory(context.Context) ([]*HelmRelease, error)
+}
+
+// TestOptions tune a run of the Helm tests of a release.
+type TestOptions struct {
+	// Restart discards the outcome of the previous run and starts over.
+	Restart bool
+
+	// Cleanup deletes the test objects once the run completed.
+	Cleanup bool
 }
@@ -18,17 +18,25 @@ import (
 	"bytes"
 	"io"
 	"reflect"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	yaml "gopkg.in/yaml.v2"
 	rpb "helm.sh/helm/v3/pkg/release"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type HelmRelease struct {
 	*rpb.Release
-	cached []unstructured.Unstructured
+	cached    []unstructured.Unstructured
+	drifted   []string
+	conflicts []string
+	reader    client.Reader
+
+	rolloutDeadline time.Duration
 }
 
 func (r *HelmRelease) GetNotes() string {
@@ -36,11 +44,53 @@ func (r *HelmRelease) GetNotes() string {
 	return ""
 }
 
+// SetReader provides the client used to lookup the objects which are
+// not part of the release but drive its readiness.
+func (r *HelmRelease) SetReader(reader client.Reader) {
+	r.reader = reader
+}
+
+// SetRolloutDeadline sets the time given to the statefulsets and the
+// daemonsets of the release to complete their rollout.
+func (r *HelmRelease) SetRolloutDeadline(deadline time.Duration) {
+	r.rolloutDeadline = deadline
+}
+
+// newKubernetesDependency returns the KubernetesDependency checking the
+// objects of the release.
+func (release *HelmRelease) newKubernetesDependency() *KubernetesDependency {
+	dep := NewKubernetesDependency(release.reader)
+	dep.rolloutDeadline = release.rolloutDeadline
+	return dep
+}
+
 // Let's cache the actual objects
 func (r *HelmRelease) AddToCache(u unstructured.Unstructured) {
 	r.cached = append(r.cached, u)
 }
 
+// Let's keep track of the objects which drifted from the manifest
+func (r *HelmRelease) AddToDrifted(id string) {
+	r.drifted = append(r.drifted, id)
+}
+
+// GetDriftedResources returns the objects which did not match
+// the deployed manifest during the last reconciliation.
+func (r *HelmRelease) GetDriftedResources() []string {
+	return r.drifted
+}
+
+// Let's keep track of the field ownership conflicts
+func (r *HelmRelease) AddToConflicts(conflict string) {
+	r.conflicts = append(r.conflicts, conflict)
+}
+
+// GetFieldConflicts returns the objects which could not be applied
+// because some of their fields are owned by another field manager.
+func (r *HelmRelease) GetFieldConflicts() []string {
+	return r.conflicts
+}
+
 // GetDependentResource extracts the list of dependent resources
 // from the Helm Manifest in order to add Watch on those components.
 func (release *HelmRelease) GetDependentResources() []unstructured.Unstructured {
@@ -82,7 +132,7 @@ func (release *HelmRelease) CheckOwnerReference(refs []metav1.OwnerReference) bo
 // Check the state of a service
 func (release *HelmRelease) IsReady() bool {
 
-	dep := &KubernetesDependency{}
+	dep := release.newKubernetesDependency()
 
 	// Check that each sub resource is owned by the phase
 	items := release.GetDependentResources()
@@ -97,7 +147,7 @@ func (release *HelmRelease) IsReady() bool {
 
 func (release *HelmRelease) IsFailedOrError() bool {
 
-	dep := &KubernetesDependency{}
+	dep := release.newKubernetesDependency()
 
 	// Check that each sub resource is owned by the phase
 	items := release.GetDependentResources()
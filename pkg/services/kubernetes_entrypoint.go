@@ -15,16 +15,41 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type KubernetesDependency struct {
+	// reader is used to lookup the objects which are not part of the
+	// release but drive its readiness, such as the Endpoints of a Service.
+	reader client.Reader
+
+	// registry holds the readiness rules. DefaultReadinessRegistry is used if nil.
+	registry *ReadinessRegistry
+
+	// rolloutDeadline is the time given to a statefulset or a daemonset to
+	// complete its rollout. defaultRolloutDeadline is used if zero.
+	rolloutDeadline time.Duration
+}
+
+// NewKubernetesDependency returns a KubernetesDependency able to lookup
+// related objects through reader.
+func NewKubernetesDependency(reader client.Reader) *KubernetesDependency {
+	return &KubernetesDependency{reader: reader}
 }
 
 // Is the status of the Unstructured ready
@@ -33,116 +58,24 @@ func (obj *KubernetesDependency) IsUnstructuredReady(u *unstructured.Unstructure
 		return true
 	}
 
-	// TODO(jeb): Any better pattern possible here ?
-	switch u.GetKind() {
-	case "Pod":
-		{
-			return obj.IsPodReady(u)
-		}
-	case "Job":
-		{
-			return obj.IsJobReady(u)
-		}
-	case "Service":
-		{
-			return true
-		}
-	case "Deployment":
-		{
-			return true
-		}
-	case "StatefulSet":
-		{
-			return true
-		}
-	case "Workflow":
-		{
-			return obj.IsWorkflowReady(u)
-		}
-	case "ArmadaChart":
-		{
-			return obj.IsArmadaChartReady(u)
-		}
-	case "ArmadaChartGroup":
-		{
-			return obj.IsArmadaChartGroupReady(u)
-		}
-	case "ArmadaManifest":
-		{
-			return obj.IsArmadaManifestReady(u)
-		}
-	// case "PodDisruptionBudget":
-	// case "ServiceAccount":
-	// case "Role":
-	// case "RoleBinding":
-	// case "Secret":
-	// case "ConfigMap":
-	// case "Ingress":
-	// case "CronJob":
-	default:
-		{
-			return true
-		}
+	rule, found := obj.getRegistry().Lookup(u.GroupVersionKind())
+	if !found || rule.IsReady == nil {
+		return obj.IsGenericReady(u)
 	}
+	return rule.IsReady(obj, u)
 }
 
-// Is the status of the Unstructured ready
+// Is the status of the Unstructured failed or in error
 func (obj *KubernetesDependency) IsUnstructuredFailedOrError(u *unstructured.Unstructured) bool {
 	if u == nil {
 		return false
 	}
 
-	// TODO(jeb): Any better pattern possible here ?
-	switch u.GetKind() {
-	case "Pod":
-		{
-			return obj.IsPodFailedOrError(u)
-		}
-	case "Job":
-		{
-			return obj.IsJobFailedOrError(u)
-		}
-	case "Service":
-		{
-			return false
-		}
-	case "Deployment":
-		{
-			return false
-		}
-	case "StatefulSet":
-		{
-			return false
-		}
-	case "Workflow":
-		{
-			return obj.IsWorkflowFailedOrError(u)
-		}
-	case "ArmadaChart":
-		{
-			return obj.IsArmadaChartFailedOrError(u)
-		}
-	case "ArmadaChartGroup":
-		{
-			return obj.IsArmadaChartGroupFailedOrError(u)
-		}
-	case "ArmadaManifest":
-		{
-			return obj.IsArmadaManifestFailedOrError(u)
-		}
-	// case "PodDisruptionBudget":
-	// case "ServiceAccount":
-	// case "Role":
-	// case "RoleBinding":
-	// case "Secret":
-	// case "ConfigMap":
-	// case "Ingress":
-	// case "CronJob":
-	default:
-		{
-			return false
-		}
+	rule, found := obj.getRegistry().Lookup(u.GroupVersionKind())
+	if !found || rule.IsFailedOrError == nil {
+		return obj.IsGenericFailedOrError(u)
 	}
+	return rule.IsFailedOrError(obj, u)
 }
 
 // Did the status changed
@@ -155,57 +88,19 @@ func (obj *KubernetesDependency) UnstructuredStatusChanged(u *unstructured.Unstr
 		return false, "", ""
 	}
 
-	// TODO(jeb): Any better pattern possible here ?
-	switch u.GetKind() {
-	case "Pod":
-		{
-			return obj.PodStatusChanged(u, v)
-		}
-	case "Job":
-		{
-			return obj.JobStatusChanged(u, v)
-		}
-	case "Service":
-		{
-			return false, "", ""
-		}
-	case "Deployment":
-		{
-			return false, "", ""
-		}
-	case "StatefulSet":
-		{
-			return false, "", ""
-		}
-	case "Workflow":
-		{
-			return obj.WorkflowStatusChanged(u, v)
-		}
-	case "ArmadaChart":
-		{
-			return obj.ArmadaChartStatusChanged(u, v)
-		}
-	case "ArmadaChartGroup":
-		{
-			return obj.ArmadaChartGroupStatusChanged(u, v)
-		}
-	case "ArmadaManifest":
-		{
-			return obj.ArmadaManifestStatusChanged(u, v)
-		}
-	// case "PodDisruptionBudget":
-	// case "ServiceAccount":
-	// case "Role":
-	// case "RoleBinding":
-	// case "Secret":
-	// case "ConfigMap":
-	// case "Ingress":
-	// case "CronJob":
-	default:
-		{
-			return false, "", ""
-		}
+	rule, found := obj.getRegistry().Lookup(u.GroupVersionKind())
+	if !found || rule.StatusChanged == nil {
+		return obj.GenericStatusChanged(u, v)
 	}
+	return rule.StatusChanged(obj, u, v)
+}
+
+// getRegistry returns the registry holding the readiness rules
+func (obj *KubernetesDependency) getRegistry() *ReadinessRegistry {
+	if obj.registry == nil {
+		return DefaultReadinessRegistry
+	}
+	return obj.registry
 }
 
 // Check the state of the ArmadaChart to figure out if it is still running
@@ -290,47 +185,57 @@ func (obj *KubernetesDependency) CustomResourceStatusChanged(key string,
 	return uValue != "" && vValue != "" && uValue != vValue, uValue, vValue
 }
 
-// Utility function to extract a field value from an Unstructured object
-// This code is inspired from the kubernetes-entrypoint project
+// Utility function to extract a field value from an Unstructured object.
+// A missing or malformed field is logged and reported as "".
 func (obj *KubernetesDependency) extractField(key string, u *unstructured.Unstructured) string {
-
 	if u == nil {
 		return ""
 	}
 
-	customResource := u.UnstructuredContent()
-
-	for i := strings.Index(key, "."); i != -1; i = strings.Index(key, ".") {
-		first := key[:i]
-		key = key[i+1:]
-		if customResource[first] != nil {
-			customResource = customResource[first].(map[string]interface{})
-		} else {
-			return ""
+	value, err := ExtractField(key, u)
+	if err != nil {
+		if !errors.Is(err, ErrFieldNotFound) {
+			log.Info("Failed to extract field", "kind", u.GetKind(), "name", u.GetName(), "error", err.Error())
 		}
-	}
-
-	if customResource != nil {
-		return customResource[key].(string)
-	} else {
 		return ""
 	}
+	return value
 }
 
-// Check the state of a service
+// Check the state of a service by looking up its endpoints
 // This code is inspired from the kubernetes-entrypoint project
 func (obj *KubernetesDependency) IsServiceReady(u *unstructured.Unstructured) bool {
 	if u == nil {
 		return false
 	}
 
-	endpointsu := corev1.Endpoints{}
-	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &endpointsu)
+	serviceu := corev1.Service{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &serviceu)
 	if err1u != nil {
 		return false
 	}
 
-	for _, subset := range endpointsu.Subsets {
+	if serviceu.Spec.Type == corev1.ServiceTypeExternalName || len(serviceu.Spec.Selector) == 0 {
+		// The endpoints are not managed by Kubernetes
+		return true
+	}
+
+	if serviceu.Spec.Type == corev1.ServiceTypeLoadBalancer && len(serviceu.Status.LoadBalancer.Ingress) == 0 {
+		return false
+	}
+
+	if obj.reader == nil {
+		// Can't lookup the endpoints
+		return true
+	}
+
+	endpoints := corev1.Endpoints{}
+	err := obj.reader.Get(context.TODO(), types.NamespacedName{Namespace: u.GetNamespace(), Name: u.GetName()}, &endpoints)
+	if err != nil {
+		return false
+	}
+
+	for _, subset := range endpoints.Subsets {
 		if len(subset.Addresses) > 0 {
 			return true
 		}
@@ -338,26 +243,228 @@ func (obj *KubernetesDependency) IsServiceReady(u *unstructured.Unstructured) bo
 	return false
 }
 
+// A service does not report failures in its status. The failures
+// are only visible in the status of the pods it selects.
 func (obj *KubernetesDependency) IsServiceFailedOrError(u *unstructured.Unstructured) bool {
+	return false
+}
+
+// Compare the load balancer status between two Service. The changes of the
+// endpoints are detected through a watch on the Endpoints.
+func (obj *KubernetesDependency) ServiceStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	serviceu := corev1.Service{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &serviceu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	servicev := corev1.Service{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &servicev)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v", serviceu.Status.LoadBalancer.Ingress)
+	statusv := fmt.Sprintf("%v", servicev.Status.LoadBalancer.Ingress)
+	return statusu != statusv, statusu, statusv
+}
+
+// Check that a persistent volume claim is bound
+func (obj *KubernetesDependency) IsPersistentVolumeClaimReady(u *unstructured.Unstructured) bool {
 	if u == nil {
 		return false
 	}
 
-	endpointsu := corev1.Endpoints{}
-	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &endpointsu)
+	pvcu := corev1.PersistentVolumeClaim{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pvcu)
 	if err1u != nil {
 		return false
 	}
 
-	for _, subset := range endpointsu.Subsets {
-		if false {
-			log.Info("%v", subset)
-		}
+	return pvcu.Status.Phase == corev1.ClaimBound
+}
+
+func (obj *KubernetesDependency) IsPersistentVolumeClaimFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	pvcu := corev1.PersistentVolumeClaim{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pvcu)
+	if err1u != nil {
+		return false
+	}
+
+	return pvcu.Status.Phase == corev1.ClaimLost
+}
+
+// Compare the phase between two PersistentVolumeClaim
+func (obj *KubernetesDependency) PersistentVolumeClaimStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	pvcu := corev1.PersistentVolumeClaim{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pvcu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	pvcv := corev1.PersistentVolumeClaim{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &pvcv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	return pvcu.Status.Phase != pvcv.Status.Phase, string(pvcu.Status.Phase), string(pvcv.Status.Phase)
+}
+
+// Check that an ingress has been assigned a load balancer
+func (obj *KubernetesDependency) IsIngressReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	ingressu := networkingv1.Ingress{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &ingressu)
+	if err1u != nil {
+		return false
+	}
+
+	return len(ingressu.Status.LoadBalancer.Ingress) > 0
+}
+
+// An ingress does not report failures in its status.
+func (obj *KubernetesDependency) IsIngressFailedOrError(u *unstructured.Unstructured) bool {
+	return false
+}
+
+// Compare the load balancer status between two Ingress
+func (obj *KubernetesDependency) IngressStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	ingressu := networkingv1.Ingress{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &ingressu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	ingressv := networkingv1.Ingress{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &ingressv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v", ingressu.Status.LoadBalancer.Ingress)
+	statusv := fmt.Sprintf("%v", ingressv.Status.LoadBalancer.Ingress)
+	return statusu != statusv, statusu, statusv
+}
+
+// Check the scheduling of a cronjob. A cronjob is ready as long as
+// its last scheduled run did not fail.
+func (obj *KubernetesDependency) IsCronJobReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	return !obj.IsCronJobFailedOrError(u)
+}
+
+// Check if the last scheduled run of a cronjob completed without success
+func (obj *KubernetesDependency) IsCronJobFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	cronjobu := batchv1.CronJob{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &cronjobu)
+	if err1u != nil {
+		return false
 	}
 
+	status := cronjobu.Status
+	if status.LastScheduleTime == nil || len(status.Active) > 0 {
+		// Not scheduled yet or still running
+		return false
+	}
+	return status.LastSuccessfulTime == nil || status.LastSuccessfulTime.Before(status.LastScheduleTime)
+}
+
+// Compare the scheduling status between two CronJob
+func (obj *KubernetesDependency) CronJobStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	cronjobu := batchv1.CronJob{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &cronjobu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	cronjobv := batchv1.CronJob{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &cronjobv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v|%v|%v", cronjobu.Status.LastScheduleTime, cronjobu.Status.LastSuccessfulTime, len(cronjobu.Status.Active))
+	statusv := fmt.Sprintf("%v|%v|%v", cronjobv.Status.LastScheduleTime, cronjobv.Status.LastSuccessfulTime, len(cronjobv.Status.Active))
+	return statusu != statusv, statusu, statusv
+}
+
+// Check that a pod disruption budget has enough healthy pods
+func (obj *KubernetesDependency) IsPodDisruptionBudgetReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	pdbu := policyv1.PodDisruptionBudget{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pdbu)
+	if err1u != nil {
+		return false
+	}
+
+	if pdbu.Generation > pdbu.Status.ObservedGeneration {
+		return false
+	}
+	return pdbu.Status.CurrentHealthy >= pdbu.Status.DesiredHealthy
+}
+
+// A pod disruption budget does not report failures in its status.
+func (obj *KubernetesDependency) IsPodDisruptionBudgetFailedOrError(u *unstructured.Unstructured) bool {
 	return false
 }
 
+// Compare the healthy pods between two PodDisruptionBudget
+func (obj *KubernetesDependency) PodDisruptionBudgetStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	pdbu := policyv1.PodDisruptionBudget{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pdbu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	pdbv := policyv1.PodDisruptionBudget{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &pdbv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v|%v|%v", pdbu.Status.ObservedGeneration, pdbu.Status.CurrentHealthy, pdbu.Status.DesiredHealthy)
+	statusv := fmt.Sprintf("%v|%v|%v", pdbv.Status.ObservedGeneration, pdbv.Status.CurrentHealthy, pdbv.Status.DesiredHealthy)
+	return statusu != statusv, statusu, statusv
+}
+
 // Check the state of a container
 // This code is inspired from the kubernetes-entrypoint project
 func (obj *KubernetesDependency) IsContainerReady(containerName string, u *unstructured.Unstructured) bool {
@@ -439,6 +546,314 @@ func (obj *KubernetesDependency) JobStatusChanged(u *unstructured.Unstructured,
 		fmt.Sprintf("%v|%v", jobv.Status.Succeeded, jobv.Status.Failed)
 }
 
+// Check the rollout of a deployment
+// This code is inspired from the kubectl rollout status command
+func (obj *KubernetesDependency) IsDeploymentReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	deploymentu := appsv1.Deployment{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &deploymentu)
+	if err1u != nil {
+		return false
+	}
+
+	if deploymentu.Generation > deploymentu.Status.ObservedGeneration {
+		return false
+	}
+
+	replicas := int32(1)
+	if deploymentu.Spec.Replicas != nil {
+		replicas = *deploymentu.Spec.Replicas
+	}
+
+	status := deploymentu.Status
+	if status.UpdatedReplicas < replicas {
+		return false
+	}
+	if status.Replicas > status.UpdatedReplicas {
+		// Old replicas are still pending termination
+		return false
+	}
+	if status.AvailableReplicas < status.UpdatedReplicas {
+		return false
+	}
+	return true
+}
+
+func (obj *KubernetesDependency) IsDeploymentFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	deploymentu := appsv1.Deployment{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &deploymentu)
+	if err1u != nil {
+		return false
+	}
+
+	for _, condition := range deploymentu.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return true
+		}
+		if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the rollout status between two Deployment
+func (obj *KubernetesDependency) DeploymentStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	deploymentu := appsv1.Deployment{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &deploymentu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	deploymentv := appsv1.Deployment{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &deploymentv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v|%v|%v|%v", deploymentu.Status.ObservedGeneration, deploymentu.Status.UpdatedReplicas,
+		deploymentu.Status.AvailableReplicas, obj.IsDeploymentFailedOrError(u))
+	statusv := fmt.Sprintf("%v|%v|%v|%v", deploymentv.Status.ObservedGeneration, deploymentv.Status.UpdatedReplicas,
+		deploymentv.Status.AvailableReplicas, obj.IsDeploymentFailedOrError(v))
+	return statusu != statusv, statusu, statusv
+}
+
+// defaultRolloutDeadline is the time given by default to a statefulset or a
+// daemonset to complete its rollout. It matches the default
+// progressDeadlineSeconds of a deployment.
+const defaultRolloutDeadline = 600 * time.Second
+
+// now returns the current time. It is replaced by the tests.
+var now = time.Now
+
+// isFailureCondition checks if a condition reported by the controller of a
+// workload is a failure, such as ReplicaFailure or ProgressDeadlineExceeded.
+func isFailureCondition(conditionType string, status corev1.ConditionStatus, reason string) bool {
+	if reason == "ProgressDeadlineExceeded" {
+		return true
+	}
+	return strings.HasSuffix(conditionType, "Failure") && status == corev1.ConditionTrue
+}
+
+// getRolloutDeadline returns the time given to the object to complete its
+// rollout: its progressDeadlineSeconds if it has one, the deadline of the
+// KubernetesDependency otherwise, extended by its minReadySeconds.
+func (obj *KubernetesDependency) getRolloutDeadline(u *unstructured.Unstructured) time.Duration {
+	deadline := obj.rolloutDeadline
+	if deadline <= 0 {
+		deadline = defaultRolloutDeadline
+	}
+	if seconds, found, err := unstructured.NestedInt64(u.Object, "spec", "progressDeadlineSeconds"); err == nil && found && seconds > 0 {
+		deadline = time.Duration(seconds) * time.Second
+	}
+	if seconds, found, err := unstructured.NestedInt64(u.Object, "spec", "minReadySeconds"); err == nil && found && seconds > 0 {
+		deadline += time.Duration(seconds) * time.Second
+	}
+	return deadline
+}
+
+// isRolloutStuck checks if the spec of the object has not been updated for
+// longer than its rollout deadline. The time of the last update of the spec is
+// the most recent one of the managed fields, the status updates excepted.
+func (obj *KubernetesDependency) isRolloutStuck(u *unstructured.Unstructured) bool {
+	lastUpdate := u.GetCreationTimestamp().Time
+	for _, entry := range u.GetManagedFields() {
+		if entry.Subresource == "" && entry.Time != nil && entry.Time.After(lastUpdate) {
+			lastUpdate = entry.Time.Time
+		}
+	}
+	return !lastUpdate.IsZero() && now().Sub(lastUpdate) > obj.getRolloutDeadline(u)
+}
+
+// Check the rollout of a statefulset
+// This code is inspired from the kubectl rollout status command
+func (obj *KubernetesDependency) IsStatefulSetReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	statefulsetu := appsv1.StatefulSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &statefulsetu)
+	if err1u != nil {
+		return false
+	}
+
+	if statefulsetu.Spec.UpdateStrategy.Type != "" && statefulsetu.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		// The rollout of OnDelete statefulsets is driven manually
+		return true
+	}
+
+	status := statefulsetu.Status
+	if statefulsetu.Generation > status.ObservedGeneration {
+		return false
+	}
+
+	replicas := int32(1)
+	if statefulsetu.Spec.Replicas != nil {
+		replicas = *statefulsetu.Spec.Replicas
+	}
+	if status.ReadyReplicas < replicas {
+		return false
+	}
+
+	rollingUpdate := statefulsetu.Spec.UpdateStrategy.RollingUpdate
+	if rollingUpdate != nil && rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+		// Only the replicas above the partition are expected to be updated
+		return status.UpdatedReplicas >= replicas-*rollingUpdate.Partition
+	}
+
+	return status.UpdateRevision == status.CurrentRevision
+}
+
+// Check if the rollout of a statefulset failed. The statefulset controller
+// does not report a progress deadline as the deployment controller does, hence
+// a rollout observed by the controller which is still incomplete after its
+// rollout deadline is reported as failed.
+func (obj *KubernetesDependency) IsStatefulSetFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	statefulsetu := appsv1.StatefulSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &statefulsetu)
+	if err1u != nil {
+		return false
+	}
+
+	for _, condition := range statefulsetu.Status.Conditions {
+		if isFailureCondition(string(condition.Type), condition.Status, condition.Reason) {
+			return true
+		}
+	}
+
+	if statefulsetu.Generation > statefulsetu.Status.ObservedGeneration || obj.IsStatefulSetReady(u) {
+		return false
+	}
+	return obj.isRolloutStuck(u)
+}
+
+// Compare the rollout status between two StatefulSet
+func (obj *KubernetesDependency) StatefulSetStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	statefulsetu := appsv1.StatefulSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &statefulsetu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	statefulsetv := appsv1.StatefulSet{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &statefulsetv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v|%v|%v|%v|%v", statefulsetu.Status.ObservedGeneration, statefulsetu.Status.ReadyReplicas,
+		statefulsetu.Status.UpdatedReplicas, statefulsetu.Status.CurrentRevision, obj.IsStatefulSetFailedOrError(u))
+	statusv := fmt.Sprintf("%v|%v|%v|%v|%v", statefulsetv.Status.ObservedGeneration, statefulsetv.Status.ReadyReplicas,
+		statefulsetv.Status.UpdatedReplicas, statefulsetv.Status.CurrentRevision, obj.IsStatefulSetFailedOrError(v))
+	return statusu != statusv, statusu, statusv
+}
+
+// Check the rollout of a daemonset
+// This code is inspired from the kubectl rollout status command
+func (obj *KubernetesDependency) IsDaemonSetReady(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	daemonsetu := appsv1.DaemonSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &daemonsetu)
+	if err1u != nil {
+		return false
+	}
+
+	if daemonsetu.Spec.UpdateStrategy.Type != "" && daemonsetu.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+		// The rollout of OnDelete daemonsets is driven manually
+		return true
+	}
+
+	status := daemonsetu.Status
+	if daemonsetu.Generation > status.ObservedGeneration {
+		return false
+	}
+	if status.UpdatedNumberScheduled < status.DesiredNumberScheduled {
+		return false
+	}
+	if status.NumberAvailable < status.DesiredNumberScheduled {
+		return false
+	}
+	return true
+}
+
+// Check if the rollout of a daemonset failed. As for the statefulsets, a
+// rollout observed by the controller which still has pods not updated or
+// unavailable after its rollout deadline is reported as failed.
+func (obj *KubernetesDependency) IsDaemonSetFailedOrError(u *unstructured.Unstructured) bool {
+	if u == nil {
+		return false
+	}
+
+	daemonsetu := appsv1.DaemonSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &daemonsetu)
+	if err1u != nil {
+		return false
+	}
+
+	for _, condition := range daemonsetu.Status.Conditions {
+		if isFailureCondition(string(condition.Type), condition.Status, condition.Reason) {
+			return true
+		}
+	}
+
+	status := daemonsetu.Status
+	if daemonsetu.Generation > status.ObservedGeneration || obj.IsDaemonSetReady(u) {
+		return false
+	}
+	if status.UpdatedNumberScheduled >= status.DesiredNumberScheduled && status.NumberUnavailable == 0 {
+		return false
+	}
+	return obj.isRolloutStuck(u)
+}
+
+// Compare the rollout status between two DaemonSet
+func (obj *KubernetesDependency) DaemonSetStatusChanged(u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+	if u == nil || v == nil {
+		return true, "", ""
+	}
+
+	daemonsetu := appsv1.DaemonSet{}
+	err1u := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &daemonsetu)
+	if err1u != nil {
+		return true, "", ""
+	}
+
+	daemonsetv := appsv1.DaemonSet{}
+	err1v := runtime.DefaultUnstructuredConverter.FromUnstructured(v.UnstructuredContent(), &daemonsetv)
+	if err1v != nil {
+		return true, "", ""
+	}
+
+	statusu := fmt.Sprintf("%v|%v|%v|%v", daemonsetu.Status.ObservedGeneration, daemonsetu.Status.UpdatedNumberScheduled,
+		daemonsetu.Status.NumberAvailable, obj.IsDaemonSetFailedOrError(u))
+	statusv := fmt.Sprintf("%v|%v|%v|%v", daemonsetv.Status.ObservedGeneration, daemonsetv.Status.UpdatedNumberScheduled,
+		daemonsetv.Status.NumberAvailable, obj.IsDaemonSetFailedOrError(v))
+	return statusu != statusv, statusu, statusv
+}
+
 // Check the state of a pod
 // This code is inspired from the kubernetes-entrypoint project
 func (obj *KubernetesDependency) IsPodReady(u *unstructured.Unstructured) bool {
@@ -0,0 +1,363 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newUnstructured(kind string, content map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: content}
+	u.SetKind(kind)
+	u.SetName("foo")
+	u.SetNamespace("default")
+	return u
+}
+
+func TestDeploymentReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	rolling := newUnstructured("Deployment", map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"metadata":   map[string]interface{}{"generation": int64(2)},
+		"spec":       map[string]interface{}{"replicas": int64(3)},
+		"status": map[string]interface{}{
+			"observedGeneration": int64(2),
+			"replicas":           int64(3),
+			"updatedReplicas":    int64(3),
+			"availableReplicas":  int64(1),
+		},
+	})
+	g.Expect(dep.IsUnstructuredReady(rolling)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredFailedOrError(rolling)).To(gomega.BeFalse())
+
+	available := rolling.DeepCopy()
+	_ = unstructured.SetNestedField(available.Object, int64(3), "status", "availableReplicas")
+	g.Expect(dep.IsUnstructuredReady(available)).To(gomega.BeTrue())
+
+	changed, _, _ := dep.UnstructuredStatusChanged(rolling, available)
+	g.Expect(changed).To(gomega.BeTrue())
+
+	stale := available.DeepCopy()
+	stale.SetGeneration(3)
+	g.Expect(dep.IsUnstructuredReady(stale)).To(gomega.BeFalse())
+
+	failed := rolling.DeepCopy()
+	_ = unstructured.SetNestedSlice(failed.Object, []interface{}{
+		map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"},
+	}, "status", "conditions")
+	g.Expect(dep.IsUnstructuredFailedOrError(failed)).To(gomega.BeTrue())
+}
+
+func TestStatefulSetReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	sts := newUnstructured("StatefulSet", map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"spec":       map[string]interface{}{"replicas": int64(3)},
+		"status": map[string]interface{}{
+			"readyReplicas":   int64(3),
+			"updatedReplicas": int64(1),
+			"currentRevision": "foo-1",
+			"updateRevision":  "foo-2",
+		},
+	})
+	g.Expect(dep.IsUnstructuredReady(sts)).To(gomega.BeFalse())
+
+	partitioned := sts.DeepCopy()
+	_ = unstructured.SetNestedMap(partitioned.Object, map[string]interface{}{
+		"type":          "RollingUpdate",
+		"rollingUpdate": map[string]interface{}{"partition": int64(2)},
+	}, "spec", "updateStrategy")
+	g.Expect(dep.IsUnstructuredReady(partitioned)).To(gomega.BeTrue())
+
+	updated := sts.DeepCopy()
+	_ = unstructured.SetNestedField(updated.Object, "foo-2", "status", "currentRevision")
+	g.Expect(dep.IsUnstructuredReady(updated)).To(gomega.BeTrue())
+}
+
+// setLastUpdate records an update of the spec of the object at the given time.
+func setLastUpdate(u *unstructured.Unstructured, at time.Time) {
+	u.SetManagedFields([]metav1.ManagedFieldsEntry{
+		{Manager: "armada-operator", Operation: metav1.ManagedFieldsOperationApply, Time: &metav1.Time{Time: at}},
+		{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate,
+			Subresource: "status", Time: &metav1.Time{Time: at.Add(time.Hour)}},
+	})
+}
+
+func TestStatefulSetFailure(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	current := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	sts := newUnstructured("StatefulSet", map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"metadata":   map[string]interface{}{"generation": int64(2)},
+		"spec":       map[string]interface{}{"replicas": int64(3)},
+		"status": map[string]interface{}{
+			"observedGeneration": int64(2),
+			"readyReplicas":      int64(2),
+			"updatedReplicas":    int64(2),
+			"currentRevision":    "foo-1",
+			"updateRevision":     "foo-2",
+		},
+	})
+
+	// The rollout is still in progress
+	setLastUpdate(sts, current.Add(-5*time.Minute))
+	g.Expect(dep.IsUnstructuredFailedOrError(sts)).To(gomega.BeFalse())
+
+	// The rollout did not complete in time, the status updates do not count
+	stuck := sts.DeepCopy()
+	setLastUpdate(stuck, current.Add(-15*time.Minute))
+	g.Expect(dep.IsUnstructuredFailedOrError(stuck)).To(gomega.BeTrue())
+	changed, _, _ := dep.UnstructuredStatusChanged(sts, stuck)
+	g.Expect(changed).To(gomega.BeTrue())
+
+	// The controller did not observe the last update yet
+	unobserved := stuck.DeepCopy()
+	unobserved.SetGeneration(3)
+	g.Expect(dep.IsUnstructuredFailedOrError(unobserved)).To(gomega.BeFalse())
+
+	// A completed rollout is never failed
+	completed := stuck.DeepCopy()
+	_ = unstructured.SetNestedField(completed.Object, int64(3), "status", "readyReplicas")
+	_ = unstructured.SetNestedField(completed.Object, "foo-2", "status", "currentRevision")
+	g.Expect(dep.IsUnstructuredFailedOrError(completed)).To(gomega.BeFalse())
+
+	// Failures reported by the controller
+	reported := sts.DeepCopy()
+	_ = unstructured.SetNestedSlice(reported.Object, []interface{}{
+		map[string]interface{}{"type": "ReplicaFailure", "status": "True", "reason": "FailedCreate"},
+	}, "status", "conditions")
+	g.Expect(dep.IsUnstructuredFailedOrError(reported)).To(gomega.BeTrue())
+
+	// The deadline is configurable and extended by minReadySeconds
+	slow := &KubernetesDependency{rolloutDeadline: 30 * time.Minute}
+	g.Expect(slow.IsUnstructuredFailedOrError(stuck)).To(gomega.BeFalse())
+	delayed := stuck.DeepCopy()
+	_ = unstructured.SetNestedField(delayed.Object, int64(600), "spec", "minReadySeconds")
+	g.Expect(dep.IsUnstructuredFailedOrError(delayed)).To(gomega.BeFalse())
+
+	// progressDeadlineSeconds takes precedence
+	bounded := stuck.DeepCopy()
+	_ = unstructured.SetNestedField(bounded.Object, int64(3600), "spec", "progressDeadlineSeconds")
+	g.Expect(dep.IsUnstructuredFailedOrError(bounded)).To(gomega.BeFalse())
+}
+
+func TestDaemonSetReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	ds := newUnstructured("DaemonSet", map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"status": map[string]interface{}{
+			"desiredNumberScheduled": int64(4),
+			"updatedNumberScheduled": int64(4),
+			"numberAvailable":        int64(3),
+		},
+	})
+	g.Expect(dep.IsUnstructuredReady(ds)).To(gomega.BeFalse())
+
+	_ = unstructured.SetNestedField(ds.Object, int64(4), "status", "numberAvailable")
+	g.Expect(dep.IsUnstructuredReady(ds)).To(gomega.BeTrue())
+}
+
+func TestDaemonSetFailure(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	current := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	ds := newUnstructured("DaemonSet", map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"metadata":   map[string]interface{}{"generation": int64(5)},
+		"status": map[string]interface{}{
+			"observedGeneration":     int64(5),
+			"desiredNumberScheduled": int64(4),
+			"updatedNumberScheduled": int64(4),
+			"numberAvailable":        int64(3),
+			"numberUnavailable":      int64(1),
+		},
+	})
+	setLastUpdate(ds, current.Add(-5*time.Minute))
+	g.Expect(dep.IsUnstructuredFailedOrError(ds)).To(gomega.BeFalse())
+
+	stuck := ds.DeepCopy()
+	setLastUpdate(stuck, current.Add(-15*time.Minute))
+	g.Expect(dep.IsUnstructuredFailedOrError(stuck)).To(gomega.BeTrue())
+
+	available := stuck.DeepCopy()
+	_ = unstructured.SetNestedField(available.Object, int64(4), "status", "numberAvailable")
+	_ = unstructured.SetNestedField(available.Object, int64(0), "status", "numberUnavailable")
+	g.Expect(dep.IsUnstructuredFailedOrError(available)).To(gomega.BeFalse())
+}
+
+func TestPersistentVolumeClaimReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	pending := newUnstructured("PersistentVolumeClaim", map[string]interface{}{
+		"apiVersion": "v1",
+		"status":     map[string]interface{}{"phase": "Pending"},
+	})
+	bound := pending.DeepCopy()
+	_ = unstructured.SetNestedField(bound.Object, "Bound", "status", "phase")
+
+	g.Expect(dep.IsUnstructuredReady(pending)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredReady(bound)).To(gomega.BeTrue())
+	changed, _, _ := dep.UnstructuredStatusChanged(pending, bound)
+	g.Expect(changed).To(gomega.BeTrue())
+}
+
+func TestCronJobReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	cronjob := newUnstructured("CronJob", map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"spec":       map[string]interface{}{"schedule": "*/5 * * * *"},
+	})
+	g.Expect(dep.IsUnstructuredReady(cronjob)).To(gomega.BeTrue())
+
+	failed := cronjob.DeepCopy()
+	_ = unstructured.SetNestedField(failed.Object, "2019-10-01T10:05:00Z", "status", "lastScheduleTime")
+	_ = unstructured.SetNestedField(failed.Object, "2019-10-01T10:00:30Z", "status", "lastSuccessfulTime")
+	g.Expect(dep.IsUnstructuredReady(failed)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredFailedOrError(failed)).To(gomega.BeTrue())
+}
+
+func TestServiceReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	newService := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		u := newUnstructured("Service", map[string]interface{}{"apiVersion": "v1", "spec": spec})
+		u.SetName(name)
+		return u
+	}
+	newEndpoints := func(name string, addresses ...string) *corev1.Endpoints {
+		subset := corev1.EndpointSubset{}
+		for _, address := range addresses {
+			subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: address})
+		}
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Subsets:    []corev1.EndpointSubset{subset},
+		}
+	}
+	selector := map[string]interface{}{"app": "keystone"}
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		newEndpoints("keystone-api", "10.0.0.1"),
+		newEndpoints("keystone-db"),
+	).Build()
+	dep := NewKubernetesDependency(c)
+
+	for _, tc := range []struct {
+		name    string
+		service *unstructured.Unstructured
+		ready   bool
+	}{
+		{"endpoints with addresses", newService("keystone-api", map[string]interface{}{"selector": selector}), true},
+		{"endpoints without address", newService("keystone-db", map[string]interface{}{"selector": selector}), false},
+		{"endpoints not found", newService("keystone-cache", map[string]interface{}{"selector": selector}), false},
+		{"endpoints not managed", newService("keystone-external", map[string]interface{}{}), true},
+		{"external name", newService("keystone-alias",
+			map[string]interface{}{"type": "ExternalName", "externalName": "keystone.example.com"}), true},
+		{"load balancer pending", newService("keystone-api",
+			map[string]interface{}{"type": "LoadBalancer", "selector": selector}), false},
+	} {
+		g.Expect(dep.IsUnstructuredReady(tc.service)).To(gomega.Equal(tc.ready), tc.name)
+	}
+}
+
+func TestIngressReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	pending := newUnstructured("Ingress", map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"spec":       map[string]interface{}{"ingressClassName": "nginx"},
+	})
+	assigned := pending.DeepCopy()
+	_ = unstructured.SetNestedSlice(assigned.Object, []interface{}{
+		map[string]interface{}{"ip": "192.168.0.10"},
+	}, "status", "loadBalancer", "ingress")
+
+	for _, tc := range []struct {
+		name    string
+		ingress *unstructured.Unstructured
+		ready   bool
+	}{
+		{"no load balancer", pending, false},
+		{"load balancer assigned", assigned, true},
+	} {
+		g.Expect(dep.IsUnstructuredReady(tc.ingress)).To(gomega.Equal(tc.ready), tc.name)
+		g.Expect(dep.IsUnstructuredFailedOrError(tc.ingress)).To(gomega.BeFalse(), tc.name)
+	}
+
+	changed, _, _ := dep.UnstructuredStatusChanged(pending, assigned)
+	g.Expect(changed).To(gomega.BeTrue())
+}
+
+func TestPodDisruptionBudgetReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{}
+
+	newPDB := func(generation, observedGeneration, currentHealthy, desiredHealthy int64) *unstructured.Unstructured {
+		u := newUnstructured("PodDisruptionBudget", map[string]interface{}{
+			"apiVersion": "policy/v1",
+			"spec":       map[string]interface{}{"minAvailable": int64(2)},
+			"status": map[string]interface{}{
+				"observedGeneration": observedGeneration,
+				"currentHealthy":     currentHealthy,
+				"desiredHealthy":     desiredHealthy,
+			},
+		})
+		u.SetGeneration(generation)
+		return u
+	}
+
+	for _, tc := range []struct {
+		name  string
+		pdb   *unstructured.Unstructured
+		ready bool
+	}{
+		{"enough healthy pods", newPDB(1, 1, 3, 2), true},
+		{"not enough healthy pods", newPDB(1, 1, 1, 2), false},
+		{"not observed yet", newPDB(2, 1, 3, 2), false},
+	} {
+		g.Expect(dep.IsUnstructuredReady(tc.pdb)).To(gomega.Equal(tc.ready), tc.name)
+	}
+
+	changed, _, _ := dep.UnstructuredStatusChanged(newPDB(1, 1, 1, 2), newPDB(1, 1, 3, 2))
+	g.Expect(changed).To(gomega.BeTrue())
+}
@@ -0,0 +1,413 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LayeringMethod is the way the spec of an ArmadaChart is layered on top of
+// the spec of its parent, as Deckhand layers documents.
+type LayeringMethod string
+
+const (
+	// LayeringMethodMerge deep merges the child data into the parent data.
+	// Maps are merged recursively, other values of the child win.
+	LayeringMethodMerge LayeringMethod = "merge"
+
+	// LayeringMethodReplace replaces the parent data with the child data.
+	LayeringMethodReplace LayeringMethod = "replace"
+
+	// LayeringMethodDelete deletes the parent data.
+	LayeringMethodDelete LayeringMethod = "delete"
+)
+
+// LayeringAction applies a LayeringMethod at a path of the spec, such as
+// ".values.conf". The path "." designates the whole spec.
+type LayeringAction struct {
+	Method LayeringMethod `json:"method" yaml:"method"`
+	Path   string         `json:"path" yaml:"path"`
+}
+
+// defaultLayeringActions are used when the ArmadaChart has a parent but no actions.
+var defaultLayeringActions = []LayeringAction{{Method: LayeringMethodMerge, Path: "."}}
+
+// SubstitutionSource is the value of a key of a Secret of the namespace of
+// the ArmadaChart. When Path is set, the value is parsed as YAML and the
+// JSONPath is extracted from it.
+type SubstitutionSource struct {
+	Secret string `json:"secret" yaml:"secret"`
+	Key    string `json:"key" yaml:"key"`
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// SubstitutionDest is the path of the spec receiving the value. When Pattern
+// is set, only the occurrences of the pattern in the current string value are
+// replaced.
+type SubstitutionDest struct {
+	Path    string `json:"path" yaml:"path"`
+	Pattern string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+}
+
+// Substitution copies a value from a Secret into the spec of an ArmadaChart.
+type Substitution struct {
+	Source SubstitutionSource `json:"src" yaml:"src"`
+	Dest   SubstitutionDest   `json:"dest" yaml:"dest"`
+}
+
+// GetLayeringActions parses the layering actions listed in the annotations of
+// an ArmadaChart. The whole spec is merged when no action is listed.
+func GetLayeringActions(annotations map[string]string) ([]LayeringAction, error) {
+	data, found := annotations[AnnotationLayeringActions]
+	if !found || strings.TrimSpace(data) == "" {
+		return defaultLayeringActions, nil
+	}
+
+	actions := make([]LayeringAction, 0)
+	if err := yaml.Unmarshal([]byte(data), &actions); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s annotation: %s", InvalidArmadaObjectException, AnnotationLayeringActions, err)
+	}
+	for _, action := range actions {
+		switch action.Method {
+		case LayeringMethodMerge, LayeringMethodReplace, LayeringMethodDelete:
+		default:
+			return nil, fmt.Errorf("%w: %s annotation: unknown method %q",
+				InvalidArmadaObjectException, AnnotationLayeringActions, action.Method)
+		}
+		if _, err := splitPath(action.Path); err != nil {
+			return nil, fmt.Errorf("%w: %s annotation: %s", InvalidArmadaObjectException, AnnotationLayeringActions, err)
+		}
+	}
+	return actions, nil
+}
+
+// GetSubstitutions parses the substitutions listed in the annotations of an ArmadaChart.
+func GetSubstitutions(annotations map[string]string) ([]Substitution, error) {
+	data, found := annotations[AnnotationSubstitutions]
+	if !found || strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	substitutions := make([]Substitution, 0)
+	if err := yaml.Unmarshal([]byte(data), &substitutions); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s annotation: %s", InvalidArmadaObjectException, AnnotationSubstitutions, err)
+	}
+	for _, substitution := range substitutions {
+		if substitution.Source.Secret == "" || substitution.Source.Key == "" {
+			return nil, fmt.Errorf("%w: %s annotation: src.secret and src.key are required",
+				InvalidArmadaObjectException, AnnotationSubstitutions)
+		}
+		segments, err := splitPath(substitution.Dest.Path)
+		if err == nil && len(segments) == 0 {
+			err = fmt.Errorf("dest.path can not be the whole spec")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s annotation: %s", InvalidArmadaObjectException, AnnotationSubstitutions, err)
+		}
+	}
+	return substitutions, nil
+}
+
+// ResolveArmadaChart returns a copy of the ArmadaChart whose spec has been
+// layered on top of the specs of its parents, then completed with the values
+// of the Secrets listed in the substitutions of the ArmadaChart and of its
+// parents. The target_state is always the one of the ArmadaChart, since it
+// is driven by the ArmadaChartGroup. The ArmadaChart itself is returned when
+// it has neither parent nor substitutions.
+func ResolveArmadaChart(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (*av1.ArmadaChart, error) {
+	if !isLayered(chart) {
+		return chart, nil
+	}
+
+	data, err := resolveChartSpecData(ctx, reader, chart)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := chart.DeepCopy()
+	resolved.Spec = av1.ArmadaChartSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(data, &resolved.Spec); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrLayeringFailed, err)
+	}
+	return resolved, nil
+}
+
+// LayerArmadaChart returns a copy of the ArmadaChart whose spec has been
+// layered on top of the specs of its parents, as ResolveArmadaChart does, but
+// without the values of the Secrets. The substitutions of the ArmadaChart and
+// of its parents are returned in the order they are applied.
+func LayerArmadaChart(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (*av1.ArmadaChart, []Substitution, error) {
+	if !isLayered(chart) {
+		return chart, nil, nil
+	}
+
+	data, chain, err := layerChartSpecData(ctx, reader, chart)
+	if err != nil {
+		return nil, nil, err
+	}
+	substitutions := make([]Substitution, 0)
+	for i := len(chain) - 1; i >= 0; i-- {
+		docSubstitutions, err := GetSubstitutions(chain[i].GetAnnotations())
+		if err != nil {
+			return nil, nil, err
+		}
+		substitutions = append(substitutions, docSubstitutions...)
+	}
+
+	layered := chart.DeepCopy()
+	layered.Spec = av1.ArmadaChartSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(data, &layered.Spec); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrLayeringFailed, err)
+	}
+	return layered, substitutions, nil
+}
+
+// isLayered checks if the ArmadaChart has a parent or substitutions.
+func isLayered(chart *av1.ArmadaChart) bool {
+	annotations := chart.GetAnnotations()
+	_, hasParent := annotations[AnnotationLayeringParent]
+	_, hasSubstitutions := annotations[AnnotationSubstitutions]
+	return hasParent || hasSubstitutions
+}
+
+// resolveChartSpecData returns the spec of the ArmadaChart once layered and
+// substituted, as read from the cluster.
+func resolveChartSpecData(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (map[string]interface{}, error) {
+	data, chain, err := layerChartSpecData(ctx, reader, chart)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		substitutions, err := GetSubstitutions(chain[i].GetAnnotations())
+		if err != nil {
+			return nil, err
+		}
+		if err := substitute(ctx, reader, chart.GetNamespace(), data, substitutions); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrLayeringFailed, chain[i].GetName(), err)
+		}
+	}
+	return data, nil
+}
+
+// layerChartSpecData returns the spec of the ArmadaChart once layered, as read
+// from the cluster, and the chain of documents, from the ArmadaChart up to its
+// root parent.
+func layerChartSpecData(ctx context.Context, reader client.Reader, chart *av1.ArmadaChart) (map[string]interface{}, []*unstructured.Unstructured, error) {
+	// The chain of documents, from the ArmadaChart up to its root parent. The
+	// documents are read unstructured so that only the fields actually set in
+	// the child are layered on top of the parent.
+	chain := make([]*unstructured.Unstructured, 0)
+	visited := make(map[string]bool)
+	for name := chart.GetName(); name != ""; {
+		if visited[name] {
+			return nil, nil, fmt.Errorf("%w: cycle through parent %s", ErrLayeringFailed, name)
+		}
+		visited[name] = true
+
+		doc := av1.NewArmadaChartVersionKind(chart.GetNamespace(), name)
+		if err := reader.Get(ctx, types.NamespacedName{Namespace: chart.GetNamespace(), Name: name}, doc); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %s", ErrLayeringFailed, name, err)
+		}
+		chain = append(chain, doc)
+		name = doc.GetAnnotations()[AnnotationLayeringParent]
+	}
+
+	data, err := chartSpecData(chain[len(chain)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := len(chain) - 2; i >= 0; i-- {
+		child, err := chartSpecData(chain[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		actions, err := GetLayeringActions(chain[i].GetAnnotations())
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = LayerData(data, child, actions); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %s", ErrLayeringFailed, chain[i].GetName(), err)
+		}
+	}
+	data["target_state"] = string(chart.Spec.TargetState)
+	return data, chain, nil
+}
+
+// chartSpecData returns a copy of the spec of an ArmadaChart.
+func chartSpecData(doc *unstructured.Unstructured) (map[string]interface{}, error) {
+	data, _, err := unstructured.NestedMap(doc.Object, "spec")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrLayeringFailed, doc.GetName(), err)
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	return data, nil
+}
+
+// LayerData applies the layering actions of the child to a copy of the
+// parent data, and returns the copy. Merged and replaced paths must exist in
+// the child data, deleted paths must exist in the parent data.
+func LayerData(parent map[string]interface{}, child map[string]interface{}, actions []LayeringAction) (map[string]interface{}, error) {
+	data := runtime.DeepCopyJSON(parent)
+	for _, action := range actions {
+		segments, err := splitPath(action.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if action.Method == LayeringMethodDelete {
+			if len(segments) == 0 {
+				data = map[string]interface{}{}
+				continue
+			}
+			if _, found, _ := unstructured.NestedFieldNoCopy(data, segments...); !found {
+				return nil, fmt.Errorf("%s %s: path not found in the parent", action.Method, action.Path)
+			}
+			unstructured.RemoveNestedField(data, segments...)
+			continue
+		}
+
+		value, found, _ := unstructured.NestedFieldCopy(child, segments...)
+		if !found {
+			return nil, fmt.Errorf("%s %s: path not found in the child", action.Method, action.Path)
+		}
+		if action.Method == LayeringMethodMerge {
+			if current, found, _ := unstructured.NestedFieldNoCopy(data, segments...); found {
+				value = mergeData(current, value)
+			}
+		}
+		if len(segments) == 0 {
+			root, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s %s: the spec must be an object", action.Method, action.Path)
+			}
+			data = root
+			continue
+		}
+		if err := unstructured.SetNestedField(data, value, segments...); err != nil {
+			return nil, fmt.Errorf("%s %s: %s", action.Method, action.Path, err)
+		}
+	}
+	return data, nil
+}
+
+// mergeData deep merges the child value into the parent value. Maps are
+// merged key by key, any other child value replaces the parent value.
+func mergeData(parent interface{}, child interface{}) interface{} {
+	parentMap, parentIsMap := parent.(map[string]interface{})
+	childMap, childIsMap := child.(map[string]interface{})
+	if !parentIsMap || !childIsMap {
+		return child
+	}
+
+	merged := make(map[string]interface{}, len(parentMap))
+	for key, value := range parentMap {
+		merged[key] = value
+	}
+	for key, value := range childMap {
+		if current, found := merged[key]; found {
+			value = mergeData(current, value)
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// substitute copies the values of the Secrets into the data.
+func substitute(ctx context.Context, reader client.Reader, namespace string, data map[string]interface{}, substitutions []Substitution) error {
+	for _, substitution := range substitutions {
+		value, err := substitutionValue(ctx, reader, namespace, substitution.Source)
+		if err != nil {
+			return err
+		}
+
+		segments, _ := splitPath(substitution.Dest.Path)
+		if substitution.Dest.Pattern != "" {
+			current, found, err := unstructured.NestedString(data, segments...)
+			if err != nil || !found {
+				return fmt.Errorf("substitution into %s: no string to replace %q in", substitution.Dest.Path, substitution.Dest.Pattern)
+			}
+			value = strings.ReplaceAll(current, substitution.Dest.Pattern, value)
+		}
+		if err := unstructured.SetNestedField(data, value, segments...); err != nil {
+			return fmt.Errorf("substitution into %s: %s", substitution.Dest.Path, err)
+		}
+	}
+	return nil
+}
+
+// substitutionValue reads the value of a SubstitutionSource.
+func substitutionValue(ctx context.Context, reader client.Reader, namespace string, source SubstitutionSource) (string, error) {
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.Secret}, secret); err != nil {
+		return "", fmt.Errorf("secret %s: %s", source.Secret, err)
+	}
+	value, found := secret.Data[source.Key]
+	if !found {
+		return "", fmt.Errorf("secret %s: key %s not found", source.Secret, source.Key)
+	}
+	if source.Path == "" {
+		return string(value), nil
+	}
+
+	content, err := utilyaml.ToJSON(value)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: key %s: %s", source.Secret, source.Key, err)
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(content, &obj); err != nil {
+		return "", fmt.Errorf("secret %s: key %s is not an object: %s", source.Secret, source.Key, err)
+	}
+	extracted, err := ExtractField(source.Path, &unstructured.Unstructured{Object: obj})
+	if err != nil {
+		return "", fmt.Errorf("secret %s: key %s: %s", source.Secret, source.Key, err)
+	}
+	return extracted, nil
+}
+
+// splitPath splits a path such as ".values.conf" into its fields. The path "."
+// designates the whole data and returns no field.
+func splitPath(path string) ([]string, error) {
+	trimmed := strings.TrimPrefix(path, ".")
+	if trimmed == "" {
+		if path != "." {
+			return nil, fmt.Errorf("empty path")
+		}
+		return []string{}, nil
+	}
+	segments := strings.Split(trimmed, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return segments, nil
+}
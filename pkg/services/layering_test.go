@@ -0,0 +1,143 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLayerData(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	parent := map[string]interface{}{
+		"release": "keystone",
+		"values": map[string]interface{}{
+			"conf":   map[string]interface{}{"debug": false, "workers": int64(4)},
+			"images": map[string]interface{}{"api": "keystone:ocata"},
+			"pod":    map[string]interface{}{"replicas": int64(1)},
+		},
+	}
+	child := map[string]interface{}{
+		"values": map[string]interface{}{
+			"conf":   map[string]interface{}{"debug": true},
+			"images": map[string]interface{}{"api": "keystone:queens"},
+		},
+	}
+
+	data, err := LayerData(parent, child, []LayeringAction{
+		{Method: LayeringMethodMerge, Path: ".values.conf"},
+		{Method: LayeringMethodReplace, Path: ".values.images"},
+		{Method: LayeringMethodDelete, Path: ".values.pod"},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data).To(gomega.Equal(map[string]interface{}{
+		"release": "keystone",
+		"values": map[string]interface{}{
+			"conf":   map[string]interface{}{"debug": true, "workers": int64(4)},
+			"images": map[string]interface{}{"api": "keystone:queens"},
+		},
+	}))
+	g.Expect(parent["values"]).To(gomega.HaveKey("pod"))
+
+	_, err = LayerData(parent, child, []LayeringAction{{Method: LayeringMethodReplace, Path: ".values.pod"}})
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	_, err = GetLayeringActions(map[string]string{AnnotationLayeringActions: "- method: patch\n  path: .values"})
+	g.Expect(errors.Is(err, InvalidArmadaObjectException)).To(gomega.BeTrue())
+}
+
+// newChartDocument returns an ArmadaChart as stored in the cluster: only the
+// fields set by the user are present.
+func newChartDocument(name string, annotations map[string]string, spec map[string]interface{}) *unstructured.Unstructured {
+	doc := av1.NewArmadaChartVersionKind("openstack", name)
+	doc.SetAnnotations(annotations)
+	doc.Object["spec"] = spec
+	return doc
+}
+
+func TestResolveArmadaChart(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	parent := newChartDocument("keystone-global", map[string]string{AnnotationAbstract: "true"},
+		map[string]interface{}{
+			"chart_name": "keystone",
+			"release":    "keystone",
+			"source": map[string]interface{}{
+				"type":         "local",
+				"location":     "/opt/armada/helm-charts/keystone",
+				"subpath":      ".",
+				"reference":    "master",
+				"proxy_server": "http://PROXY:3128",
+			},
+			"target_state": "uninitialized",
+		})
+	annotations := map[string]string{
+		AnnotationLayeringParent:  "keystone-global",
+		AnnotationLayeringActions: "- method: merge\n  path: .source",
+		AnnotationSubstitutions: `
+- src: {secret: site-proxy, key: proxy.yaml, path: .proxy.host}
+  dest: {path: .source.proxy_server, pattern: PROXY}
+`,
+	}
+	child := newChartDocument("keystone", annotations, map[string]interface{}{
+		"source":       map[string]interface{}{"reference": "stable"},
+		"target_state": "deployed",
+	})
+	orphan := newChartDocument("glance", map[string]string{AnnotationLayeringParent: "missing"},
+		map[string]interface{}{"target_state": "deployed"})
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "openstack", Name: "site-proxy"},
+		Data:       map[string][]byte{"proxy.yaml": []byte("proxy:\n  host: proxy.site1\n")},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(parent, child, orphan, secret).Build()
+
+	chart := &av1.ArmadaChart{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "openstack", Name: "keystone", Annotations: annotations},
+		Spec:       av1.ArmadaChartSpec{TargetState: av1.StateDeployed},
+	}
+	resolved, err := ResolveArmadaChart(context.TODO(), c, chart)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(resolved.Spec.Release).To(gomega.Equal("keystone"))
+	g.Expect(resolved.Spec.Source.Location).To(gomega.Equal("/opt/armada/helm-charts/keystone"))
+	g.Expect(resolved.Spec.Source.Reference).To(gomega.Equal("stable"))
+	g.Expect(resolved.Spec.Source.ProxyServer).To(gomega.Equal("http://proxy.site1:3128"))
+	g.Expect(resolved.Spec.TargetState).To(gomega.Equal(av1.StateDeployed))
+	g.Expect(chart.Spec.Release).To(gomega.BeEmpty())
+
+	layered, substitutions, err := LayerArmadaChart(context.TODO(), c, chart)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(layered.Spec.Source.Reference).To(gomega.Equal("stable"))
+	g.Expect(layered.Spec.Source.ProxyServer).To(gomega.Equal("http://PROXY:3128"))
+	g.Expect(substitutions).To(gomega.HaveLen(1))
+	g.Expect(substitutions[0].Source.Secret).To(gomega.Equal("site-proxy"))
+
+	chart = &av1.ArmadaChart{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "openstack", Name: "glance", Annotations: orphan.GetAnnotations()},
+	}
+	_, err = ResolveArmadaChart(context.TODO(), c, chart)
+	g.Expect(errors.Is(err, ErrLayeringFailed)).To(gomega.BeTrue())
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// FailurePolicy describes the behavior of an ArmadaManifest when one of its
+// ArmadaChartGroups fails.
+type FailurePolicy string
+
+const (
+	// FailurePolicyHalt stops enabling the next ArmadaChartGroups.
+	FailurePolicyHalt FailurePolicy = "halt"
+
+	// FailurePolicyContinue keeps enabling the next ArmadaChartGroups.
+	FailurePolicyContinue FailurePolicy = "continue"
+
+	// FailurePolicyRollbackGroup reverts the ArmadaCharts of the failed group
+	// to their previous revisions, then halts.
+	FailurePolicyRollbackGroup FailurePolicy = "rollback-group"
+)
+
+// ArmadaManifestSpecExtensions holds the fields of the spec of an
+// ArmadaManifest which are declared in the armadamanifests CRD shipped with
+// the operator but are not part of the ArmadaManifestSpec of armada-crd.
+type ArmadaManifestSpecExtensions struct {
+	// MaxConcurrency is the default max_concurrency of the ArmadaChartGroups
+	// enabled by the manifest. 0 means unlimited.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// OrphanPolicy selects how the manifest handles the ArmadaChartGroups it
+	// still owns but which are no longer listed in its spec. Defaults to
+	// retain-and-warn.
+	OrphanPolicy OrphanPolicy `json:"orphan_policy,omitempty"`
+
+	// FailurePolicy selects how the manifest reacts when one of its
+	// ArmadaChartGroups fails. Defaults to halt.
+	FailurePolicy FailurePolicy `json:"failure_policy,omitempty"`
+}
+
+// GetArmadaManifestSpecExtensions reads the ArmadaManifest from the cluster
+// and returns the extension fields of its spec.
+func GetArmadaManifestSpecExtensions(ctx context.Context, reader client.Reader, manifest *av1.ArmadaManifest) (*ArmadaManifestSpecExtensions, error) {
+	doc := av1.NewArmadaManifestVersionKind(manifest.GetNamespace(), manifest.GetName())
+	ext := &ArmadaManifestSpecExtensions{}
+	if err := readSpecExtensions(ctx, reader, doc, ext); err != nil {
+		return nil, err
+	}
+
+	if ext.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("%w: negative max_concurrency %d", InvalidArmadaObjectException, ext.MaxConcurrency)
+	}
+	policy, err := defaultOrphanPolicy(ext.OrphanPolicy)
+	if err != nil {
+		return nil, err
+	}
+	ext.OrphanPolicy = policy
+
+	switch ext.FailurePolicy {
+	case "":
+		ext.FailurePolicy = FailurePolicyHalt
+	case FailurePolicyHalt, FailurePolicyContinue, FailurePolicyRollbackGroup:
+	default:
+		return nil, fmt.Errorf("%w: unknown failure_policy %q", InvalidArmadaObjectException, ext.FailurePolicy)
+	}
+	return ext, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+
+	"github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetArmadaManifestSpecExtensions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	newManifestDocument := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		doc := av1.NewArmadaManifestVersionKind("openstack", name)
+		doc.Object["spec"] = spec
+		return doc
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		newManifestDocument("plain", map[string]interface{}{"release_prefix": "osh"}),
+		newManifestDocument("tuned", map[string]interface{}{
+			"max_concurrency": int64(5), "orphan_policy": "delete", "failure_policy": "rollback-group"}),
+		newManifestDocument("negative", map[string]interface{}{"max_concurrency": int64(-1)}),
+		newManifestDocument("unknown", map[string]interface{}{"failure_policy": "retry"}),
+	).Build()
+
+	manifestOf := func(name string) *av1.ArmadaManifest {
+		manifest := &av1.ArmadaManifest{}
+		manifest.SetNamespace("openstack")
+		manifest.SetName(name)
+		return manifest
+	}
+
+	ext, err := GetArmadaManifestSpecExtensions(context.TODO(), c, manifestOf("plain"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.MaxConcurrency).To(gomega.BeZero())
+	g.Expect(ext.OrphanPolicy).To(gomega.Equal(OrphanPolicyRetainAndWarn))
+	g.Expect(ext.FailurePolicy).To(gomega.Equal(FailurePolicyHalt))
+
+	ext, err = GetArmadaManifestSpecExtensions(context.TODO(), c, manifestOf("tuned"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ext.MaxConcurrency).To(gomega.Equal(5))
+	g.Expect(ext.OrphanPolicy).To(gomega.Equal(OrphanPolicyDelete))
+	g.Expect(ext.FailurePolicy).To(gomega.Equal(FailurePolicyRollbackGroup))
+
+	for _, name := range []string{"negative", "unknown"} {
+		_, err = GetArmadaManifestSpecExtensions(context.TODO(), c, manifestOf(name))
+		g.Expect(errors.Is(err, InvalidArmadaObjectException)).To(gomega.BeTrue(), name)
+	}
+}
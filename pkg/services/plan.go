@@ -0,0 +1,188 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PlanAction is the action the operator would take on an ArmadaChart.
+type PlanAction string
+
+const (
+	// PlanActionInstall indicates the release would be installed.
+	PlanActionInstall PlanAction = "install"
+
+	// PlanActionUpgrade indicates the release would be upgraded.
+	PlanActionUpgrade PlanAction = "upgrade"
+
+	// PlanActionUnchanged indicates the release is up to date.
+	PlanActionUnchanged PlanAction = "unchanged"
+
+	// PlanActionMissing indicates the ArmadaChart or the ArmadaChartGroup does not exist.
+	PlanActionMissing PlanAction = "missing"
+
+	// PlanActionError indicates the release could not be planned.
+	PlanActionError PlanAction = "error"
+)
+
+// ChartPlan is the action planned for an ArmadaChart. The diff between the
+// deployed and the rendered manifests is provided for upgrades. Disabled
+// reports that the ArmadaChartGroup or the ArmadaChart has not been enabled
+// yet: the action is only taken once the ArmadaManifest enables it.
+type ChartPlan struct {
+	ChartGroup string     `json:"chartGroup" yaml:"chartGroup"`
+	Chart      string     `json:"chart,omitempty" yaml:"chart,omitempty"`
+	Release    string     `json:"release,omitempty" yaml:"release,omitempty"`
+	Action     PlanAction `json:"action" yaml:"action"`
+	Disabled   bool       `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Diff       string     `json:"diff,omitempty" yaml:"diff,omitempty"`
+	Error      string     `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ManifestPlan lists, in deployment order, the actions planned for the
+// ArmadaCharts of an ArmadaManifest.
+type ManifestPlan struct {
+	Manifest string         `json:"manifest" yaml:"manifest"`
+	Counts   map[string]int `json:"counts" yaml:"counts"`
+	Charts   []ChartPlan    `json:"charts" yaml:"charts"`
+}
+
+// NewManifestPlan returns an empty plan for the ArmadaManifest.
+func NewManifestPlan(manifest string) *ManifestPlan {
+	return &ManifestPlan{Manifest: manifest, Counts: make(map[string]int), Charts: make([]ChartPlan, 0)}
+}
+
+// Add appends the plan of an ArmadaChart.
+func (p *ManifestPlan) Add(chart ChartPlan) {
+	p.Charts = append(p.Charts, chart)
+	p.Counts[string(chart.Action)]++
+}
+
+// Summary returns the number of ArmadaCharts per action.
+func (p *ManifestPlan) Summary() string {
+	return fmt.Sprintf("%d to install, %d to upgrade, %d unchanged, %d missing, %d in error",
+		p.Counts[string(PlanActionInstall)], p.Counts[string(PlanActionUpgrade)],
+		p.Counts[string(PlanActionUnchanged)], p.Counts[string(PlanActionMissing)],
+		p.Counts[string(PlanActionError)])
+}
+
+// DiffManifests compares two rendered release manifests object by object.
+// Objects are identified by the "# Source:" comment Helm adds to each of them.
+// Added and removed objects are reported by name, and the lines of the changed
+// objects are prefixed with "+" or "-". The content of the Secrets is redacted.
+func DiffManifests(from, to string) string {
+	fromObjects, fromKeys := splitManifest(from)
+	toObjects, toKeys := splitManifest(to)
+
+	var diff strings.Builder
+	for _, key := range fromKeys {
+		if _, found := toObjects[key]; !found {
+			fmt.Fprintf(&diff, "- %s\n", key)
+		}
+	}
+	for _, key := range toKeys {
+		previous, found := fromObjects[key]
+		if !found {
+			fmt.Fprintf(&diff, "+ %s\n", key)
+			continue
+		}
+		if previous == toObjects[key] {
+			continue
+		}
+		if isSecret(previous) || isSecret(toObjects[key]) {
+			fmt.Fprintf(&diff, "~ %s (Secret, content redacted)\n", key)
+			continue
+		}
+		fmt.Fprintf(&diff, "~ %s\n", key)
+		for _, line := range diffLines(strings.Split(previous, "\n"), strings.Split(toObjects[key], "\n")) {
+			fmt.Fprintf(&diff, "  %s\n", line)
+		}
+	}
+	return diff.String()
+}
+
+// secretKind matches the kind of a Secret document.
+var secretKind = regexp.MustCompile(`(?m)^kind:\s*["']?Secret["']?\s*$`)
+
+// isSecret checks if a document of a manifest is a Secret.
+func isSecret(document string) bool {
+	return secretKind.MatchString(document)
+}
+
+// splitManifest splits a manifest into its objects, keyed by source.
+// The keys are returned in order of appearance.
+func splitManifest(manifest string) (map[string]string, []string) {
+	objects := make(map[string]string)
+	keys := make([]string, 0)
+	for i, document := range strings.Split(manifest, "\n---") {
+		document = strings.TrimSpace(strings.TrimPrefix(document, "---"))
+		if document == "" {
+			continue
+		}
+		key := fmt.Sprintf("document %d", i)
+		if strings.HasPrefix(document, "# Source: ") {
+			key = strings.TrimPrefix(strings.SplitN(document, "\n", 2)[0], "# Source: ")
+		}
+		// A template can render several objects
+		base := key
+		for n := 2; objects[key] != ""; n++ {
+			key = fmt.Sprintf("%s (%d)", base, n)
+		}
+		objects[key] = document
+		keys = append(keys, key)
+	}
+	return objects, keys
+}
+
+// diffLines returns the lines removed from and added to an object, using the
+// longest common subsequence of the lines.
+func diffLines(from, to []string) []string {
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			switch {
+			case from[i] == to[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0)
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			i++
+			j++
+		case j == len(to) || (i < len(from) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+from[i])
+			i++
+		default:
+			lines = append(lines, "+"+to[j])
+			j++
+		}
+	}
+	return lines
+}
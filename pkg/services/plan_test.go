@@ -0,0 +1,85 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestDiffManifests(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	deployed := `---
+# Source: keystone/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: keystone-etc
+data:
+  debug: "false"
+---
+# Source: keystone/templates/job-bootstrap.yaml
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: keystone-bootstrap
+---
+# Source: keystone/templates/secret-db.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: keystone-db-admin
+stringData:
+  DB_PASSWORD: password
+`
+	candidate := `---
+# Source: keystone/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: keystone-etc
+data:
+  debug: "true"
+---
+# Source: keystone/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: keystone-api
+---
+# Source: keystone/templates/secret-db.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: keystone-db-admin
+stringData:
+  DB_PASSWORD: s3cr3t
+`
+	g.Expect(DiffManifests(deployed, candidate)).To(gomega.Equal(
+		"- keystone/templates/job-bootstrap.yaml\n" +
+			"~ keystone/templates/configmap.yaml\n" +
+			"  -  debug: \"false\"\n" +
+			"  +  debug: \"true\"\n" +
+			"+ keystone/templates/service.yaml\n" +
+			"~ keystone/templates/secret-db.yaml (Secret, content redacted)\n"))
+	g.Expect(DiffManifests(deployed, deployed)).To(gomega.BeEmpty())
+
+	plan := NewManifestPlan("armada-manifest")
+	plan.Add(ChartPlan{ChartGroup: "openstack-keystone", Chart: "keystone", Action: PlanActionUpgrade})
+	plan.Add(ChartPlan{ChartGroup: "openstack-keystone", Chart: "glance", Action: PlanActionInstall})
+	g.Expect(plan.Summary()).To(gomega.Equal("1 to install, 1 to upgrade, 0 unchanged, 0 missing, 0 in error"))
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultAPIVersions are the apiVersion used when a Prerequisite only
+// specifies the kind.
+var defaultAPIVersions = map[string]string{
+	"Service":               "v1",
+	"Pod":                   "v1",
+	"PersistentVolumeClaim": "v1",
+	"Job":                   "batch/v1",
+	"Deployment":            "apps/v1",
+	"StatefulSet":           "apps/v1",
+	"DaemonSet":             "apps/v1",
+	"ArmadaChart":           "armada.airshipit.org/v1alpha1",
+}
+
+// Prerequisite is an object which must be ready before a release is installed.
+// The object is selected either by name or by labels. When selected by labels,
+// at least one object must exist and all of them must be ready.
+type Prerequisite struct {
+	APIVersion string            `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty"`
+	Kind       string            `json:"kind" yaml:"kind"`
+	Namespace  string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// GroupVersionKind returns the GVK of the Prerequisite
+func (p Prerequisite) GroupVersionKind() schema.GroupVersionKind {
+	apiVersion := p.APIVersion
+	if apiVersion == "" {
+		apiVersion = defaultAPIVersions[p.Kind]
+	}
+	return schema.FromAPIVersionAndKind(apiVersion, p.Kind)
+}
+
+// String returns a short description of the Prerequisite
+func (p Prerequisite) String() string {
+	if p.Name != "" {
+		return fmt.Sprintf("%s/%s/%s", p.Kind, p.Namespace, p.Name)
+	}
+	keys := make([]string, 0, len(p.Labels))
+	for key := range p.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	selector := make([]string, 0, len(keys))
+	for _, key := range keys {
+		selector = append(selector, key+"="+p.Labels[key])
+	}
+	return fmt.Sprintf("%s/%s/{%s}", p.Kind, p.Namespace, strings.Join(selector, ","))
+}
+
+// Matches checks if the object is selected by the Prerequisite
+func (p Prerequisite) Matches(gvk schema.GroupVersionKind, o metav1.Object) bool {
+	if gvk != p.GroupVersionKind() || o.GetNamespace() != p.Namespace {
+		return false
+	}
+	if p.Name != "" {
+		return o.GetName() == p.Name
+	}
+	return labels.SelectorFromSet(p.Labels).Matches(labels.Set(o.GetLabels()))
+}
+
+// defaultPrerequisites checks the prerequisites listed in the spec of an
+// ArmadaChart. Prerequisites without namespace default to namespace.
+func defaultPrerequisites(prereqs []Prerequisite, namespace string) error {
+	for i := range prereqs {
+		prereq := &prereqs[i]
+		if prereq.Kind == "" || prereq.GroupVersionKind().Version == "" {
+			return fmt.Errorf("%w: wait_for: apiVersion and kind are required for %s",
+				InvalidArmadaObjectException, prereq)
+		}
+		if prereq.Name == "" && len(prereq.Labels) == 0 {
+			return fmt.Errorf("%w: wait_for: name or labels are required for %s",
+				InvalidArmadaObjectException, prereq)
+		}
+		if prereq.Namespace == "" {
+			prereq.Namespace = namespace
+		}
+	}
+	return nil
+}
+
+// CheckPrerequisites returns the description of the prerequisites which are
+// not ready yet.
+func (obj *KubernetesDependency) CheckPrerequisites(ctx context.Context, prereqs []Prerequisite) ([]string, error) {
+	blockers := make([]string, 0)
+	for _, prereq := range prereqs {
+		items, err := obj.getPrerequisiteObjects(ctx, prereq)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			blockers = append(blockers, fmt.Sprintf("%s (NotFound)", prereq))
+			continue
+		}
+		for i := range items {
+			if !obj.IsUnstructuredReady(&items[i]) {
+				blockers = append(blockers, fmt.Sprintf("%s (NotReady)", prereq))
+				break
+			}
+		}
+	}
+	return blockers, nil
+}
+
+// getPrerequisiteObjects fetches the objects matching the Prerequisite
+func (obj *KubernetesDependency) getPrerequisiteObjects(ctx context.Context, prereq Prerequisite) ([]unstructured.Unstructured, error) {
+	gvk := prereq.GroupVersionKind()
+
+	if prereq.Name != "" {
+		u := unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		err := obj.reader.Get(ctx, types.NamespacedName{Namespace: prereq.Namespace, Name: prereq.Name}, &u)
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []unstructured.Unstructured{u}, nil
+	}
+
+	list := unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	err := obj.reader.List(ctx, &list, client.InNamespace(prereq.Namespace), client.MatchingLabels(prereq.Labels))
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
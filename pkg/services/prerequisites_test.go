@@ -0,0 +1,93 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDefaultPrerequisites(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	prereqs := []Prerequisite{
+		{Kind: "Service", Name: "mariadb"},
+		{Kind: "Pod", Namespace: "infra", Labels: map[string]string{"application": "memcached"}},
+	}
+	g.Expect(defaultPrerequisites(prereqs, "openstack")).To(gomega.Succeed())
+	g.Expect(prereqs[0].Namespace).To(gomega.Equal("openstack"))
+	g.Expect(prereqs[1].String()).To(gomega.Equal("Pod/infra/{application=memcached}"))
+
+	err := defaultPrerequisites([]Prerequisite{{Kind: "Widget", Name: "foo"}}, "openstack")
+	g.Expect(errors.Is(err, InvalidArmadaObjectException)).To(gomega.BeTrue())
+
+	err = defaultPrerequisites([]Prerequisite{{Kind: "Service"}}, "openstack")
+	g.Expect(errors.Is(err, InvalidArmadaObjectException)).To(gomega.BeTrue())
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "openstack", Name: "mariadb-bootstrap"},
+		Status:     batchv1.JobStatus{Succeeded: 1},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "openstack", Name: "memcached-0",
+			Labels: map[string]string{"application": "memcached"}},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionFalse}}},
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(job, pod).Build()
+	dep := NewKubernetesDependency(reader)
+
+	blockers, err := dep.CheckPrerequisites(context.TODO(), []Prerequisite{
+		{Kind: "Job", Namespace: "openstack", Name: "mariadb-bootstrap"},
+		{Kind: "Service", Namespace: "openstack", Name: "mariadb"},
+		{Kind: "Pod", Namespace: "openstack", Labels: map[string]string{"application": "memcached"}},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(blockers).To(gomega.Equal([]string{
+		"Service/openstack/mariadb (NotFound)",
+		"Pod/openstack/{application=memcached} (NotReady)",
+	}))
+}
+
+func TestPrerequisiteMatches(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	podGVK := corev1.SchemeGroupVersion.WithKind("Pod")
+	pod := &metav1.ObjectMeta{Namespace: "openstack", Name: "memcached-0",
+		Labels: map[string]string{"application": "memcached", "component": "server"}}
+
+	byLabels := Prerequisite{Kind: "Pod", Namespace: "openstack", Labels: map[string]string{"application": "memcached"}}
+	g.Expect(byLabels.Matches(podGVK, pod)).To(gomega.BeTrue())
+	g.Expect(byLabels.Matches(batchv1.SchemeGroupVersion.WithKind("Job"), pod)).To(gomega.BeFalse())
+
+	byName := Prerequisite{Kind: "Pod", Namespace: "openstack", Name: "memcached-1"}
+	g.Expect(byName.Matches(podGVK, pod)).To(gomega.BeFalse())
+
+	otherNamespace := Prerequisite{Kind: "Pod", Namespace: "infra", Name: "memcached-0"}
+	g.Expect(otherNamespace.Matches(podGVK, pod)).To(gomega.BeFalse())
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"fmt"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ChildStatus is the state of an ArmadaChart of an ArmadaChartGroup, or of an
+// ArmadaChartGroup of an ArmadaManifest.
+type ChildStatus struct {
+	Name               string                `json:"name"`
+	ActualState        av1.HelmResourceState `json:"actual_state,omitempty"`
+	LastTransitionTime *metav1.Time          `json:"lastTransitionTime,omitempty"`
+	Revision           int32                 `json:"revision,omitempty"`
+}
+
+// Progress summarizes the deployment of the children of an ArmadaChartGroup
+// or of an ArmadaManifest. The summary is recorded as the Progress condition
+// and the whole progress in status.progress.
+type Progress struct {
+	Deployed int           `json:"deployed"`
+	Total    int           `json:"total"`
+	Summary  string        `json:"summary"`
+	Children []ChildStatus `json:"children"`
+}
+
+// newChildStatus returns the state of a child. The last transition time and
+// the revision are the most recent ones found in its conditions.
+func newChildStatus(name string, status *av1.HelmResourceStatus) ChildStatus {
+	child := ChildStatus{Name: name, ActualState: status.ActualState}
+	for i := range status.Conditions {
+		condition := &status.Conditions[i]
+		if child.LastTransitionTime == nil || child.LastTransitionTime.Before(&condition.LastTransitionTime) {
+			child.LastTransitionTime = condition.LastTransitionTime.DeepCopy()
+		}
+		if condition.ResourceVersion > child.Revision {
+			child.Revision = condition.ResourceVersion
+		}
+	}
+	return child
+}
+
+// newProgress counts the deployed children.
+func newProgress(children []ChildStatus) *Progress {
+	progress := &Progress{Total: len(children), Children: children}
+	for _, child := range children {
+		if child.ActualState == av1.StateDeployed {
+			progress.Deployed++
+		}
+	}
+	progress.Summary = fmt.Sprintf("%d/%d", progress.Deployed, progress.Total)
+	return progress
+}
+
+// Condition returns the Progress condition. Its message is the summary,
+// which is displayed by the Progress printer column.
+func (p *Progress) Condition() av1.HelmResourceCondition {
+	hrc := av1.HelmResourceCondition{
+		Type:    ConditionProgress,
+		Status:  av1.ConditionStatusTrue,
+		Reason:  ReasonChildrenDeployed,
+		Message: p.Summary,
+	}
+	if p.Deployed < p.Total {
+		hrc.Status = av1.ConditionStatusFalse
+		hrc.Reason = ReasonChildrenPending
+	}
+	return hrc
+}
+
+// NewChartProgress returns the Progress of the ArmadaCharts of an ArmadaChartGroup.
+func NewChartProgress(charts []av1.ArmadaChart) *Progress {
+	children := make([]ChildStatus, 0, len(charts))
+	for i := range charts {
+		children = append(children, newChildStatus(charts[i].GetName(), &charts[i].Status.HelmResourceStatus))
+	}
+	return newProgress(children)
+}
+
+// NewChartGroupProgress returns the Progress of the ArmadaChartGroups of an ArmadaManifest.
+func NewChartGroupProgress(chartGroups []av1.ArmadaChartGroup) *Progress {
+	children := make([]ChildStatus, 0, len(chartGroups))
+	for i := range chartGroups {
+		children = append(children, newChildStatus(chartGroups[i].GetName(), &chartGroups[i].Status.HelmResourceStatus))
+	}
+	return newProgress(children)
+}
+
+// progressStatusExtensions holds the fields of the status of an ArmadaChartGroup
+// or of an ArmadaManifest which are not part of the status types of armada-crd.
+type progressStatusExtensions struct {
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// UpdateArmadaChartGroupStatus writes the typed status of the ArmadaChartGroup
+// along with its progress, which a typed status update would drop.
+func UpdateArmadaChartGroupStatus(ctx context.Context, c client.Client, chartGroup *av1.ArmadaChartGroup, progress *Progress) error {
+	doc := av1.NewArmadaChartGroupVersionKind(chartGroup.GetNamespace(), chartGroup.GetName())
+	return updateStatus(ctx, c, chartGroup, doc, &progressStatusExtensions{Progress: progress})
+}
+
+// UpdateArmadaManifestStatus writes the typed status of the ArmadaManifest
+// along with its progress, which a typed status update would drop.
+func UpdateArmadaManifestStatus(ctx context.Context, c client.Client, manifest *av1.ArmadaManifest, progress *Progress) error {
+	doc := av1.NewArmadaManifestVersionKind(manifest.GetNamespace(), manifest.GetName())
+	return updateStatus(ctx, c, manifest, doc, &progressStatusExtensions{Progress: progress})
+}
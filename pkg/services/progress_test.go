@@ -0,0 +1,89 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	av1 "github.com/keleustes/armada-crd/pkg/apis/armada/v1alpha1"
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewChartProgress(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	installed := metav1.NewTime(time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC))
+	upgraded := metav1.NewTime(time.Date(2019, 5, 1, 11, 0, 0, 0, time.UTC))
+
+	mariadb := av1.ArmadaChart{}
+	mariadb.SetName("mariadb")
+	mariadb.Status.ActualState = av1.StateDeployed
+	mariadb.Status.Conditions = []av1.HelmResourceCondition{
+		{Type: av1.ConditionRunning, ResourceVersion: 1, LastTransitionTime: installed},
+		{Type: av1.ConditionDeployed, ResourceVersion: 2, LastTransitionTime: upgraded},
+	}
+	keystone := av1.ArmadaChart{}
+	keystone.SetName("keystone")
+	keystone.Status.ActualState = av1.StateRunning
+	glance := av1.ArmadaChart{}
+	glance.SetName("glance")
+
+	progress := NewChartProgress([]av1.ArmadaChart{mariadb, keystone, glance})
+	g.Expect(progress.Summary).To(gomega.Equal("1/3"))
+	g.Expect(progress.Children).To(gomega.HaveLen(3))
+	g.Expect(progress.Children[0].Revision).To(gomega.Equal(int32(2)))
+	g.Expect(progress.Children[0].LastTransitionTime.Equal(&upgraded)).To(gomega.BeTrue())
+	g.Expect(progress.Children[2].LastTransitionTime).To(gomega.BeNil())
+
+	hrc := progress.Condition()
+	g.Expect(hrc.Type).To(gomega.Equal(ConditionProgress))
+	g.Expect(hrc.Status).To(gomega.Equal(av1.ConditionStatusFalse))
+	g.Expect(hrc.Message).To(gomega.Equal("1/3"))
+}
+
+func TestUpdateArmadaChartGroupStatus(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	doc := av1.NewArmadaChartGroupVersionKind("openstack", "infra")
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(doc).Build()
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(doc), doc)).To(gomega.Succeed())
+
+	chartGroup := &av1.ArmadaChartGroup{}
+	chartGroup.SetNamespace(doc.GetNamespace())
+	chartGroup.SetName(doc.GetName())
+	chartGroup.SetResourceVersion(doc.GetResourceVersion())
+
+	// The children are written along with the typed status
+	mariadb := av1.ArmadaChart{}
+	mariadb.SetName("mariadb")
+	mariadb.Status.ActualState = av1.StateDeployed
+	progress := NewChartProgress([]av1.ArmadaChart{mariadb})
+	g.Expect(UpdateArmadaChartGroupStatus(context.TODO(), c, chartGroup, progress)).To(gomega.Succeed())
+
+	g.Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(doc), doc)).To(gomega.Succeed())
+	children, _, err := unstructured.NestedSlice(doc.Object, "status", "progress", "children")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(children).To(gomega.HaveLen(1))
+	g.Expect(children[0]).To(gomega.HaveKeyWithValue("name", "mariadb"))
+	g.Expect(chartGroup.GetResourceVersion()).To(gomega.Equal(doc.GetResourceVersion()))
+}
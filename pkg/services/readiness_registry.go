@@ -0,0 +1,346 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/jsonpath"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ReadyFunc checks if an object is ready
+type ReadyFunc func(dep *KubernetesDependency, u *unstructured.Unstructured) bool
+
+// FailedOrErrorFunc checks if an object failed
+type FailedOrErrorFunc func(dep *KubernetesDependency, u *unstructured.Unstructured) bool
+
+// StatusChangedFunc compares the status of two versions of an object
+type StatusChangedFunc func(dep *KubernetesDependency, u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string)
+
+// ReadinessRule groups the evaluators used for a GroupVersionKind.
+type ReadinessRule struct {
+	IsReady         ReadyFunc
+	IsFailedOrError FailedOrErrorFunc
+	StatusChanged   StatusChangedFunc
+}
+
+// ReadinessRegistry holds the ReadinessRules keyed by GroupVersionKind.
+// The rules loaded from a ConfigMap are kept apart from the registered
+// ones so that a reload can replace or remove them.
+type ReadinessRegistry struct {
+	m          sync.RWMutex
+	rules      map[schema.GroupVersionKind]ReadinessRule
+	configured map[schema.GroupVersionKind]ReadinessRule
+	version    string
+}
+
+// NewReadinessRegistry returns an empty ReadinessRegistry.
+func NewReadinessRegistry() *ReadinessRegistry {
+	return &ReadinessRegistry{rules: map[schema.GroupVersionKind]ReadinessRule{}}
+}
+
+// DefaultReadinessRegistry is the registry used by the KubernetesDependency.
+// The built-in rules are registered at init.
+var DefaultReadinessRegistry = NewReadinessRegistry()
+
+// Register adds or replaces the rule of a GroupVersionKind.
+func (r *ReadinessRegistry) Register(gvk schema.GroupVersionKind, rule ReadinessRule) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.rules[gvk] = rule
+}
+
+// Lookup returns the rule of a GroupVersionKind. The rules loaded from the
+// ConfigMap take precedence over the registered ones.
+func (r *ReadinessRegistry) Lookup(gvk schema.GroupVersionKind) (ReadinessRule, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if rule, found := r.configured[gvk]; found {
+		return rule, found
+	}
+	rule, found := r.rules[gvk]
+	return rule, found
+}
+
+// Register the built-in rules
+func init() {
+	register := func(rule ReadinessRule, gvks ...schema.GroupVersionKind) {
+		for _, gvk := range gvks {
+			DefaultReadinessRegistry.Register(gvk, rule)
+		}
+	}
+
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsPodReady,
+		IsFailedOrError: (*KubernetesDependency).IsPodFailedOrError,
+		StatusChanged:   (*KubernetesDependency).PodStatusChanged,
+	},
+		schema.GroupVersionKind{Version: "v1", Kind: "Pod"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsJobReady,
+		IsFailedOrError: (*KubernetesDependency).IsJobFailedOrError,
+		StatusChanged:   (*KubernetesDependency).JobStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsServiceReady,
+		IsFailedOrError: (*KubernetesDependency).IsServiceFailedOrError,
+		StatusChanged:   (*KubernetesDependency).ServiceStatusChanged,
+	},
+		schema.GroupVersionKind{Version: "v1", Kind: "Service"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsPersistentVolumeClaimReady,
+		IsFailedOrError: (*KubernetesDependency).IsPersistentVolumeClaimFailedOrError,
+		StatusChanged:   (*KubernetesDependency).PersistentVolumeClaimStatusChanged,
+	},
+		schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsDeploymentReady,
+		IsFailedOrError: (*KubernetesDependency).IsDeploymentFailedOrError,
+		StatusChanged:   (*KubernetesDependency).DeploymentStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Deployment"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsStatefulSetReady,
+		IsFailedOrError: (*KubernetesDependency).IsStatefulSetFailedOrError,
+		StatusChanged:   (*KubernetesDependency).StatefulSetStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsDaemonSetReady,
+		IsFailedOrError: (*KubernetesDependency).IsDaemonSetFailedOrError,
+		StatusChanged:   (*KubernetesDependency).DaemonSetStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+		schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "DaemonSet"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsIngressReady,
+		IsFailedOrError: (*KubernetesDependency).IsIngressFailedOrError,
+		StatusChanged:   (*KubernetesDependency).IngressStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+		schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"},
+		schema.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Ingress"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsCronJobReady,
+		IsFailedOrError: (*KubernetesDependency).IsCronJobFailedOrError,
+		StatusChanged:   (*KubernetesDependency).CronJobStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+		schema.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsPodDisruptionBudgetReady,
+		IsFailedOrError: (*KubernetesDependency).IsPodDisruptionBudgetFailedOrError,
+		StatusChanged:   (*KubernetesDependency).PodDisruptionBudgetStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "policy", Version: "v1", Kind: "PodDisruptionBudget"},
+		schema.GroupVersionKind{Group: "policy", Version: "v1beta1", Kind: "PodDisruptionBudget"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsWorkflowReady,
+		IsFailedOrError: (*KubernetesDependency).IsWorkflowFailedOrError,
+		StatusChanged:   (*KubernetesDependency).WorkflowStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsArmadaChartReady,
+		IsFailedOrError: (*KubernetesDependency).IsArmadaChartFailedOrError,
+		StatusChanged:   (*KubernetesDependency).ArmadaChartStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "armada.airshipit.org", Version: "v1alpha1", Kind: "ArmadaChart"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsArmadaChartGroupReady,
+		IsFailedOrError: (*KubernetesDependency).IsArmadaChartGroupFailedOrError,
+		StatusChanged:   (*KubernetesDependency).ArmadaChartGroupStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "armada.airshipit.org", Version: "v1alpha1", Kind: "ArmadaChartGroup"})
+	register(ReadinessRule{
+		IsReady:         (*KubernetesDependency).IsArmadaManifestReady,
+		IsFailedOrError: (*KubernetesDependency).IsArmadaManifestFailedOrError,
+		StatusChanged:   (*KubernetesDependency).ArmadaManifestStatusChanged,
+	},
+		schema.GroupVersionKind{Group: "armada.airshipit.org", Version: "v1alpha1", Kind: "ArmadaManifest"})
+}
+
+// FieldRule matches the value found at a JSONPath against a list of values.
+type FieldRule struct {
+	Path   string   `json:"path" yaml:"path"`
+	Values []string `json:"values" yaml:"values"`
+}
+
+// ConfigurableRule describes the readiness of a third-party custom resource.
+// The object is ready when all the Ready FieldRules match and failed when any
+// of the Failed FieldRules matches. The status is considered changed when any
+// of the paths of the rules returns a different value.
+type ConfigurableRule struct {
+	Group   string      `json:"group" yaml:"group"`
+	Version string      `json:"version" yaml:"version"`
+	Kind    string      `json:"kind" yaml:"kind"`
+	Ready   []FieldRule `json:"ready" yaml:"ready"`
+	Failed  []FieldRule `json:"failed,omitempty" yaml:"failed,omitempty"`
+}
+
+// GroupVersionKind returns the GroupVersionKind the rule applies to.
+func (c ConfigurableRule) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: c.Group, Version: c.Version, Kind: c.Kind}
+}
+
+// ToReadinessRule builds the evaluators of a ConfigurableRule.
+func (c ConfigurableRule) ToReadinessRule() (ReadinessRule, error) {
+	paths := make([]*jsonpath.JSONPath, 0)
+	for _, fieldRule := range append(append([]FieldRule{}, c.Ready...), c.Failed...) {
+		parser := jsonpath.New(c.Kind).AllowMissingKeys(true)
+		if err := parser.Parse(normalizePath(fieldRule.Path)); err != nil {
+			return ReadinessRule{}, fmt.Errorf("invalid path %s for %s: %s", fieldRule.Path, c.GroupVersionKind(), err)
+		}
+		paths = append(paths, parser)
+	}
+	readyPaths := paths[:len(c.Ready)]
+	failedPaths := paths[len(c.Ready):]
+
+	matches := func(parser *jsonpath.JSONPath, expectedValues []string, u *unstructured.Unstructured) bool {
+		actualValue := evaluatePath(parser, u)
+		for _, expectedValue := range expectedValues {
+			if actualValue == expectedValue {
+				return true
+			}
+		}
+		return false
+	}
+
+	return ReadinessRule{
+		IsReady: func(dep *KubernetesDependency, u *unstructured.Unstructured) bool {
+			for i, fieldRule := range c.Ready {
+				if !matches(readyPaths[i], fieldRule.Values, u) {
+					return false
+				}
+			}
+			return true
+		},
+		IsFailedOrError: func(dep *KubernetesDependency, u *unstructured.Unstructured) bool {
+			for i, fieldRule := range c.Failed {
+				if matches(failedPaths[i], fieldRule.Values, u) {
+					return true
+				}
+			}
+			return false
+		},
+		StatusChanged: func(dep *KubernetesDependency, u *unstructured.Unstructured, v *unstructured.Unstructured) (bool, string, string) {
+			if u == nil || v == nil {
+				return true, "", ""
+			}
+			var uValues, vValues []string
+			for _, parser := range paths {
+				uValues = append(uValues, evaluatePath(parser, u))
+				vValues = append(vValues, evaluatePath(parser, v))
+			}
+			uValue := fmt.Sprintf("%v", uValues)
+			vValue := fmt.Sprintf("%v", vValues)
+			return uValue != vValue, uValue, vValue
+		},
+	}, nil
+}
+
+// evaluatePath returns the value found at a JSONPath, or "" if the
+// path does not exist.
+func evaluatePath(parser *jsonpath.JSONPath, u *unstructured.Unstructured) string {
+	if u == nil {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	if err := parser.Execute(buf, u.UnstructuredContent()); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// ParseReadinessRules parses a YAML list of ConfigurableRule.
+func ParseReadinessRules(data []byte) ([]ConfigurableRule, error) {
+	rules := make([]ConfigurableRule, 0)
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse readiness rules: %s", err)
+	}
+	return rules, nil
+}
+
+// LoadReadinessRules replaces the rules previously loaded in the registry
+// by the ones found in every key of the ConfigMap. A missing ConfigMap
+// removes them and is not considered an error. If the ConfigMap is invalid,
+// the previously loaded rules are kept.
+func (r *ReadinessRegistry) LoadReadinessRules(ctx context.Context, reader client.Reader, key types.NamespacedName) error {
+	configMap := &corev1.ConfigMap{}
+	if err := reader.Get(ctx, key, configMap); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		r.setConfiguredRules(map[schema.GroupVersionKind]ReadinessRule{}, "")
+		return nil
+	}
+
+	r.m.RLock()
+	unchanged := r.version != "" && r.version == configMap.ResourceVersion
+	r.m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	configured := map[schema.GroupVersionKind]ReadinessRule{}
+	for dataKey, data := range configMap.Data {
+		rules, err := ParseReadinessRules([]byte(data))
+		if err != nil {
+			return fmt.Errorf("%s/%s: %s", key, dataKey, err)
+		}
+		for _, rule := range rules {
+			readinessRule, err := rule.ToReadinessRule()
+			if err != nil {
+				return fmt.Errorf("%s/%s: %s", key, dataKey, err)
+			}
+			configured[rule.GroupVersionKind()] = readinessRule
+			log.Info("Loaded readiness rule", "gvk", rule.GroupVersionKind())
+		}
+	}
+	r.setConfiguredRules(configured, configMap.ResourceVersion)
+	return nil
+}
+
+// WatchReadinessRules reloads the rules of the ConfigMap every period until
+// the context is done, so that edits of the ConfigMap are picked up without
+// restarting the operator.
+func (r *ReadinessRegistry) WatchReadinessRules(ctx context.Context, reader client.Reader, key types.NamespacedName, period time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.LoadReadinessRules(ctx, reader, key); err != nil {
+			log.Error(err, "Failed to reload readiness rules", "configmap", key)
+		}
+	}, period)
+}
+
+func (r *ReadinessRegistry) setConfiguredRules(configured map[schema.GroupVersionKind]ReadinessRule, version string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.configured = configured
+	r.version = version
+}
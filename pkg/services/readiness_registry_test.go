@@ -0,0 +1,157 @@
+// Copyright 2019 The Armada Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestConfigurableReadinessRule(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	rules, err := ParseReadinessRules([]byte(`
+- group: ceph.rook.io
+  version: v1
+  kind: CephCluster
+  ready:
+    - path: .status.phase
+      values: ["Ready"]
+  failed:
+    - path: .status.phase
+      values: ["Failure"]
+`))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(rules).To(gomega.HaveLen(1))
+
+	registry := NewReadinessRegistry()
+	rule, err := rules[0].ToReadinessRule()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	registry.Register(rules[0].GroupVersionKind(), rule)
+	dep := &KubernetesDependency{registry: registry}
+
+	cluster := newUnstructured("CephCluster", map[string]interface{}{
+		"apiVersion": "ceph.rook.io/v1",
+	})
+	g.Expect(dep.IsUnstructuredReady(cluster)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredFailedOrError(cluster)).To(gomega.BeFalse())
+
+	ready := cluster.DeepCopy()
+	_ = unstructured.SetNestedField(ready.Object, "Ready", "status", "phase")
+	g.Expect(dep.IsUnstructuredReady(ready)).To(gomega.BeTrue())
+
+	failed := cluster.DeepCopy()
+	_ = unstructured.SetNestedField(failed.Object, "Failure", "status", "phase")
+	g.Expect(dep.IsUnstructuredFailedOrError(failed)).To(gomega.BeTrue())
+
+	changed, _, _ := dep.UnstructuredStatusChanged(ready, failed)
+	g.Expect(changed).To(gomega.BeTrue())
+}
+
+func TestGenericReadiness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dep := &KubernetesDependency{registry: NewReadinessRegistry()}
+
+	widget := newUnstructured("Widget", map[string]interface{}{
+		"apiVersion": "example.com/v1",
+	})
+	g.Expect(dep.IsUnstructuredReady(widget)).To(gomega.BeTrue())
+
+	inprogress := widget.DeepCopy()
+	inprogress.SetGeneration(2)
+	_ = unstructured.SetNestedField(inprogress.Object, int64(1), "status", "observedGeneration")
+	g.Expect(dep.IsUnstructuredReady(inprogress)).To(gomega.BeFalse())
+	g.Expect(dep.IsUnstructuredFailedOrError(inprogress)).To(gomega.BeFalse())
+
+	notready := widget.DeepCopy()
+	_ = unstructured.SetNestedSlice(notready.Object, []interface{}{
+		map[string]interface{}{"type": "Ready", "status": "False", "reason": "Pending"},
+	}, "status", "conditions")
+	g.Expect(dep.IsUnstructuredReady(notready)).To(gomega.BeFalse())
+
+	stalled := widget.DeepCopy()
+	_ = unstructured.SetNestedSlice(stalled.Object, []interface{}{
+		map[string]interface{}{"type": "Ready", "status": "False"},
+		map[string]interface{}{"type": "Stalled", "status": "True", "message": "bad spec"},
+	}, "status", "conditions")
+	g.Expect(dep.IsUnstructuredFailedOrError(stalled)).To(gomega.BeTrue())
+
+	changed, _, _ := dep.UnstructuredStatusChanged(notready, stalled)
+	g.Expect(changed).To(gomega.BeTrue())
+}
+
+func TestReloadReadinessRules(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	key := types.NamespacedName{Namespace: "armada", Name: "readiness-rules"}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data: map[string]string{"rules.yaml": `
+- group: ceph.rook.io
+  version: v1
+  kind: CephCluster
+  ready:
+    - path: .status.phase
+      values: ["Ready"]
+- version: v1
+  kind: Pod
+  ready:
+    - path: .status.phase
+      values: ["Running"]
+`},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(configMap).Build()
+
+	builtin := ReadinessRule{IsReady: func(dep *KubernetesDependency, u *unstructured.Unstructured) bool { return false }}
+	podGVK := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	cephGVK := schema.GroupVersionKind{Group: "ceph.rook.io", Version: "v1", Kind: "CephCluster"}
+	registry := NewReadinessRegistry()
+	registry.Register(podGVK, builtin)
+
+	g.Expect(registry.LoadReadinessRules(context.TODO(), c, key)).To(gomega.Succeed())
+	_, found := registry.Lookup(cephGVK)
+	g.Expect(found).To(gomega.BeTrue())
+	rule, _ := registry.Lookup(podGVK)
+	pod := newUnstructured("Pod", map[string]interface{}{"apiVersion": "v1"})
+	_ = unstructured.SetNestedField(pod.Object, "Running", "status", "phase")
+	g.Expect(rule.IsReady(nil, pod)).To(gomega.BeTrue())
+
+	// Rules removed from the ConfigMap are unregistered and the
+	// built-in rules they overrode are restored
+	configMap.Data = map[string]string{}
+	g.Expect(c.Update(context.TODO(), configMap)).To(gomega.Succeed())
+	g.Expect(registry.LoadReadinessRules(context.TODO(), c, key)).To(gomega.Succeed())
+	_, found = registry.Lookup(cephGVK)
+	g.Expect(found).To(gomega.BeFalse())
+	rule, _ = registry.Lookup(podGVK)
+	g.Expect(rule.IsReady(nil, pod)).To(gomega.BeFalse())
+
+	// An invalid ConfigMap keeps the loaded rules
+	configMap.Data = map[string]string{"rules.yaml": "- kind: [\n"}
+	g.Expect(c.Update(context.TODO(), configMap)).To(gomega.Succeed())
+	g.Expect(registry.LoadReadinessRules(context.TODO(), c, key)).NotTo(gomega.Succeed())
+	rule, _ = registry.Lookup(podGVK)
+	g.Expect(rule.IsReady(nil, pod)).To(gomega.BeFalse())
+}
@@ -89,3 +89,32 @@ func BuildDependentResourceWatchUpdater(mgr manager.Manager, owner *unstructured
 
 	return watchUpdater
 }
+
+// KindWatchUpdater adds a watch for the GroupVersionKinds which are not watched yet.
+type KindWatchUpdater func([]schema.GroupVersionKind) error
+
+// BuildKindWatchUpdater builds a function that adds watches handling the events
+// of the objects of a GroupVersionKind with the handler.
+func BuildKindWatchUpdater(c controller.Controller, handler crthandler.EventHandler) KindWatchUpdater {
+	var m sync.Mutex
+	watches := map[schema.GroupVersionKind]struct{}{}
+	return func(gvks []schema.GroupVersionKind) error {
+		m.Lock()
+		defer m.Unlock()
+		for _, gvk := range gvks {
+			if _, ok := watches[gvk]; ok {
+				continue
+			}
+
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(gvk)
+			if err := c.Watch(&source.Kind{Type: u}, handler); err != nil {
+				log.Error(err, "Add Watch to Controller", "resourceType", gvk.GroupVersion(), "resourceKind", gvk.Kind)
+				return err
+			}
+			log.Info("Added watch", "resourceType", gvk.GroupVersion(), "resourceKind", gvk.Kind)
+			watches[gvk] = struct{}{}
+		}
+		return nil
+	}
+}